@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/age"
+	"e2e-message/internal/identity"
+)
+
+// Files in testdata/age were created with filippo.io/age v1.2.1
+
+// pattern returns the plaintext of two-chunks.age
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func loadTestIdentities(t *testing.T, name string) []*age.Identity {
+	t.Helper()
+	ids, err := loadAgeIdentities(filepath.Join("testdata", "age", name))
+	if err != nil {
+		t.Fatalf("loading %s failed: %v", name, err)
+	}
+	t.Cleanup(func() {
+		for _, id := range ids {
+			id.Close()
+		}
+	})
+	return ids
+}
+
+func decryptFile(t *testing.T, name string, ids []*age.Identity) ([]byte, error) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "age", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := age.Decrypt(f, ids...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestAgeInteropVectors(t *testing.T) {
+	ids := loadTestIdentities(t, "identity.txt")
+	tests := []struct {
+		file string
+		want []byte
+	}{
+		{"hello.age", []byte("Hello from age!\n")},
+		{"empty.age", nil},
+		{"two-chunks.age", pattern(64<<10 + 1)},
+		{"two-recipients.age", []byte("for both of us\n")},
+		{"mixed-recipients.age", []byte("for SSH and age keys\n")}, // ssh-rsa and ssh-ed25519 stanzas first
+	}
+	for _, tt := range tests {
+		got, err := decryptFile(t, tt.file, ids)
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %d bytes, want %d", tt.file, len(got), len(tt.want))
+		}
+	}
+
+	if _, err := decryptFile(t, "other.age", ids); !errors.Is(err, age.ErrNoIdentity) {
+		t.Errorf("Expected ErrNoIdentity, got %v", err)
+	}
+	other := loadTestIdentities(t, "ed25519-identity.pem")
+	if _, err := decryptFile(t, "mixed-recipients.age", other); !errors.Is(err, age.ErrNoIdentity) || !strings.Contains(err.Error(), "ssh-rsa") {
+		t.Errorf("Expected ErrNoIdentity naming ssh-rsa, got %v", err)
+	}
+}
+
+func TestAgeIdentityKey(t *testing.T) {
+	ids := loadTestIdentities(t, "ed25519-identity.pem")
+	want, _ := os.ReadFile(filepath.Join("testdata", "age", "ed25519-recipient.txt"))
+	if got := ids[0].Recipient().String(); got != strings.TrimSpace(string(want)) {
+		t.Errorf("Recipient %s, want %s", got, want)
+	}
+
+	// The recipient can also be computed from the public identity key alone
+	id, err := identity.Load(filepath.Join("testdata", "age", "ed25519-identity.pem"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer id.Close()
+	r, err := ageRecipient(id.PublicKey())
+	if err != nil || r.String() != ids[0].Recipient().String() {
+		t.Errorf("ageRecipient = %v, %v", r, err)
+	}
+
+	got, err := decryptFile(t, "ed25519.age", ids)
+	if err != nil || string(got) != "Hello, identity key!\n" {
+		t.Errorf("Decrypt = %q, %v", got, err)
+	}
+}
+
+func TestAgeSSHRecipient(t *testing.T) {
+	// Created with age -R testdata/ssh/id_ed25519.pub
+	ids, err := loadAgeIdentities(sshTestFile("id_ed25519"))
+	if err != nil {
+		t.Fatalf("loadAgeIdentities failed: %v", err)
+	}
+	defer ids[0].Close()
+	for file, want := range map[string]string{
+		"ssh-ed25519.age":      "to an SSH key\n",
+		"mixed-recipients.age": "for SSH and age keys\n",
+	} {
+		if got, err := decryptFile(t, file, ids); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", file, got, err)
+		}
+	}
+
+	// Only the SSH key's own identity opens the stanza
+	for _, name := range []string{"identity.txt", "ed25519-identity.pem"} {
+		if _, err := decryptFile(t, "ssh-ed25519.age", loadTestIdentities(t, name)); !errors.Is(err, age.ErrNoIdentity) {
+			t.Errorf("%s: expected ErrNoIdentity, got %v", name, err)
+		}
+	}
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	ids := loadTestIdentities(t, "identity.txt")
+	other := loadTestIdentities(t, "ed25519-identity.pem")
+
+	for _, size := range []int{0, 1, 64 << 10, 64<<10 + 1, 3 << 16} {
+		plaintext := pattern(size)
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, other[0].Recipient(), ids[0].Recipient())
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		w.Write(plaintext)
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		encrypted := buf.Bytes()
+
+		r, err := age.Decrypt(bytes.NewReader(encrypted), ids...)
+		if err != nil {
+			t.Fatalf("Decrypt of %d bytes failed: %v", size, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("Round trip of %d bytes gave %d bytes, %v", size, len(got), err)
+		}
+
+		// Truncating or altering the payload is detected
+		tampered := bytes.Clone(encrypted)
+		tampered[len(tampered)-1] ^= 1
+		for _, data := range [][]byte{tampered, encrypted[:len(encrypted)-1]} {
+			r, err := age.Decrypt(bytes.NewReader(data), ids...)
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if err == nil {
+				t.Errorf("Tampered %d-byte file decrypted", size)
+			}
+		}
+	}
+}
+
+func TestAgeRecipientParsing(t *testing.T) {
+	ids := loadTestIdentities(t, "identity.txt")
+	s := ids[0].Recipient().String()
+	if r, err := age.ParseRecipient(s); err != nil || r.String() != s {
+		t.Errorf("ParseRecipient(%s) = %v, %v", s, r, err)
+	}
+	for _, bad := range []string{
+		s[:len(s)-1] + "q",                    // Checksum
+		"Age1" + s[4:],                        // Mixed case
+		strings.ToUpper(s),                    // Recipients are lower case, as in age
+		strings.Replace(s, "age1", "agx1", 1), // Wrong prefix
+	} {
+		if _, err := age.ParseRecipient(bad); err == nil {
+			t.Errorf("ParseRecipient(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestAgeCommands(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("E2E_MESSAGE_HOME", dir)
+	in := filepath.Join(dir, "plain.txt")
+	os.WriteFile(in, []byte("file for a teammate\n"), 0o600)
+	enc := filepath.Join(dir, "plain.txt.age")
+	out := filepath.Join(dir, "out.txt")
+
+	// Encrypt to our own identity key by its age recipient
+	id, err := loadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeIdentity()
+	r, _ := ageRecipient(id.PublicKey())
+
+	var stdout bytes.Buffer
+	if code := runCommand([]string{"age-encrypt", "-r", r.String(), "-o", enc, in}, nil, &stdout); code != 0 {
+		t.Fatalf("age-encrypt exited with %d", code)
+	}
+	if code := runCommand([]string{"age-encrypt", "-r", r.String(), "-o", enc, in}, nil, &stdout); code == 0 {
+		t.Error("age-encrypt overwrote an existing file")
+	}
+
+	// Decrypting without -i uses our identity
+	if code := runCommand([]string{"age-decrypt", "-o", out, enc}, nil, &stdout); code != 0 {
+		t.Fatalf("age-decrypt exited with %d", code)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "file for a teammate\n" {
+		t.Errorf("Decrypted %q", got)
+	}
+
+	// A wrong identity leaves no output file behind
+	out2 := filepath.Join(dir, "out2.txt")
+	identityTxt := filepath.Join("testdata", "age", "identity.txt")
+	if code := runCommand([]string{"age-decrypt", "-i", identityTxt, "-o", out2, enc}, nil, &stdout); code == 0 {
+		t.Error("age-decrypt with the wrong identity succeeded")
+	}
+	if _, err := os.Stat(out2); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Output file left behind: %v", err)
+	}
+
+	// Standard input and output, with a known peer as recipient
+	peers, _ := loadKnownPeers()
+	peers.Add("me", id.PublicKey())
+	stdout.Reset()
+	if code := runCommand([]string{"age-encrypt", "-r", "me"}, strings.NewReader("piped"), &stdout); code != 0 {
+		t.Fatalf("age-encrypt from stdin exited with %d", code)
+	}
+	var plain bytes.Buffer
+	if code := runCommand([]string{"age-decrypt"}, &stdout, &plain); code != 0 || plain.String() != "piped" {
+		t.Errorf("age-decrypt from stdin = %q, exit %d", plain.String(), code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/codec"
+	"e2e-message/internal/session"
+)
+
+func TestDecryptBatch(t *testing.T) {
+	alice, bob := establishedPair(t)
+	var lines []string
+	for i := 0; i < 7; i++ {
+		l, err := alice.Encrypt(fmt.Sprintf("message %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l)
+	}
+
+	// #0 arrived earlier; #2 and #4 never arrive
+	if _, err := bob.Decrypt(lines[0]); err != nil {
+		t.Fatal(err)
+	}
+	num, encoded, _ := strings.Cut(lines[5], " ")
+	ct, _ := codec.Decode(encoded)
+	ct[len(ct)-1] ^= 1
+	forged := num + " " + base64.StdEncoding.EncodeToString(ct)
+
+	batch := []string{
+		lines[6],
+		"",
+		forged, // Fails, but does not keep the genuine #5 from decrypting
+		lines[3],
+		lines[0], // Duplicate of an earlier message
+		"hello there",
+		lines[5],
+		lines[1],
+		lines[3], // Duplicate within the batch
+	}
+	res, err := bob.DecryptBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, m := range res.Messages {
+		got = append(got, fmt.Sprintf("%d:%s", m.Num, m.Text))
+	}
+	want := []string{"1:message 1", "3:message 3", "5:message 5", "6:message 6"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decrypted %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(res.Duplicates, []uint32{0, 3}) {
+		t.Errorf("Duplicates = %v, want [0 3]", res.Duplicates)
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Num != 5 || res.Failed[0].Line != 3 {
+		t.Errorf("Failed = %+v, want #5 on line 3", res.Failed)
+	}
+	if !reflect.DeepEqual(res.Invalid, []int{6}) {
+		t.Errorf("Invalid = %v, want [6]", res.Invalid)
+	}
+	if !reflect.DeepEqual(res.Missing, []uint32{2, 4}) {
+		t.Errorf("Missing = %v, want [2 4]", res.Missing)
+	}
+
+	summary := batchSummary(res)
+	for _, s := range []string{
+		"Decrypted:  #1, #3, #5, #6",
+		"Duplicate:  #0, #3",
+		"Failed:     #5 (line 3: decryption failed",
+		"line 6 (not a message)",
+		"Missing:    #2, #4",
+	} {
+		if !strings.Contains(summary, s) {
+			t.Errorf("Summary lacks %q:\n%s", s, summary)
+		}
+	}
+}
+
+func TestDecryptBatchParts(t *testing.T) {
+	alice, bob := establishedPair(t)
+	alice.SetPartSize(80)
+	first, _ := alice.EncryptMessage(&session.Message{Text: strings.Repeat("split over parts ", 12)})
+	alice.SetPartSize(0)
+	second, _ := alice.Encrypt("short")
+	third, _ := alice.EncryptMessage(&session.Message{Text: strings.Repeat("x", 300)})
+	if len(first) < 3 {
+		t.Fatalf("Expected several parts, got %d", len(first))
+	}
+
+	// Parts reversed and mixed with a later message; one part repeated
+	batch := []string{second}
+	for i := len(first) - 1; i >= 0; i-- {
+		batch = append(batch, first[i])
+	}
+	batch = append(batch, first[1])
+	res, err := bob.DecryptBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Messages) != 2 || res.Messages[0].Num != 0 || res.Messages[1].Text != "short" {
+		t.Fatalf("Messages = %+v", res.Messages)
+	}
+	if !reflect.DeepEqual(res.Duplicates, []uint32{0}) || len(res.Failed) != 0 || len(res.Incomplete) != 0 {
+		t.Errorf("Unexpected result %+v", res)
+	}
+
+	// A message with parts still missing is reported as incomplete
+	alice.SetPartSize(80)
+	fourth, _ := alice.EncryptMessage(&session.Message{Text: strings.Repeat("y", 300)})
+	res, _ = bob.DecryptBatch(append(third, fourth[0]))
+	if len(res.Incomplete) != 1 || res.Incomplete[0].MsgNum != 3 || len(res.Incomplete[0].Missing) == 0 {
+		t.Errorf("Incomplete = %+v", res.Incomplete)
+	}
+	if !strings.Contains(batchSummary(res), "Incomplete: #3") {
+		t.Errorf("Summary lacks the incomplete message:\n%s", batchSummary(res))
+	}
+
+	if _, err := new(session.Session).DecryptBatch(nil); err == nil {
+		t.Error("Expected an error before the session is established")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/session"
+)
+
+// Run with go test -run '^$' -bench . -benchmem; README.md records the
+// numbers the hot path is held to
+
+var benchSizes = []int{64, 1 << 10, 64 << 10}
+
+func BenchmarkSessionEncrypt(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			alice, _ := establishedBenchPair(b)
+			text := strings.Repeat("a", size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := alice.Encrypt(text); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSessionRoundTrip(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			alice, bob := establishedBenchPair(b)
+			text := strings.Repeat("a", size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				line, err := alice.Encrypt(text)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := bob.Decrypt(line); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSessionLargeMessage sends 1 MiB messages, which are padded to
+// their Padmé bucket
+func BenchmarkSessionLargeMessage(b *testing.B) {
+	alice, bob := establishedBenchPair(b)
+	text := strings.Repeat("a", 1<<20)
+	b.SetBytes(1 << 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		line, err := alice.Encrypt(text)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := bob.Decrypt(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSeal(b *testing.B) {
+	key := bytes.Repeat([]byte{1}, 32)
+	nonce := make([]byte, crypto.NonceSize)
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			plaintext := make([]byte, size)
+			dst := make([]byte, 0, crypto.NonceSize+size+crypto.Overhead)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := crypto.Seal(dst[:0], key, nonce, plaintext, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	key := bytes.Repeat([]byte{1}, 32)
+	nonce := make([]byte, crypto.NonceSize)
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			sealed, _ := crypto.Seal(nil, key, nonce, make([]byte, size), nil)
+			dst := make([]byte, 0, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := crypto.Open(dst[:0], key, sealed, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRatchetStep(b *testing.B) {
+	r, _ := crypto.NewRatchet(bytes.Repeat([]byte{2}, 32), nil, true)
+	defer r.Close()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := r.UseSendKey(func([]byte, uint32) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDeriveMessageKey(b *testing.B) {
+	chainKey := bytes.Repeat([]byte{3}, 32)
+	msgKey := make([]byte, 32)
+	next := make([]byte, 32)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := crypto.DeriveMessageKey(chainKey, uint32(i), msgKey, next); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRatchetSkipAhead receives message 100 first, caching the 100
+// skipped keys
+func BenchmarkRatchetSkipAhead(b *testing.B) {
+	shared := bytes.Repeat([]byte{2}, 32)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		r, _ := crypto.NewRatchet(shared, nil, false)
+		b.StartTimer()
+		if err := r.OpenRecvKey(100, func([]byte) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		r.Close()
+		b.StartTimer()
+	}
+}
+
+func establishedBenchPair(b *testing.B) (*session.Session, *session.Session) {
+	b.Helper()
+	alice, err := session.NewSession()
+	if err != nil {
+		b.Fatal(err)
+	}
+	bob, err := session.NewSession()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(alice.Close)
+	b.Cleanup(bob.Close)
+	alice.SetPeerPublicKey(bob.GetPublicKeyBase64())
+	bob.SetPeerPublicKey(alice.GetPublicKeyBase64())
+	return alice, bob
+}
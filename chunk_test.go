@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/chunk"
+	"e2e-message/internal/codec"
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/session"
+)
+
+func TestChunkSplitRespectsSize(t *testing.T) {
+	data := make([]byte, 500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for _, enc := range allEncodings {
+		for _, size := range []int{chunk.MinSize, 70, 160, 280} {
+			lines, err := chunk.Split(12, data, enc, size)
+			if err != nil {
+				t.Fatalf("Split(%s, %d) failed: %v", enc, size, err)
+			}
+
+			var joined []byte
+			for i, l := range lines {
+				if len(l) > size {
+					t.Errorf("%s part %d is %d characters, limit %d", enc, i+1, len(l), size)
+				}
+				p, err := chunk.Parse(l)
+				if err != nil {
+					t.Fatalf("Parse(%q) failed: %v", l, err)
+				}
+				if p.MsgNum != 12 || p.Index != i+1 || p.Total != len(lines) {
+					t.Errorf("Unexpected header %d/%d/%d", p.MsgNum, p.Index, p.Total)
+				}
+				joined = append(joined, p.Data...)
+			}
+			if string(joined) != string(data) {
+				t.Errorf("%s parts of size %d do not join back to the input", enc, size)
+			}
+		}
+	}
+
+	if _, err := chunk.Split(0, data, codec.Base64, chunk.MinSize-1); err == nil {
+		t.Error("Expected error for part size below the minimum")
+	}
+}
+
+func TestSessionPartsAnyOrder(t *testing.T) {
+	alice, bob := establishedPair(t)
+	if err := alice.SetPartSize(80); err != nil {
+		t.Fatalf("SetPartSize failed: %v", err)
+	}
+
+	message := strings.Repeat("A long message relayed over SMS. ", 10)
+	lines, err := alice.EncryptMessage(&session.Message{Text: message})
+	if err != nil {
+		t.Fatalf("EncryptMessage failed: %v", err)
+	}
+	if len(lines) < 3 {
+		t.Fatalf("Expected several parts, got %d", len(lines))
+	}
+
+	rand.New(rand.NewSource(1)).Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+
+	for i, l := range lines {
+		m, status, err := bob.DecryptPart(l)
+		if err != nil {
+			t.Fatalf("DecryptPart %d failed: %v", i, err)
+		}
+		if i < len(lines)-1 {
+			if status.Complete() || m != nil {
+				t.Fatalf("Message completed early after %d parts", i+1)
+			}
+			if len(status.Missing) != len(lines)-i-1 {
+				t.Errorf("Expected %d missing parts, got %v", len(lines)-i-1, status.Missing)
+			}
+			if len(bob.PendingParts()) != 1 {
+				t.Errorf("Expected one pending message")
+			}
+			continue
+		}
+		if !status.Complete() {
+			t.Fatal("Message not complete after all parts")
+		}
+		if m.Text != message {
+			t.Errorf("Reassembled message mismatch: got %q", m.Text)
+		}
+	}
+	if len(bob.PendingParts()) != 0 {
+		t.Error("Completed message still pending")
+	}
+}
+
+func TestSessionPartsMissingReported(t *testing.T) {
+	alice, bob := establishedPair(t)
+	alice.SetPartSize(chunk.MinSize)
+
+	lines, err := alice.EncryptMessage(&session.Message{Text: strings.Repeat("x", 100)})
+	if err != nil {
+		t.Fatalf("EncryptMessage failed: %v", err)
+	}
+	if len(lines) < 4 {
+		t.Fatalf("Expected at least 4 parts, got %d", len(lines))
+	}
+
+	// Deliver only the first and last parts
+	bob.DecryptPart(lines[0])
+	_, status, err := bob.DecryptPart(lines[len(lines)-1])
+	if err != nil {
+		t.Fatalf("DecryptPart failed: %v", err)
+	}
+
+	var want []int
+	for i := 2; i < len(lines); i++ {
+		want = append(want, i)
+	}
+	if !reflect.DeepEqual(status.Missing, want) {
+		t.Errorf("Missing parts: got %v, want %v", status.Missing, want)
+	}
+}
+
+func TestSessionPartsShortMessage(t *testing.T) {
+	alice, bob := establishedPair(t)
+	alice.SetPartSize(160)
+
+	lines, err := alice.EncryptMessage(&session.Message{Text: "hi"})
+	if err != nil {
+		t.Fatalf("EncryptMessage failed: %v", err)
+	}
+	if len(lines) != 1 || chunk.IsPart(lines[0]) {
+		t.Fatalf("Short message should be a single regular line, got %v", lines)
+	}
+	if pt, err := bob.Decrypt(lines[0]); err != nil || pt != "hi" {
+		t.Errorf("Decrypt failed: %q, %v", pt, err)
+	}
+}
+
+func TestChunkAssemblerConflicts(t *testing.T) {
+	a := chunk.NewAssembler()
+	add := func(index, total int, data string) ([]byte, chunk.Status) {
+		return a.Add(&chunk.Part{MsgNum: 1, Index: index, Total: total, Data: []byte(data)})
+	}
+
+	add(1, 3, "a")
+	// Same part again is harmless
+	if _, st := add(1, 3, "a"); st.Received != 1 {
+		t.Errorf("Duplicate part counted twice: %+v", st)
+	}
+	// A garbled total is replaced by the genuine one, with its parts
+	add(2, 4, "x")
+	if _, st := add(2, 3, "b"); st.Total != 3 || !reflect.DeepEqual(st.Missing, []int{1, 3}) {
+		t.Errorf("Status after a conflicting total = %+v", st)
+	}
+	// A garbled part is replaced by the retransmission
+	add(1, 3, "?")
+	add(1, 3, "a")
+	if data, st := add(3, 3, "c"); string(data) != "abc" || !st.Complete() {
+		t.Errorf("Assembled %q, %+v; want abc", data, st)
+	}
+	if pending := a.Pending(); len(pending) != 0 {
+		t.Errorf("Assembled message still pending: %+v", pending)
+	}
+
+	for _, bad := range []string{"1/0/3 YWJj", "1/4/3 YWJj", "1/1/0 YWJj", "1/1/2 !!!"} {
+		if _, err := chunk.Parse(bad); err == nil {
+			t.Errorf("Expected Parse(%q) to fail", bad)
+		}
+	}
+}
+
+// TestSessionPartsGarbled checks that a garbled part never keeps the genuine
+// parts of the message from decrypting
+func TestSessionPartsGarbled(t *testing.T) {
+	alice, bob := establishedPair(t)
+	alice.SetPartSize(chunk.MinSize)
+	text := strings.Repeat("x", 100)
+	lines, err := alice.EncryptMessage(&session.Message{Text: text})
+	if err != nil {
+		t.Fatalf("EncryptMessage failed: %v", err)
+	}
+	// garble flips the last byte of a part, as a typo in transit would
+	garble := func(line string) string {
+		p, err := chunk.Parse(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Data[len(p.Data)-1] ^= 1
+		return fmt.Sprintf("%d/%d/%d %s", p.MsgNum, p.Index, p.Total, codec.Base64.Encode(p.Data))
+	}
+	last := len(lines) - 1
+
+	// Garbled before the message is complete: the retransmission replaces it
+	bob.DecryptPart(garble(lines[0]))
+	var msg *session.Message
+	for _, l := range lines {
+		if msg, _, err = bob.DecryptPart(l); err != nil {
+			t.Fatalf("DecryptPart failed: %v", err)
+		}
+	}
+	if msg == nil || msg.Text != text {
+		t.Fatalf("Message after a garbled part = %v", msg)
+	}
+
+	// Garbled part completing the message: it fails, then decrypts when sent again
+	lines, _ = alice.EncryptMessage(&session.Message{Text: text})
+	for _, l := range lines[:last] {
+		bob.DecryptPart(l)
+	}
+	if _, _, err := bob.DecryptPart(garble(lines[last])); !errors.Is(err, session.ErrDecryption) {
+		t.Fatalf("Garbled message decrypted: %v", err)
+	}
+	for _, l := range lines {
+		if msg, _, err = bob.DecryptPart(l); err != nil {
+			t.Fatalf("DecryptPart of the resent message failed: %v", err)
+		}
+	}
+	if msg == nil || msg.Text != text {
+		t.Fatalf("Resent message = %v", msg)
+	}
+
+	// Late copies of a decrypted message's parts are refused, not collected
+	if _, _, err := bob.DecryptPart(lines[0]); !errors.Is(err, crypto.ErrAlreadyReceived) {
+		t.Errorf("Late part: %v", err)
+	}
+	if pending := bob.PendingParts(); len(pending) != 0 {
+		t.Errorf("Late part started a pending message: %+v", pending)
+	}
+}
+
+func TestChunkSplitParsesBack(t *testing.T) {
+	// Each part's encoding is detected on its own, so a short part made of
+	// digits and capitals only used to be read as Base32
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		data := make([]byte, 60+r.Intn(400))
+		r.Read(data)
+		for _, enc := range allEncodings {
+			lines, err := chunk.Split(3, data, enc, 80)
+			if err != nil {
+				t.Fatalf("Split(%s) failed: %v", enc, err)
+			}
+			var joined []byte
+			for _, l := range lines {
+				p, err := chunk.Parse(l)
+				if err != nil {
+					t.Fatalf("Parse(%q) failed: %v", l, err)
+				}
+				joined = append(joined, p.Data...)
+			}
+			if string(joined) != string(data) {
+				t.Fatalf("%s parts do not join back to the input:\n%s", enc, strings.Join(lines, "\n"))
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/session"
+)
+
+func TestCompressionOffByDefault(t *testing.T) {
+	sess, _ := session.NewSession()
+	if sess.GetCompression() {
+		t.Error("Compression should be off by default")
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	alice, bob := establishedPair(t)
+	logs := strings.Repeat("2024-01-01 12:00:00 INFO request handled in 3ms\n", 200)
+
+	plain, err := alice.Encrypt(logs)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if err := alice.SetCompression(true); err != nil {
+		t.Fatalf("SetCompression failed: %v", err)
+	}
+	compressed, err := alice.Encrypt(logs)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	short, err := alice.Encrypt("short")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if ciphertextLen(compressed)*4 > ciphertextLen(plain) {
+		t.Errorf("Compression barely helped: %d vs %d", ciphertextLen(compressed), ciphertextLen(plain))
+	}
+
+	for i, tt := range []struct{ ct, want string }{{plain, logs}, {compressed, logs}, {short, "short"}} {
+		got, err := bob.Decrypt(tt.ct)
+		if err != nil {
+			t.Fatalf("Decrypt %d failed: %v", i, err)
+		}
+		if got != tt.want {
+			t.Errorf("Message %d mismatch", i)
+		}
+	}
+}
+
+func TestCompressionRequiresPadding(t *testing.T) {
+	sess, _ := session.NewSession()
+
+	if err := sess.SetPadding(crypto.PaddingNone, 0); err != nil {
+		t.Fatalf("SetPadding failed: %v", err)
+	}
+	if err := sess.SetCompression(true); err == nil {
+		t.Error("Expected error enabling compression without padding")
+	}
+
+	if err := sess.SetPadding(crypto.PaddingPadme, crypto.DefaultMinBucket); err != nil {
+		t.Fatalf("SetPadding failed: %v", err)
+	}
+	if err := sess.SetCompression(true); err != nil {
+		t.Fatalf("SetCompression failed: %v", err)
+	}
+	if err := sess.SetPadding(crypto.PaddingNone, 0); err == nil {
+		t.Error("Expected error disabling padding while compression is enabled")
+	}
+}
+
+func TestDecompressionBombRejected(t *testing.T) {
+	alice, bob := establishedPair(t)
+	if err := alice.SetCompression(true); err != nil {
+		t.Fatalf("SetCompression failed: %v", err)
+	}
+
+	// Highly repetitive input compresses to a tiny ciphertext
+	bomb, err := alice.Encrypt(strings.Repeat("A", session.MaxDecompressedSize+1))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if ciphertextLen(bomb) > 16*1024 {
+		t.Fatalf("Expected a small ciphertext, got %d bytes", ciphertextLen(bomb))
+	}
+
+	if _, err := bob.Decrypt(bomb); err == nil {
+		t.Error("Expected decompression size limit to reject the message")
+	}
+}
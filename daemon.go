@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"e2e-message/internal/chunk"
+	"e2e-message/internal/identity"
+	"e2e-message/internal/session"
+	"e2e-message/internal/transcript"
+)
+
+// maxRequestSize is the longest request line the daemon reads
+const maxRequestSize = 16 << 20
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000 // The method failed; data.code tells why
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"` // nil for a notification, which gets no response
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int          `json:"code"`
+	Message string       `json:"message"`
+	Data    rpcErrorData `json:"data"`
+}
+
+// rpcErrorData carries the same codes as the error objects of --json
+type rpcErrorData struct {
+	Code string `json:"code"`
+}
+
+func newRPCError(id json.RawMessage, code int, dataCode, message string) rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{Code: code, Message: message, Data: rpcErrorData{Code: dataCode}}}
+}
+
+// daemonSession is a session held by the daemon; mu serializes the calls on
+// it, since a session is not safe for concurrent use
+type daemonSession struct {
+	mu         sync.Mutex
+	sess       *session.Session
+	transcript *transcript.Transcript // nil when not saving
+	closed     bool
+}
+
+func (ds *daemonSession) close() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.sess.Close()
+	if ds.transcript != nil {
+		ds.transcript.Close()
+		ds.transcript = nil
+	}
+	ds.closed = true
+}
+
+// daemon serves the JSON-RPC API; its sessions are shared by all connections
+type daemon struct {
+	mu       sync.Mutex
+	sessions map[string]*daemonSession
+	opts     []session.Option // For new sessions
+}
+
+func newDaemon(opts ...session.Option) *daemon {
+	return &daemon{sessions: make(map[string]*daemonSession), opts: opts}
+}
+
+// daemonMethods are the methods of the API, by name
+var daemonMethods = map[string]func(*daemon, json.RawMessage) (any, error){
+	"createSession": (*daemon).createSession,
+	"closeSession":  (*daemon).closeSession,
+	"importPeer":    (*daemon).importPeer,
+	"encrypt":       (*daemon).encrypt,
+	"decrypt":       (*daemon).decrypt,
+	"status":        (*daemon).status,
+	"verify":        (*daemon).verify,
+	"save":          (*daemon).save,
+}
+
+// serve answers the requests read from r, one per line, until r ends
+func (d *daemon) serve(r io.Reader, w io.Writer) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxRequestSize)
+	for sc.Scan() {
+		data := bytes.TrimSpace(sc.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		if resp, ok := d.handle(data); ok {
+			writeJSON(w, resp)
+		}
+	}
+	return sc.Err()
+}
+
+// handle runs one request and returns its response; ok is false for a
+// notification
+func (d *daemon) handle(data []byte) (resp rpcResponse, ok bool) {
+	if data[0] == '[' {
+		return newRPCError(nil, rpcInvalidRequest, "invalid_request", "batch requests are not supported"), true
+	}
+	var req rpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return newRPCError(nil, rpcParseError, "parse_error", err.Error()), true
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return newRPCError(req.ID, rpcInvalidRequest, "invalid_request", `not a JSON-RPC 2.0 request (need "jsonrpc": "2.0" and a method)`), true
+	}
+
+	method, found := daemonMethods[req.Method]
+	if !found {
+		resp = newRPCError(req.ID, rpcMethodNotFound, "unknown_method", "unknown method: "+req.Method)
+	} else if result, err := method(d, req.Params); errors.Is(err, errInvalidParams) {
+		resp = newRPCError(req.ID, rpcInvalidParams, errorCode(err), err.Error())
+	} else if err != nil {
+		resp = newRPCError(req.ID, rpcServerError, errorCode(err), err.Error())
+	} else {
+		resp = rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+	}
+	return resp, req.ID != nil
+}
+
+// decodeParams decodes the params object of a request into v, rejecting
+// unknown fields so that misspelled ones are not silently ignored
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidParams, err)
+	}
+	return nil
+}
+
+// lock returns the session named id, locked; the caller unlocks it
+func (d *daemon) lock(id string) (*daemonSession, error) {
+	d.mu.Lock()
+	ds, ok := d.sessions[id]
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errUnknownSession, id)
+	}
+	ds.mu.Lock()
+	if ds.closed { // Closed while we waited for it
+		ds.mu.Unlock()
+		return nil, fmt.Errorf("%w: %q", errUnknownSession, id)
+	}
+	return ds, nil
+}
+
+type sessionJSON struct {
+	Type      string `json:"type"` // "session"
+	Session   string `json:"session"`
+	PublicKey string `json:"public_key"` // To send to the peer
+}
+
+func (d *daemon) createSession(params json.RawMessage) (any, error) {
+	if err := decodeParams(params, &struct{}{}); err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSession(d.opts...)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sessions[id] = &daemonSession{sess: sess}
+	return sessionJSON{Type: "session", Session: id, PublicKey: sess.GetPublicKeyBase64()}, nil
+}
+
+type sessionParams struct {
+	Session string `json:"session"`
+}
+
+func (d *daemon) closeSession(params json.RawMessage) (any, error) {
+	var p sessionParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	ds, ok := d.sessions[p.Session]
+	delete(d.sessions, p.Session)
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errUnknownSession, p.Session)
+	}
+	ds.close()
+	return noteJSON{Type: "ok", Message: "session closed"}, nil
+}
+
+// close destroys all sessions
+func (d *daemon) close() {
+	d.mu.Lock()
+	sessions := d.sessions
+	d.sessions = make(map[string]*daemonSession)
+	d.mu.Unlock()
+	for _, ds := range sessions {
+		ds.close()
+	}
+}
+
+func (d *daemon) importPeer(params json.RawMessage) (any, error) {
+	var p struct {
+		Session   string `json:"session"`
+		PublicKey string `json:"public_key"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	ds, err := d.lock(p.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.mu.Unlock()
+	if err := ds.sess.SetPeerPublicKey(p.PublicKey); err != nil {
+		return nil, err
+	}
+	return newEstablishedJSON(ds.sess, "key"), nil
+}
+
+func (d *daemon) encrypt(params json.RawMessage) (any, error) {
+	var p struct {
+		Session string `json:"session"`
+		Text    string `json:"text"`
+		TTLMs   int64  `json:"ttl_ms"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Text == "" || p.TTLMs < 0 {
+		return nil, fmt.Errorf("%w: need a text and a ttl_ms that is not negative", errInvalidParams)
+	}
+	ds, err := d.lock(p.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.mu.Unlock()
+
+	msg := &session.Message{Text: p.Text, TTL: time.Duration(p.TTLMs) * time.Millisecond}
+	lines, err := ds.sess.EncryptMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	ds.save(transcript.Sent, msg)
+	return ciphertextJSON{Type: "ciphertext", Num: msg.Num, Kind: msg.Type.String(), Lines: lines}, nil
+}
+
+// decrypt decrypts a message line, or a part, which returns a message
+// once all parts have arrived
+func (d *daemon) decrypt(params json.RawMessage) (any, error) {
+	var p struct {
+		Session string `json:"session"`
+		Line    string `json:"line"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Line == "" {
+		return nil, fmt.Errorf("%w: need a line", errInvalidParams)
+	}
+	ds, err := d.lock(p.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.mu.Unlock()
+
+	var msg *session.Message
+	if chunk.IsPart(p.Line) {
+		var status chunk.Status
+		if msg, status, err = ds.sess.DecryptPart(p.Line); err == nil && !status.Complete() {
+			return newPartJSON(status), nil
+		}
+	} else {
+		msg, err = ds.sess.DecryptMessage(p.Line)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ds.save(transcript.Received, msg)
+	return newMessageJSON(msg, time.Now()), nil
+}
+
+// save records a message in the session's transcript, if it has one; a
+// failure is only reported, as the message has already been used up
+func (ds *daemonSession) save(dir transcript.Direction, msg *session.Message) {
+	if err := saveMessage(ds.transcript, dir, msg); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: message not saved to transcript: %v\n", err)
+	}
+}
+
+func (d *daemon) status(params json.RawMessage) (any, error) {
+	var p sessionParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	ds, err := d.lock(p.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.mu.Unlock()
+	return newStatusJSON(ds.sess, ds.transcript, newSessionSettingsJSON(ds.sess)), nil
+}
+
+// verify checks a signed message against the known peers; it needs no session
+func (d *daemon) verify(params json.RawMessage) (any, error) {
+	var p struct {
+		Armor string `json:"armor"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	signed, err := identity.ParseSigned(p.Armor)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := loadKnownPeers()
+	if err != nil {
+		return nil, err
+	}
+	return newSignatureJSON(signed, peers), nil
+}
+
+// save records the session's text messages from now on in an encrypted
+// transcript, which is created if path does not exist. As in the REPL, the
+// duress passphrase replaces the session and the transcript with empty ones
+func (d *daemon) save(params json.RawMessage) (any, error) {
+	var p struct {
+		Session    string `json:"session"`
+		Path       string `json:"path"`
+		Passphrase string `json:"passphrase"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Path == "" || p.Passphrase == "" {
+		return nil, fmt.Errorf("%w: need a path and a passphrase", errInvalidParams)
+	}
+	ds, err := d.lock(p.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.mu.Unlock()
+
+	if ds.transcript != nil {
+		ds.transcript.Close()
+		ds.transcript = nil
+	}
+	if _, statErr := os.Stat(p.Path); statErr == nil {
+		ds.transcript, err = transcript.Open(p.Path, p.Passphrase)
+		if errors.Is(err, transcript.ErrDuress) {
+			ds.sess, ds.transcript, err = replaceWithDecoy(ds.sess, p.Path, p.Passphrase, func() (*session.Session, error) {
+				return session.NewSession(d.opts...)
+			})
+		}
+	} else {
+		ds.transcript, err = transcript.Create(p.Path, p.Passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newTranscriptJSON(ds.transcript), nil
+}
+
+// listenUnix listens on a Unix socket that only the user can connect to,
+// replacing a stale socket left by a daemon that did not exit cleanly
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s %w and is not a socket", path, fs.ErrExist)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: a daemon is already listening", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return listenSocket(path)
+}
+
+// accept serves each connection to l in its own goroutine until l is closed
+func (d *daemon) accept(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			d.serve(conn, conn)
+		}()
+	}
+}
+
+// runDaemon serves the JSON-RPC API on stdin and stdout, or on a Unix socket
+// until interrupted; the sessions are destroyed when it returns
+func runDaemon(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	socket := fs.String("socket", "", "Unix socket path")
+	if input, err := parseFileFlags(fs, args); err != nil {
+		return err
+	} else if input != "" {
+		return fmt.Errorf("too many arguments\n%s", commandUsage)
+	}
+
+	d := newDaemon()
+	defer d.close()
+	if *socket == "" {
+		return d.serve(stdin, stdout)
+	}
+
+	l, err := listenUnix(*socket)
+	if err != nil {
+		return err
+	}
+	// Closing the listener removes the socket
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	go func() {
+		<-interrupt
+		l.Close()
+	}()
+	return d.accept(l)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"e2e-message/internal/chunk"
+	"e2e-message/internal/codec"
+	"e2e-message/internal/identity"
+	"e2e-message/internal/transcript"
+)
+
+// rpcClient sends requests to the daemon over one connection
+type rpcClient struct {
+	t    *testing.T
+	conn net.Conn
+	sc   *bufio.Scanner
+	id   int
+}
+
+// call sends a request and returns its result, or its error
+func (c *rpcClient) call(method string, params any) (map[string]any, *rpcError) {
+	c.t.Helper()
+	c.id++
+	req, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": c.id, "method": method, "params": params})
+	return c.send(string(req))
+}
+
+// send writes a raw request line and reads the response
+func (c *rpcClient) send(line string) (map[string]any, *rpcError) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	if !c.sc.Scan() {
+		c.t.Fatalf("No response to %s: %v", line, c.sc.Err())
+	}
+	var resp struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  map[string]any  `json:"result"`
+		Error   *rpcError       `json:"error"`
+	}
+	if err := json.Unmarshal(c.sc.Bytes(), &resp); err != nil {
+		c.t.Fatalf("Response %s is not JSON: %v", c.sc.Bytes(), err)
+	}
+	if resp.JSONRPC != "2.0" {
+		c.t.Errorf("Response %s is not JSON-RPC 2.0", c.sc.Bytes())
+	}
+	return resp.Result, resp.Error
+}
+
+// mustCall is call for requests that must succeed
+func (c *rpcClient) mustCall(method string, params any) map[string]any {
+	c.t.Helper()
+	res, rpcErr := c.call(method, params)
+	if rpcErr != nil {
+		c.t.Fatalf("%s failed: %+v", method, rpcErr)
+	}
+	return res
+}
+
+// startDaemon serves a daemon on a socket in a temporary directory
+func startDaemon(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "e2e.sock")
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon()
+	done := make(chan error)
+	go func() { done <- d.accept(l) }()
+	t.Cleanup(func() {
+		l.Close()
+		if err := <-done; err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		d.close()
+	})
+	return path
+}
+
+func dialDaemon(t *testing.T, path string) *rpcClient {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(nil, maxRequestSize)
+	return &rpcClient{t: t, conn: conn, sc: sc}
+}
+
+// daemonPair creates two sessions that have imported each other's keys
+func daemonPair(t *testing.T, c *rpcClient) (alice, bob string) {
+	t.Helper()
+	a := c.mustCall("createSession", nil)
+	b := c.mustCall("createSession", nil)
+	alice, bob = a["session"].(string), b["session"].(string)
+	wordsA := c.mustCall("importPeer", map[string]any{"session": alice, "public_key": b["public_key"]})
+	wordsB := c.mustCall("importPeer", map[string]any{"session": bob, "public_key": a["public_key"]})
+	if wordsA["type"] != "established" || !equalJSON(wordsA["verification_words"], wordsB["verification_words"]) {
+		t.Fatalf("Established objects differ: %v and %v", wordsA, wordsB)
+	}
+	return alice, bob
+}
+
+func equalJSON(a, b any) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+func TestDaemonSocket(t *testing.T) {
+	path := startDaemon(t)
+	c := dialDaemon(t, path)
+	alice, bob := daemonPair(t, c)
+
+	ct := c.mustCall("encrypt", map[string]any{"session": alice, "text": "hello <bob>", "ttl_ms": 60000})
+	lines := ct["lines"].([]any)
+	if ct["type"] != "ciphertext" || ct["num"] != 0.0 || len(lines) != 1 {
+		t.Fatalf("Ciphertext = %v", ct)
+	}
+
+	// Sessions are shared between connections
+	other := dialDaemon(t, path)
+	msg := other.mustCall("decrypt", map[string]any{"session": bob, "line": lines[0]})
+	if msg["type"] != "message" || msg["text"] != "hello <bob>" || msg["expires_at"] == nil {
+		t.Errorf("Message = %v", msg)
+	}
+	if _, rpcErr := other.call("decrypt", map[string]any{"session": bob, "line": lines[0]}); rpcErr == nil ||
+		rpcErr.Code != rpcServerError || rpcErr.Data.Code != "already_received" {
+		t.Errorf("Replay error = %+v", rpcErr)
+	}
+
+	status := c.mustCall("status", map[string]any{"session": alice})
+	if status["type"] != "status" || status["established"] != true || status["sent"] != 1.0 {
+		t.Errorf("Status = %v", status)
+	}
+	// History and panic wipe are REPL settings
+	settings := status["settings"].(map[string]any)
+	for _, key := range []string{"history", "panic_wipe"} {
+		if _, ok := settings[key]; ok {
+			t.Errorf("Daemon status has the REPL setting %s", key)
+		}
+	}
+
+	c.mustCall("closeSession", map[string]any{"session": alice})
+	if _, rpcErr := c.call("status", map[string]any{"session": alice}); rpcErr == nil || rpcErr.Data.Code != "unknown_session" {
+		t.Errorf("Status of a closed session: %+v", rpcErr)
+	}
+}
+
+func TestDaemonParts(t *testing.T) {
+	c := dialDaemon(t, startDaemon(t))
+	alice, bob := daemonPair(t, c)
+
+	// Split the line into the parts a size-limited channel would carry
+	long := strings.Repeat("a fairly long message ", 20)
+	ct := c.mustCall("encrypt", map[string]any{"session": alice, "text": long})
+	line := ct["lines"].([]any)[0].(string)
+	num, payload, _ := strings.Cut(line, " ")
+	data, err := codec.Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.ParseUint(num, 10, 32)
+	parts, err := chunk.Split(uint32(n), data, codec.Base64, len(line)/2+chunk.MinSize)
+	if err != nil || len(parts) != 2 {
+		t.Fatalf("Split into %d parts: %v", len(parts), err)
+	}
+
+	res := c.mustCall("decrypt", map[string]any{"session": bob, "line": parts[1]})
+	if res["type"] != "part" || res["received"] != 1.0 || !equalJSON(res["missing"], []int{1}) {
+		t.Errorf("Part = %v", res)
+	}
+	res = c.mustCall("decrypt", map[string]any{"session": bob, "line": parts[0]})
+	if res["type"] != "message" || res["text"] != long {
+		t.Errorf("Message from parts = %v", res)
+	}
+}
+
+// TestDaemonConcurrent encrypts and decrypts on the same sessions from
+// many connections at once; run with -race to check the locking
+func TestDaemonConcurrent(t *testing.T) {
+	path := startDaemon(t)
+	alice, bob := daemonPair(t, dialDaemon(t, path))
+
+	const clients, perClient = 8, 10
+	lines := make(chan string, clients*perClient)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		c := dialDaemon(t, path)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perClient; j++ {
+				res, rpcErr := c.call("encrypt", map[string]any{"session": alice, "text": "hi"})
+				if rpcErr != nil {
+					t.Errorf("encrypt failed: %+v", rpcErr)
+					return
+				}
+				lines <- res["lines"].([]any)[0].(string)
+			}
+		}()
+	}
+	wg.Wait()
+	close(lines)
+
+	nums := make(chan float64, clients*perClient)
+	for i := 0; i < clients; i++ {
+		c := dialDaemon(t, path)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range lines {
+				res, rpcErr := c.call("decrypt", map[string]any{"session": bob, "line": l})
+				if rpcErr != nil {
+					t.Errorf("decrypt failed: %+v", rpcErr)
+					return
+				}
+				nums <- res["num"].(float64)
+			}
+		}()
+	}
+	wg.Wait()
+	close(nums)
+
+	seen := make(map[float64]bool)
+	for n := range nums {
+		if seen[n] {
+			t.Errorf("Message #%v decrypted twice", n)
+		}
+		seen[n] = true
+	}
+	if len(seen) != clients*perClient {
+		t.Errorf("Decrypted %d distinct messages, want %d", len(seen), clients*perClient)
+	}
+}
+
+func TestDaemonSave(t *testing.T) {
+	c := dialDaemon(t, startDaemon(t))
+	alice, bob := daemonPair(t, c)
+	file := filepath.Join(t.TempDir(), "alice.e2et")
+
+	res := c.mustCall("save", map[string]any{"session": alice, "path": file, "passphrase": "secret"})
+	if res["type"] != "transcript" || res["open"] != true || res["path"] != file {
+		t.Errorf("Transcript = %v", res)
+	}
+	ct := c.mustCall("encrypt", map[string]any{"session": alice, "text": "keep this"})
+	c.mustCall("decrypt", map[string]any{"session": bob, "line": ct["lines"].([]any)[0]})
+	if st := c.mustCall("status", map[string]any{"session": alice}); st["transcript"] != file {
+		t.Errorf("Status transcript = %v", st["transcript"])
+	}
+
+	tr, err := transcript.Open(file, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := tr.Entries()
+	tr.Close()
+	if len(entries) != 1 || entries[0].Text != "keep this" || entries[0].Direction != transcript.Sent {
+		t.Errorf("Transcript entries = %v", entries)
+	}
+
+	if _, rpcErr := c.call("save", map[string]any{"session": bob, "path": file, "passphrase": "wrong"}); rpcErr == nil ||
+		rpcErr.Data.Code != "wrong_passphrase" {
+		t.Errorf("Wrong passphrase error = %+v", rpcErr)
+	}
+	if _, rpcErr := c.call("save", map[string]any{"session": bob, "path": file}); rpcErr == nil ||
+		rpcErr.Code != rpcInvalidParams {
+		t.Errorf("Missing passphrase error = %+v", rpcErr)
+	}
+}
+
+func TestDaemonVerify(t *testing.T) {
+	t.Setenv("E2E_MESSAGE_HOME", t.TempDir())
+	c := dialDaemon(t, startDaemon(t))
+	id, err := identity.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	armor := id.Sign("I wrote this")
+
+	res := c.mustCall("verify", map[string]any{"armor": armor})
+	if res["type"] != "signature" || res["valid"] != true || res["known"] != false || res["text"] != "I wrote this" {
+		t.Errorf("Signature = %v", res)
+	}
+	res = c.mustCall("verify", map[string]any{"armor": strings.Replace(armor, "I wrote", "I forged", 1)})
+	if res["valid"] != false {
+		t.Errorf("Altered signature = %v", res)
+	}
+}
+
+func TestDaemonProtocolErrors(t *testing.T) {
+	c := dialDaemon(t, startDaemon(t))
+	tests := []struct {
+		name, line string
+		code       int
+		dataCode   string
+	}{
+		{"parse", "not json", rpcParseError, "parse_error"},
+		{"batch", `[{"jsonrpc":"2.0","id":1,"method":"status"}]`, rpcInvalidRequest, "invalid_request"},
+		{"version", `{"id":1,"method":"status"}`, rpcInvalidRequest, "invalid_request"},
+		{"method", `{"jsonrpc":"2.0","id":1,"method":"nope"}`, rpcMethodNotFound, "unknown_method"},
+		{"unknown field", `{"jsonrpc":"2.0","id":1,"method":"encrypt","params":{"txt":"hi"}}`, rpcInvalidParams, "invalid_params"},
+		{"positional", `{"jsonrpc":"2.0","id":1,"method":"encrypt","params":["hi"]}`, rpcInvalidParams, "invalid_params"},
+		{"unknown session", `{"jsonrpc":"2.0","id":1,"method":"encrypt","params":{"session":"x","text":"hi"}}`, rpcServerError, "unknown_session"},
+	}
+	for _, tt := range tests {
+		_, rpcErr := c.send(tt.line)
+		if rpcErr == nil || rpcErr.Code != tt.code || rpcErr.Data.Code != tt.dataCode {
+			t.Errorf("%s: error = %+v, want %d %s", tt.name, rpcErr, tt.code, tt.dataCode)
+		}
+	}
+
+	// A notification gets no response, so the next response is the request's
+	if _, err := c.conn.Write([]byte(`{"jsonrpc":"2.0","method":"createSession"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if res := c.mustCall("createSession", nil); res["type"] != "session" {
+		t.Errorf("Result after a notification = %v", res)
+	}
+}
+
+func TestDaemonStdio(t *testing.T) {
+	in := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":"a","method":"createSession"}`,
+		``,
+		`{"jsonrpc":"2.0","id":"b","method":"status","params":{"session":"x"}}`,
+	}, "\n")
+	var out bytes.Buffer
+	if code := runCommand([]string{"daemon"}, strings.NewReader(in), &out); code != 0 {
+		t.Fatalf("daemon exited with %d: %s", code, out.String())
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `{"jsonrpc":"2.0","id":"a","result":{"type":"session",`) ||
+		!strings.HasPrefix(lines[1], `{"jsonrpc":"2.0","id":"b","error":{"code":-32000,`) {
+		t.Errorf("Responses:\n%s", out.String())
+	}
+}
+
+func TestDaemonListen(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("keep"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Listening on a regular file: %v", err)
+	}
+
+	path := filepath.Join(dir, "e2e.sock")
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("Socket mode = %v, %v", fi.Mode(), err)
+	}
+	if _, err := listenUnix(path); err == nil {
+		t.Error("Listened on a socket that is in use")
+	}
+	l.Close()
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Socket left behind after close: %v", err)
+	}
+}
+
+func TestDaemonSocketCreatedPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix socket modes do not apply on Windows")
+	}
+	// The socket must be private as soon as it exists, not only once
+	// listenUnix returns
+	path := filepath.Join(t.TempDir(), "e2e.sock")
+	l, err := listenSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("Socket mode after listen = %v, %v", fi.Mode(), err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"e2e-message/internal/session"
+)
+
+// sendAck has from acknowledge everything it received to to
+func sendAck(t *testing.T, from, to *session.Session) *session.Ack {
+	t.Helper()
+	ack := from.NewAck()
+	if ack == nil {
+		t.Fatal("NewAck returned nil")
+	}
+	lines, err := from.EncryptMessage(ack)
+	if err != nil {
+		t.Fatalf("EncryptMessage(ack) failed: %v", err)
+	}
+	if _, err := to.DecryptMessage(lines[0]); err != nil {
+		t.Fatalf("DecryptMessage(ack) failed: %v", err)
+	}
+	return ack.Ack
+}
+
+func TestAckReportsGaps(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	if bob.NewAck() != nil {
+		t.Error("NewAck should be nil before anything was received")
+	}
+
+	var sent []string
+	for i := 0; i < 5; i++ {
+		ct, _ := alice.Encrypt(fmt.Sprintf("message %d", i))
+		sent = append(sent, ct)
+	}
+	for _, i := range []int{0, 1, 3, 4} {
+		if _, err := bob.Decrypt(sent[i]); err != nil {
+			t.Fatalf("Decrypt %d failed: %v", i, err)
+		}
+	}
+
+	ack := sendAck(t, bob, alice)
+	if ack.Highest != 4 || !reflect.DeepEqual(ack.Missing, []uint32{2}) {
+		t.Errorf("Unexpected ack: %+v", ack)
+	}
+
+	d := alice.GetDelivery()
+	want := session.Delivery{Sent: 5, Confirmed: 4, Missing: []uint32{2}, Unconfirmed: []uint32{2}}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("GetDelivery = %+v, want %+v", d, want)
+	}
+}
+
+func TestResendOriginalCiphertext(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	lost, _ := alice.Encrypt("lost in transit")
+	ct, _ := alice.Encrypt("arrived")
+	bob.Decrypt(ct)
+	sendAck(t, bob, alice)
+
+	lines, err := alice.GetSentLines(0)
+	if err != nil || len(lines) != 1 || lines[0] != lost {
+		t.Fatalf("GetSentLines(0) = %v, %v", lines, err)
+	}
+	if pt, err := bob.Decrypt(lines[0]); err != nil || pt != "lost in transit" {
+		t.Fatalf("Decrypt of resent message failed: %q, %v", pt, err)
+	}
+
+	if ack := sendAck(t, bob, alice); len(ack.Missing) != 0 {
+		t.Errorf("Ack still reports missing messages: %v", ack.Missing)
+	}
+	d := alice.GetDelivery()
+	if d.Confirmed != 2 || len(d.Missing) != 0 || len(d.Unconfirmed) != 0 {
+		t.Errorf("Expected everything confirmed, got %+v", d)
+	}
+	if _, err := alice.GetSentLines(0); err == nil {
+		t.Error("Confirmed message should no longer be available for resending")
+	}
+}
+
+func TestResendWithPlaintext(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	alice.Encrypt("first try")
+	lines, err := alice.Resend(0, &session.Message{Text: "second try"})
+	if err != nil {
+		t.Fatalf("Resend failed: %v", err)
+	}
+	m, err := bob.DecryptMessage(lines[0])
+	if err != nil || m.Num != 1 || m.Text != "second try" {
+		t.Fatalf("Unexpected resent message: %+v, %v", m, err)
+	}
+
+	// The replaced message is no longer tracked, even though it never arrived
+	sendAck(t, bob, alice)
+	if d := alice.GetDelivery(); len(d.Missing) != 0 || len(d.Unconfirmed) != 0 {
+		t.Errorf("Replaced message still tracked: %+v", d)
+	}
+	if _, err := alice.Resend(0, &session.Message{Text: "again"}); err == nil {
+		t.Error("Expected Resend of an untracked message to fail")
+	}
+}
+
+func TestResendCountedOnce(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	alice.Encrypt("lost")
+	ct, _ := alice.Encrypt("arrived")
+	bob.Decrypt(ct)
+	lines, _ := alice.Resend(0, &session.Message{Text: "lost, again"})
+	lines, _ = alice.Resend(2, &session.Message{Text: "lost, third try"})
+	if d := alice.GetDelivery(); d.Sent != 2 || !reflect.DeepEqual(d.Unconfirmed, []uint32{1, 3}) {
+		t.Errorf("Delivery after two resends = %+v, want 2 sent", d)
+	}
+
+	bob.Decrypt(lines[0])
+	sendAck(t, bob, alice)
+	if d := alice.GetDelivery(); d.Sent != 2 || d.Confirmed != 2 || len(d.Unconfirmed) != 0 {
+		t.Errorf("Delivery after the ack = %+v, want 2 sent and confirmed", d)
+	}
+}
+
+func TestStaleAckIgnored(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	first, _ := alice.Encrypt("0")
+	second, _ := alice.Encrypt("1")
+	bob.Decrypt(second)
+
+	// Bob's first ack reports #0 missing; it arrives after a newer ack
+	ackLines, _ := bob.EncryptMessage(bob.NewAck())
+	bob.Decrypt(first)
+	sendAck(t, bob, alice)
+	if _, err := alice.DecryptMessage(ackLines[0]); err != nil {
+		t.Fatalf("DecryptMessage failed: %v", err)
+	}
+
+	if d := alice.GetDelivery(); d.Confirmed != 2 || len(d.Missing) != 0 {
+		t.Errorf("Stale ack changed the delivery state: %+v", d)
+	}
+}
+
+func TestAcksNotTracked(t *testing.T) {
+	alice, bob := establishedPair(t)
+	ct, _ := bob.Encrypt("hi")
+	alice.Decrypt(ct)
+
+	// Alice's acks are control messages, not something to resend
+	for i := 0; i < 3; i++ {
+		if _, err := alice.EncryptMessage(alice.NewAck()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice.Encrypt("hello")
+	if d := alice.GetDelivery(); d.Sent != 1 || !reflect.DeepEqual(d.Unconfirmed, []uint32{3}) {
+		t.Errorf("GetDelivery = %+v, want only the text message #3", d)
+	}
+	if _, err := alice.GetSentLines(0); err == nil {
+		t.Error("An ack was offered for resending")
+	}
+}
+
+func TestUnconfirmedBounded(t *testing.T) {
+	alice, bob := establishedPair(t)
+	for i := 0; i < 300; i++ {
+		if _, err := alice.Encrypt("never acked"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := alice.GetDelivery()
+	if d.Sent != 300 || len(d.Unconfirmed) != 256 || d.Unconfirmed[0] != 44 {
+		t.Errorf("Sent %d, %d unconfirmed from #%d; want 300, the newest 256 from #44",
+			d.Sent, len(d.Unconfirmed), d.Unconfirmed[0])
+	}
+
+	// A new channel starts numbering again, so nothing carries over
+	if err := alice.SetPeerPublicKey(bob.GetPublicKeyBase64()); err != nil {
+		t.Fatal(err)
+	}
+	if d := alice.GetDelivery(); d.Sent != 0 || len(d.Unconfirmed) != 0 {
+		t.Errorf("Delivery state after a new channel = %+v", d)
+	}
+}
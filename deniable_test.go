@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/codec"
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/identity"
+	"e2e-message/internal/session"
+)
+
+// deniableSession creates a deniable session using id and pinning peer
+func deniableSession(t *testing.T, id, peer *identity.Identity) *session.Session {
+	t.Helper()
+	sess, _ := session.NewSession()
+	if err := sess.SetDeniable(true); err != nil {
+		t.Fatalf("SetDeniable failed: %v", err)
+	}
+	if err := sess.SetIdentityKey(id.X25519()); err != nil {
+		t.Fatal(err)
+	}
+	x, _ := identity.X25519PublicKey(peer.PublicKey())
+	if err := sess.SetPeerIdentityKey(x); err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func connectSessions(t *testing.T, a, b *session.Session) {
+	t.Helper()
+	if err := a.SetPeerPublicKey(b.GetPublicKeyBase64()); err != nil {
+		t.Fatalf("SetPeerPublicKey failed: %v", err)
+	}
+	if err := b.SetPeerPublicKey(a.GetPublicKeyBase64()); err != nil {
+		t.Fatalf("SetPeerPublicKey failed: %v", err)
+	}
+}
+
+func TestDeniableSession(t *testing.T) {
+	alice, _ := identity.Generate()
+	defer alice.Close()
+	bob, _ := identity.Generate()
+	defer bob.Close()
+
+	a := deniableSession(t, alice, bob)
+	b := deniableSession(t, bob, alice)
+	if key, _ := session.DecodeKey(a.GetPublicKeyBase64()); len(key) != 4+32 {
+		t.Fatalf("Deniable session key has %d bytes, want a hello and 32", len(key))
+	}
+	connectSessions(t, a, b)
+	for i, s := range [][2]*session.Session{{a, b}, {b, a}, {a, b}} {
+		ct, _ := s[0].Encrypt("deniable hello")
+		if pt, err := s[1].Decrypt(ct); err != nil || pt != "deniable hello" {
+			t.Errorf("Message %d: Decrypt = %q, %v", i, pt, err)
+		}
+	}
+
+	// The mode cannot change once the channel exists
+	if err := a.SetDeniable(false); err == nil {
+		t.Error("Deniable mode switched off on an established channel")
+	}
+}
+
+func TestDeniableRequirements(t *testing.T) {
+	alice, _ := identity.Generate()
+	defer alice.Close()
+	bob, _ := identity.Generate()
+	defer bob.Close()
+
+	// Both sides must be in deniable mode
+	plain, _ := session.NewSession()
+	d := deniableSession(t, alice, bob)
+	if err := plain.SetPeerPublicKey(d.GetPublicKeyBase64()); err == nil || !strings.Contains(err.Error(), "deniable") {
+		t.Errorf("Normal session imported a deniable key: %v", err)
+	}
+	if err := d.SetPeerPublicKey(plain.GetPublicKeyBase64()); err == nil || !strings.Contains(err.Error(), "deniable") {
+		t.Errorf("Deniable session imported a normal key: %v", err)
+	}
+
+	// Both identities are required
+	unpinned, _ := session.NewSession()
+	unpinned.SetDeniable(true)
+	if err := unpinned.SetPeerPublicKey(d.GetPublicKeyBase64()); err == nil {
+		t.Error("Deniable channel established without identities")
+	}
+}
+
+func TestDeniableWrongIdentity(t *testing.T) {
+	alice, _ := identity.Generate()
+	defer alice.Close()
+	bob, _ := identity.Generate()
+	defer bob.Close()
+	mallory, _ := identity.Generate()
+	defer mallory.Close()
+
+	// Mallory pretends to be Bob
+	a := deniableSession(t, alice, bob)
+	m := deniableSession(t, mallory, alice)
+	connectSessions(t, a, m)
+	ct, _ := m.Encrypt("I am Bob")
+	if _, err := a.Decrypt(ct); err == nil {
+		t.Error("Message from the wrong identity accepted")
+	}
+
+	// With Alice's stolen identity key Mallory still cannot pose as Bob to
+	// Alice, which pinning alone does not prevent
+	a = deniableSession(t, alice, bob)
+	m = deniableSession(t, alice, alice)
+	x, _ := identity.X25519PublicKey(bob.PublicKey())
+	m.SetPeerIdentityKey(x)
+	connectSessions(t, a, m)
+	ct, _ = m.Encrypt("I am Bob")
+	if _, err := a.Decrypt(ct); err == nil {
+		t.Error("Stolen identity key allowed impersonating Bob")
+	}
+
+	pa := identitySession(t, alice, bob)
+	pm := identitySession(t, alice, bob) // Mallory with Alice's key, claiming Bob's identity
+	connectSessions(t, pa, pm)
+	ct, _ = pm.Encrypt("I am Bob")
+	if _, err := pa.Decrypt(ct); err != nil {
+		t.Errorf("Expected key-compromise impersonation without deniable mode: %v", err)
+	}
+}
+
+func TestDeniableNoSignature(t *testing.T) {
+	alice, _ := identity.Generate()
+	defer alice.Close()
+	bob, _ := identity.Generate()
+	defer bob.Close()
+
+	a := deniableSession(t, alice, bob)
+	b := deniableSession(t, bob, alice)
+	connectSessions(t, a, b)
+
+	// Nothing Alice sends verifies as a signature by either identity
+	text := "I wrote this"
+	sent := []string{a.GetPublicKeyBase64()}
+	for i := 0; i < 5; i++ {
+		ct, _ := a.Encrypt(text)
+		b.Decrypt(ct)
+		_, c, _ := strings.Cut(ct, " ")
+		sent = append(sent, c)
+	}
+	for _, s := range sent {
+		data, err := codec.Decode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+ed25519.SignatureSize <= len(data); i++ {
+			sig := data[i : i+ed25519.SignatureSize]
+			for _, pub := range []ed25519.PublicKey{alice.PublicKey(), bob.PublicKey()} {
+				for _, msg := range [][]byte{[]byte(text), data[:i], data[i+ed25519.SignatureSize:]} {
+					if ed25519.Verify(pub, msg, sig) {
+						t.Fatalf("Ciphertext contains a signature at offset %d", i)
+					}
+				}
+			}
+		}
+	}
+
+	// Bob alone, with a session key he made up for Alice, derives the same
+	// secret Alice's side would; so he could have produced any transcript
+	bobID, _ := crypto.SecretFrom(bob.X25519())
+	defer bobID.Destroy()
+	aliceID, _ := crypto.SecretFrom(alice.X25519())
+	defer aliceID.Destroy()
+	bobEK, bobEKPub, _ := crypto.GenerateX25519Key(rand.Reader)
+	defer bobEK.Destroy()
+	fakeEK, fakeEKPub, _ := crypto.GenerateX25519Key(rand.Reader)
+	defer fakeEK.Destroy()
+	alicePub, _ := identity.X25519PublicKey(alice.PublicKey())
+	bobPub, _ := identity.X25519PublicKey(bob.PublicKey())
+
+	aliceInit := string(fakeEKPub) < string(bobEKPub)
+	forged, err := crypto.TripleDH(bobID, bobEK, alicePub, fakeEKPub, !aliceInit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forged.Destroy()
+	genuine, err := crypto.TripleDH(aliceID, fakeEK, bobPub, bobEKPub, aliceInit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer genuine.Destroy()
+	if string(forged.Bytes()) != string(genuine.Bytes()) {
+		t.Error("Responder cannot simulate the initiator's secret")
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"strings"
 	"testing"
 
+	"golang.org/x/crypto/hkdf"
+
 	"e2e-message/internal/crypto"
 	"e2e-message/internal/session"
 )
@@ -70,12 +77,12 @@ func TestRatchetForwardSecrecy(t *testing.T) {
 	}
 
 	// Create two ratchets (initiator and responder)
-	alice, err := crypto.NewRatchet(sharedSecret, true)
+	alice, err := crypto.NewRatchet(sharedSecret, nil, true)
 	if err != nil {
 		t.Fatalf("Failed to create Alice's ratchet: %v", err)
 	}
 
-	bob, err := crypto.NewRatchet(sharedSecret, false)
+	bob, err := crypto.NewRatchet(sharedSecret, nil, false)
 	if err != nil {
 		t.Fatalf("Failed to create Bob's ratchet: %v", err)
 	}
@@ -88,7 +95,7 @@ func TestRatchetForwardSecrecy(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Failed to get send key %d: %v", i, err)
 		}
-		aliceKeys = append(aliceKeys, key)
+		aliceKeys = append(aliceKeys, bytes.Clone(key.Bytes()))
 		msgNums = append(msgNums, msgNum)
 	}
 
@@ -107,7 +114,7 @@ func TestRatchetForwardSecrecy(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Failed to get recv key %d: %v", i, err)
 		}
-		if string(key) != string(aliceKeys[i]) {
+		if string(key.Bytes()) != string(aliceKeys[i]) {
 			t.Errorf("Key mismatch for message %d", i)
 		}
 	}
@@ -119,8 +126,8 @@ func TestRatchetOutOfOrder(t *testing.T) {
 		sharedSecret[i] = byte(i)
 	}
 
-	alice, _ := crypto.NewRatchet(sharedSecret, true)
-	bob, _ := crypto.NewRatchet(sharedSecret, false)
+	alice, _ := crypto.NewRatchet(sharedSecret, nil, true)
+	bob, _ := crypto.NewRatchet(sharedSecret, nil, false)
 
 	// Alice sends 3 messages
 	key0, _, _ := alice.NextSendKey()
@@ -132,7 +139,7 @@ func TestRatchetOutOfOrder(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to receive message 2: %v", err)
 	}
-	if string(bobKey2) != string(key2) {
+	if string(bobKey2.Bytes()) != string(key2.Bytes()) {
 		t.Error("Key mismatch for message 2")
 	}
 
@@ -140,7 +147,7 @@ func TestRatchetOutOfOrder(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to receive message 0: %v", err)
 	}
-	if string(bobKey0) != string(key0) {
+	if string(bobKey0.Bytes()) != string(key0.Bytes()) {
 		t.Error("Key mismatch for message 0")
 	}
 
@@ -148,7 +155,7 @@ func TestRatchetOutOfOrder(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to receive message 1: %v", err)
 	}
-	if string(bobKey1) != string(key1) {
+	if string(bobKey1.Bytes()) != string(key1.Bytes()) {
 		t.Error("Key mismatch for message 1")
 	}
 }
@@ -357,3 +364,103 @@ func TestVerificationWords(t *testing.T) {
 
 	t.Logf("Verification words: %v", aliceWords)
 }
+
+// newSessions returns two fresh sessions
+func newSessions(t *testing.T, opts ...session.Option) (*session.Session, *session.Session) {
+	t.Helper()
+	alice, err := session.NewSession(opts...)
+	if err != nil {
+		t.Fatalf("Failed to create Alice's session: %v", err)
+	}
+	bob, err := session.NewSession(opts...)
+	if err != nil {
+		t.Fatalf("Failed to create Bob's session: %v", err)
+	}
+	return alice, bob
+}
+
+// establishedPair returns two sessions that have exchanged public keys
+func establishedPair(t *testing.T, opts ...session.Option) (*session.Session, *session.Session) {
+	t.Helper()
+	alice, bob := newSessions(t, opts...)
+	if err := alice.SetPeerPublicKey(bob.GetPublicKeyBase64()); err != nil {
+		t.Fatalf("Alice failed to import Bob's key: %v", err)
+	}
+	if err := bob.SetPeerPublicKey(alice.GetPublicKeyBase64()); err != nil {
+		t.Fatalf("Bob failed to import Alice's key: %v", err)
+	}
+	return alice, bob
+}
+
+// ciphertextLen returns the length of the ciphertext part of "msgNum ciphertext"
+func ciphertextLen(msg string) int {
+	_, ct, _ := strings.Cut(msg, " ")
+	return len(ct)
+}
+
+func TestDeriveMessageKeyMatchesHKDF(t *testing.T) {
+	// The ratchet computes HKDF by hand with reused buffers; it must agree
+	// with x/crypto/hkdf over chain key | uint32be(msgNum)
+	chainKey := make([]byte, 32)
+	for i := 0; i < 50; i++ {
+		msgNum := uint32(i * 0x01010101)
+		input := binary.BigEndian.AppendUint32(append([]byte(nil), chainKey...), msgNum)
+		want := make([]byte, 64)
+		io.ReadFull(hkdf.New(sha256.New, input, nil, []byte("e2e-msg-key")), want[:32])
+		io.ReadFull(hkdf.New(sha256.New, input, nil, []byte("e2e-chain-key")), want[32:])
+
+		got := make([]byte, 64)
+		if err := crypto.DeriveMessageKey(chainKey, msgNum, got[:32], got[32:]); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("Step %d: got %x, want %x", i, got, want)
+		}
+		chainKey = got[32:]
+	}
+}
+
+func TestSealAppends(t *testing.T) {
+	key := make([]byte, 32)
+	nonce := make([]byte, crypto.NonceSize)
+	header := []byte{1}
+	want, _ := crypto.EncryptWithNonce([]byte("hello"), key, nonce, header)
+
+	dst := make([]byte, 2, 64)
+	dst[0], dst[1] = 'h', 'i'
+	got, err := crypto.Seal(dst, key, nonce, []byte("hello"), header)
+	if err != nil || string(got[:2]) != "hi" || string(got[2:]) != string(want) || &got[0] != &dst[0] {
+		t.Errorf("Seal = %x, %v; want hi + %x in place", got, err, want)
+	}
+	pt, err := crypto.Open(got[:0:0], key, got[2:], header)
+	if err != nil || string(pt) != "hello" {
+		t.Errorf("Open = %q, %v", pt, err)
+	}
+	// The associated data is authenticated
+	if _, err := crypto.Open(nil, key, got[2:], []byte{2}); err == nil {
+		t.Error("Open accepted different associated data")
+	}
+}
+
+func TestHotPathAllocs(t *testing.T) {
+	// Targets recorded in README.md: a ratchet step allocates nothing, and
+	// Seal and Open into a large enough dst allocate only the AES cipher and GCM
+	r, _ := crypto.NewRatchet(make([]byte, 32), nil, true)
+	defer r.Close()
+	use := func([]byte, uint32) error { return nil }
+	if n := testing.AllocsPerRun(100, func() { r.UseSendKey(use) }); n != 0 {
+		t.Errorf("UseSendKey allocates %v times, want 0", n)
+	}
+
+	key := make([]byte, 32)
+	nonce := make([]byte, crypto.NonceSize)
+	plaintext := make([]byte, 1024)
+	dst := make([]byte, 0, crypto.NonceSize+len(plaintext)+crypto.Overhead)
+	if n := testing.AllocsPerRun(100, func() { crypto.Seal(dst[:0], key, nonce, plaintext, nil) }); n > 2 {
+		t.Errorf("Seal allocates %v times, want at most 2", n)
+	}
+	sealed, _ := crypto.Seal(nil, key, nonce, plaintext, nil)
+	if n := testing.AllocsPerRun(100, func() { crypto.Open(plaintext[:0], key, sealed, nil) }); n > 2 {
+		t.Errorf("Open allocates %v times, want at most 2", n)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/codec"
+)
+
+var allEncodings = []codec.Encoding{codec.Base64, codec.Base64URL, codec.Base32, codec.Base85, codec.Words}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 16, 65, 100} {
+		data := make([]byte, n)
+		rand.Read(data)
+		for _, enc := range allEncodings {
+			text := enc.Encode(data)
+			got, err := enc.Decode(text)
+			if err != nil {
+				t.Fatalf("%s.Decode(len=%d) failed: %v", enc, n, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s round trip mismatch for %d bytes", enc, n)
+			}
+		}
+	}
+}
+
+func TestEncodingDetect(t *testing.T) {
+	// Long random inputs are detected reliably
+	for i := 0; i < 50; i++ {
+		data := make([]byte, 65)
+		rand.Read(data)
+		for _, enc := range allEncodings {
+			text := enc.Encode(data)
+			got, err := codec.Decode(text)
+			if err != nil {
+				t.Fatalf("Decode of %s text failed: %v", enc, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Auto-detected %s decode mismatch (detected %s)", enc, codec.Detect(text))
+			}
+		}
+	}
+}
+
+func TestEncodingChannelSafety(t *testing.T) {
+	data := make([]byte, 300)
+	rand.Read(data)
+
+	if s := codec.Base64URL.Encode(data); strings.ContainsAny(s, "+/=") {
+		t.Errorf("URL-safe encoding contains reserved characters: %s", s)
+	}
+	if s := codec.Base32.Encode(data); strings.ToUpper(s) != s || strings.ContainsAny(s, "ILOU") {
+		t.Errorf("Crockford encoding contains ambiguous characters: %s", s)
+	}
+}
+
+func TestCrockfordForgiving(t *testing.T) {
+	data := []byte("dictate me")
+	text := codec.Base32.Encode(data)
+
+	// Lower case, no hyphens, and O/I/L look-alikes all decode
+	sloppy := strings.ReplaceAll(strings.ToLower(text), "-", "")
+	sloppy = strings.NewReplacer("0", "o", "1", "l").Replace(sloppy)
+	got, err := codec.Base32.Decode(sloppy)
+	if err != nil {
+		t.Fatalf("Decode of sloppy Crockford failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Got %q, want %q", got, data)
+	}
+}
+
+// TestCrockfordDictated checks that a lowercased Base32 line, as typed by
+// someone it was read out to, is detected as Base32 rather than Base64
+func TestCrockfordDictated(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		data := make([]byte, 65)
+		rand.Read(data)
+		dictated := strings.ToLower(codec.Base32.Encode(data))
+		dictated = strings.NewReplacer("0", "o", "1", "i").Replace(dictated)
+		if enc := codec.Detect(dictated); enc != codec.Base32 {
+			t.Fatalf("Detect(%q) = %s, want base32", dictated, enc)
+		}
+		got, err := codec.Decode(dictated)
+		if err != nil {
+			t.Fatalf("Decode of %q failed: %v", dictated, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Decode of %q = %x, want %x", dictated, got, data)
+		}
+	}
+
+	alice, bob := establishedPair(t)
+	alice.SetEncoding(codec.Base32)
+	ct, err := alice.Encrypt("read aloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := bob.Decrypt(strings.ToLower(ct)); err != nil || pt != "read aloud" {
+		t.Errorf("Decrypt of a lowercased Base32 line = %q, %v", pt, err)
+	}
+}
+
+func TestWordsInvalid(t *testing.T) {
+	if _, err := codec.Words.Decode("zebra notaword"); err == nil {
+		t.Error("Expected error for unknown word")
+	}
+}
+
+func TestSessionMixedEncodings(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	for _, enc := range allEncodings {
+		alice.SetEncoding(enc)
+		bob.SetEncoding(codec.Base64)
+
+		ct, err := alice.Encrypt("hello in " + enc.String())
+		if err != nil {
+			t.Fatalf("Encrypt with %s failed: %v", enc, err)
+		}
+		pt, err := bob.Decrypt(ct)
+		if err != nil {
+			t.Fatalf("Decrypt of %s ciphertext failed: %v", enc, err)
+		}
+		if pt != "hello in "+enc.String() {
+			t.Errorf("Message mismatch for %s: %q", enc, pt)
+		}
+	}
+}
+
+func TestPublicKeyEncodings(t *testing.T) {
+	for _, enc := range allEncodings {
+		alice, bob := newSessions(t)
+		alice.SetEncoding(enc)
+		bob.SetEncoding(enc)
+
+		if err := alice.SetPeerPublicKey(bob.GetPublicKeyEncoded()); err != nil {
+			t.Fatalf("Import of %s key failed: %v", enc, err)
+		}
+		if err := bob.SetPeerPublicKey(alice.GetPublicKeyEncoded()); err != nil {
+			t.Fatalf("Import of %s key failed: %v", enc, err)
+		}
+		if strings.Join(alice.GetVerificationWords(), " ") != strings.Join(bob.GetVerificationWords(), " ") {
+			t.Errorf("Verification words differ after %s key exchange", enc)
+		}
+	}
+}
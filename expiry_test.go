@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"e2e-message/internal/session"
+)
+
+func TestMessageCarriesSendTime(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	before := time.Now().Truncate(time.Millisecond)
+	lines, err := alice.EncryptMessage(&session.Message{Text: "hello"})
+	if err != nil {
+		t.Fatalf("EncryptMessage failed: %v", err)
+	}
+	after := time.Now()
+
+	m, err := bob.DecryptMessage(lines[0])
+	if err != nil {
+		t.Fatalf("DecryptMessage failed: %v", err)
+	}
+	if m.Text != "hello" || m.Num != 0 {
+		t.Errorf("Unexpected message: %+v", m)
+	}
+	if m.SentAt.Before(before) || m.SentAt.After(after) {
+		t.Errorf("Send time %v outside [%v, %v]", m.SentAt, before, after)
+	}
+	if m.TTL != 0 || !m.ExpiresAt().IsZero() || m.Expired(time.Now().Add(1000*time.Hour)) {
+		t.Error("Message without TTL should never expire")
+	}
+}
+
+func TestExpiredMessageRefused(t *testing.T) {
+	clock := newFakeClock()
+	alice, bob := establishedPair(t, session.WithClock(clock))
+
+	lines, err := alice.EncryptMessage(&session.Message{Text: "burn after reading", TTL: time.Millisecond})
+	if err != nil {
+		t.Fatalf("EncryptMessage failed: %v", err)
+	}
+	alice.SetTTL(time.Millisecond)
+	ct, _ := alice.Encrypt("also short-lived")
+	clock.Advance(5 * time.Millisecond)
+
+	if _, err := bob.DecryptMessage(lines[0]); !errors.Is(err, session.ErrExpired) {
+		t.Fatalf("Expected ErrExpired, got %v", err)
+	}
+	if _, err := bob.Decrypt(ct); !errors.Is(err, session.ErrExpired) {
+		t.Errorf("Decrypt should also refuse expired messages, got %v", err)
+	}
+}
+
+func TestExpiredMessageWarnPolicy(t *testing.T) {
+	clock := newFakeClock()
+	alice, bob := establishedPair(t, session.WithClock(clock))
+	bob.SetExpiryPolicy(session.ExpiryWarn)
+
+	lines, _ := alice.EncryptMessage(&session.Message{Text: "late", TTL: time.Millisecond})
+	clock.Advance(5 * time.Millisecond)
+
+	m, err := bob.DecryptMessage(lines[0])
+	if err != nil {
+		t.Fatalf("DecryptMessage failed: %v", err)
+	}
+	if m.Text != "late" || !m.Expired(clock.Now()) {
+		t.Errorf("Expected expired message to be returned, got %+v", m)
+	}
+	if want := m.SentAt.Add(time.Millisecond); !m.ExpiresAt().Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", m.ExpiresAt(), want)
+	}
+}
+
+func TestSessionDefaultTTL(t *testing.T) {
+	alice, bob := establishedPair(t)
+	if err := alice.SetTTL(time.Hour); err != nil {
+		t.Fatalf("SetTTL failed: %v", err)
+	}
+
+	ct, _ := alice.Encrypt("default")
+	m, err := bob.DecryptMessage(ct)
+	if err != nil {
+		t.Fatalf("DecryptMessage failed: %v", err)
+	}
+	if m.TTL != time.Hour || m.Expired(time.Now()) {
+		t.Errorf("Expected unexpired message with the session TTL, got %+v", m)
+	}
+
+	// A per-message TTL overrides the default
+	lines, _ := alice.EncryptMessage(&session.Message{Text: "override", TTL: 10 * time.Minute})
+	if m, err = bob.DecryptMessage(lines[0]); err != nil || m.TTL != 10*time.Minute {
+		t.Errorf("Expected per-message TTL, got %+v, %v", m, err)
+	}
+
+	for _, bad := range []time.Duration{-time.Second, session.MaxTTL + time.Millisecond} {
+		if err := alice.SetTTL(bad); err == nil {
+			t.Errorf("Expected SetTTL(%v) to fail", bad)
+		}
+		if _, err := alice.EncryptMessage(&session.Message{Text: "x", TTL: bad}); err == nil {
+			t.Errorf("Expected EncryptMessage with TTL %v to fail", bad)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+
+	"e2e-message/internal/codec"
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/session"
+)
+
+// The seed corpora live in testdata/fuzz/<FuzzName>; go test runs them as
+// regular tests, and go test -fuzz=<FuzzName> explores from there
+
+// fuzzPair returns two sessions with fixed keys and clock, so that the
+// checked-in seeds hold genuine ciphertexts
+func fuzzPair(t *testing.T) (*session.Session, *session.Session) {
+	t.Helper()
+	clock := newFakeClock()
+	alice, err := session.NewSession(session.WithRand(seededRand("fuzz alice")), session.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := session.NewSession(session.WithRand(seededRand("fuzz bob")), session.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(alice.Close)
+	t.Cleanup(bob.Close)
+	if err := alice.SetPeerPublicKey(bob.GetPublicKeyBase64()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.SetPeerPublicKey(alice.GetPublicKeyBase64()); err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+// FuzzDecrypt feeds pasted input to an established session, which must
+// not panic and must still decrypt Alice's first genuine messages afterwards
+func FuzzDecrypt(f *testing.F) {
+	f.Fuzz(func(t *testing.T, input string) {
+		alice, bob := fuzzPair(t)
+		var genuine []string
+		for i := 0; i < 3; i++ {
+			line, err := alice.Encrypt(fmt.Sprintf("genuine %d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			genuine = append(genuine, line)
+		}
+
+		pt, err := bob.Decrypt(input)
+		delivered := -1
+		for i, line := range genuine {
+			if input == line {
+				delivered = i
+			}
+		}
+		if err == nil && delivered < 0 {
+			// Only the genuine lines can decrypt; other encodings of the
+			// same bytes are fine as long as the text is right
+			for i := range genuine {
+				if pt == fmt.Sprintf("genuine %d", i) {
+					delivered = i
+				}
+			}
+			if delivered < 0 {
+				t.Fatalf("Forged input %q decrypted to %q", input, pt)
+			}
+		}
+
+		for i, line := range genuine {
+			pt, err := bob.Decrypt(line)
+			if i == delivered {
+				if err == nil {
+					t.Fatalf("Message %d decrypted twice", i)
+				}
+				continue
+			}
+			if err != nil || pt != fmt.Sprintf("genuine %d", i) {
+				t.Fatalf("After %q, genuine message %d = %q, %v", input, i, pt, err)
+			}
+		}
+	})
+}
+
+// FuzzSetPeerPublicKey imports pasted keys; a rejected key must leave the
+// session unestablished and usable with a real peer
+func FuzzSetPeerPublicKey(f *testing.F) {
+	f.Fuzz(func(t *testing.T, key string) {
+		alice, err := session.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer alice.Close()
+
+		if err := alice.SetPeerPublicKey(key); err == nil {
+			if !alice.IsEstablished() {
+				t.Fatalf("Key %q accepted, but the session is not established", key)
+			}
+			if _, err := alice.Encrypt("hi"); err != nil {
+				t.Fatalf("Encrypt after accepting %q: %v", key, err)
+			}
+			return
+		}
+		if alice.IsEstablished() {
+			t.Fatalf("Key %q rejected, but the session is established", key)
+		}
+
+		bob, err := session.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bob.Close()
+		if err := alice.SetPeerPublicKey(bob.GetPublicKeyBase64()); err != nil {
+			t.Fatalf("After rejecting %q, a real key fails: %v", key, err)
+		}
+		bob.SetPeerPublicKey(alice.GetPublicKeyBase64())
+		line, _ := alice.Encrypt("hi")
+		if pt, err := bob.Decrypt(line); err != nil || pt != "hi" {
+			t.Fatalf("After rejecting %q, Decrypt = %q, %v", key, pt, err)
+		}
+	})
+}
+
+// FuzzStartsWithNumberSpace checks the auto-decrypt detection against its
+// definition: at least three characters and a run of digits before the first space
+func FuzzStartsWithNumberSpace(f *testing.F) {
+	f.Fuzz(func(t *testing.T, input string) {
+		want := false
+		if i := strings.Index(input, " "); i > 0 && len(input) >= 3 {
+			want = strings.IndexFunc(input[:i], func(r rune) bool { return !unicode.IsDigit(r) }) < 0
+		}
+		if got := startsWithNumberSpace(input); got != want {
+			t.Errorf("startsWithNumberSpace(%q) = %v, want %v", input, got, want)
+		}
+	})
+}
+
+// FuzzRatchetGetRecvKey asks for message keys in the order given by nums
+// and checks them against the sender's keys
+func FuzzRatchetGetRecvKey(f *testing.F) {
+	f.Fuzz(func(t *testing.T, nums []byte) {
+		shared := bytes.Repeat([]byte{7}, 32)
+		sender, _ := crypto.NewRatchet(shared, nil, true)
+		defer sender.Close()
+		receiver, _ := crypto.NewRatchet(shared, nil, false)
+		defer receiver.Close()
+
+		var sent [][]byte
+		used := map[uint32]bool{}
+		next := uint32(0)
+		for i, b := range nums {
+			n := uint32(b)
+			for uint32(len(sent)) <= n {
+				key, _, err := sender.NextSendKey()
+				if err != nil {
+					t.Fatal(err)
+				}
+				sent = append(sent, bytes.Clone(key.Bytes()))
+				key.Destroy()
+			}
+
+			key, err := receiver.GetRecvKey(n)
+			ok := !used[n] && (n < next || n-next <= 100)
+			if (err == nil) != ok {
+				t.Fatalf("GetRecvKey(%d) after %v: err = %v, want success %v", n, nums[:i], err, ok)
+			}
+			if err != nil {
+				continue
+			}
+			if !bytes.Equal(key.Bytes(), sent[n]) {
+				t.Fatalf("GetRecvKey(%d) returned the wrong key", n)
+			}
+			key.Destroy()
+			used[n] = true
+			if n >= next {
+				next = n + 1
+			}
+		}
+	})
+}
+
+// fuzzChannel is one direction of the stateful fuzzer's conversation
+type fuzzChannel struct {
+	from, to  *session.Session
+	lines     []string
+	delivered map[int]bool
+	next      int // Next number the receiver's ratchet has not reached
+}
+
+// deliver hands line (message i, or a forgery if i < 0) to the receiver and
+// checks the result against a model of the ratchet
+func (c *fuzzChannel) deliver(t *testing.T, i int, line string) {
+	t.Helper()
+	pt, err := c.to.Decrypt(line)
+	if i < 0 {
+		if err == nil {
+			t.Fatalf("Forged line %q decrypted to %q", line, pt)
+		}
+		return
+	}
+	want := !c.delivered[i] && (i < c.next || i-c.next <= 100)
+	if (err == nil) != want {
+		t.Fatalf("Delivering message %d: err = %v, want success %v", i, err, want)
+	}
+	if err != nil {
+		return
+	}
+	if pt != fmt.Sprintf("message %d", i) {
+		t.Fatalf("Message %d decrypted to %q", i, pt)
+	}
+	c.delivered[i] = true
+	if i >= c.next {
+		c.next = i + 1
+	}
+}
+
+// FuzzSessions interprets ops as a conversation between two sessions:
+// sending, delivering in any order, replaying, and delivering forged or
+// garbled lines. No message may decrypt twice, no forgery may decrypt, and
+// forgeries must not keep genuine messages from decrypting
+func FuzzSessions(f *testing.F) {
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		alice, bob := fuzzPair(t)
+		channels := []*fuzzChannel{
+			{from: alice, to: bob, delivered: map[int]bool{}},
+			{from: bob, to: alice, delivered: map[int]bool{}},
+		}
+		arg := func(i int) int {
+			if i+1 < len(ops) {
+				return int(ops[i+1])
+			}
+			return 0
+		}
+
+		for i := 0; i < len(ops); i++ {
+			c := channels[ops[i]&1]
+			op := (ops[i] >> 1) % 6
+			if op == 0 || len(c.lines) == 0 {
+				line, err := c.from.Encrypt(fmt.Sprintf("message %d", len(c.lines)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.lines = append(c.lines, line)
+				continue
+			}
+			n := arg(i) % len(c.lines)
+			line := c.lines[n]
+			num, encoded, _ := strings.Cut(line, " ")
+			ct, _ := codec.Decode(encoded)
+
+			switch op {
+			case 1, 2: // Deliver or replay a message
+				c.deliver(t, n, line)
+			case 3: // Flip a bit of the ciphertext
+				ct[arg(i)%len(ct)] ^= 1 << (ops[i] >> 5)
+				c.deliver(t, -1, num+" "+base64.StdEncoding.EncodeToString(ct))
+			case 4: // Move the ciphertext to another message number
+				if other := (n + 1 + arg(i)) % (len(c.lines) + 2); other != n {
+					c.deliver(t, -1, strconv.Itoa(other)+" "+encoded)
+				}
+			case 5: // Truncate, or paste the rest of ops
+				if arg(i)&1 == 0 {
+					c.deliver(t, -1, num+" "+base64.StdEncoding.EncodeToString(ct[:arg(i)%len(ct)]))
+				} else {
+					c.deliver(t, -1, num+" "+string(ops[i:]))
+				}
+			}
+			i++
+		}
+	})
+}
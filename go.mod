@@ -5,9 +5,7 @@ go 1.21
 require (
 	github.com/peterh/liner v1.2.2
 	golang.org/x/crypto v0.21.0
+	golang.org/x/sys v0.18.0
 )
 
-require (
-	github.com/mattn/go-runewidth v0.0.3 // indirect
-	golang.org/x/sys v0.18.0 // indirect
-)
+require github.com/mattn/go-runewidth v0.0.3 // indirect
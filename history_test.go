@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/peterh/liner"
+)
+
+const secret = "meet at the old mill"
+
+var historyInputs = []string{
+	"e " + secret,
+	"E " + secret,
+	"e --ttl 1h " + secret,
+	"resend 2 " + secret,
+	"history search " + secret,
+	"sign " + secret,
+	"pake 7-old-mill",
+	"resend 2",
+	"history 10",
+	"status",
+	"3 Qm9iIGlzIGhlcmU=",
+	"3/1/2 Qm9iIGlz",
+	"key BPx7kG",
+}
+
+// withHistory records inputs under a policy into a fresh liner history
+func withHistory(t *testing.T, policy historyPolicy, inputs []string) []string {
+	t.Helper()
+	line = liner.NewLiner()
+	defer line.Close()
+	historyMode = policy
+	defer func() { historyMode = historySkip }()
+
+	for _, in := range inputs {
+		recordHistory(in)
+	}
+	var buf bytes.Buffer
+	if _, err := line.WriteHistory(&buf); err != nil {
+		t.Fatalf("WriteHistory failed: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+func TestHistoryNeverContainsPlaintext(t *testing.T) {
+	for _, policy := range []historyPolicy{historySkip, historyRedact, historyCommands, historyOff} {
+		history := withHistory(t, policy, historyInputs)
+		for _, h := range history {
+			if strings.Contains(h, "mill") {
+				t.Errorf("%s policy recorded plaintext: %q", policy, h)
+			}
+		}
+	}
+}
+
+func TestHistoryPolicies(t *testing.T) {
+	tests := []struct {
+		policy historyPolicy
+		input  string
+		want   string // "" means not recorded
+	}{
+		{historySkip, "e " + secret, ""},
+		{historySkip, "resend 2", "resend 2"},
+		{historySkip, "3 Qm9iIGlzIGhlcmU=", "3 Qm9iIGlzIGhlcmU="},
+		{historyRedact, "e " + secret, "e [redacted]"},
+		{historyRedact, "e --ttl 1h " + secret, "e --ttl 1h [redacted]"},
+		{historyRedact, "resend  2   " + secret, "resend  2   [redacted]"},
+		{historyRedact, "history search " + secret, "history search [redacted]"},
+		{historyRedact, "status", "status"},
+		{historyRedact, "pake 7-old-mill", "pake [redacted]"},
+		{historyRedact, "pake BPx7kG", "pake BPx7kG"},
+		{historyCommands, "E " + secret, "e"},
+		{historyCommands, "key BPx7kG", "key"},
+		{historyCommands, "3 Qm9iIGlzIGhlcmU=", ""},
+		{historyCommands, "3/1/2 Qm9iIGlz", ""},
+		{historyOff, "status", ""},
+	}
+	for _, tt := range tests {
+		got, ok := historyEntry(tt.policy, tt.input)
+		if !ok {
+			got = ""
+		}
+		if got != tt.want {
+			t.Errorf("historyEntry(%s, %q) = %q, want %q", tt.policy, tt.input, got, tt.want)
+		}
+	}
+}
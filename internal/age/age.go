@@ -0,0 +1,449 @@
+// Package age reads and writes files in the age v1 format
+// (https://age-encryption.org/v1) for X25519 recipients, so files can be
+// exchanged with the age tool and its other implementations.
+//
+// Only the binary format and X25519 and ssh-ed25519 stanzas are supported:
+// stanzas of other types, such as scrypt (passphrase) or ssh-rsa, are
+// skipped, and ASCII armor is not read.
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"e2e-message/internal/crypto"
+)
+
+const (
+	intro       = "age-encryption.org/v1\n"
+	stanzaStart = "->"
+	footer      = "---"
+	x25519Type  = "X25519"
+	x25519Label = "age-encryption.org/v1/X25519"
+
+	recipientHRP = "age"
+	identityHRP  = "AGE-SECRET-KEY-"
+
+	fileKeySize  = 16
+	nonceSize    = 16
+	macSize      = 32
+	columnsPerLn = 64       // Base64 characters per stanza body line
+	maxHeader    = 64 << 10 // Largest header we read
+)
+
+var b64 = base64.RawStdEncoding.Strict()
+
+// ErrNoIdentity is returned by Decrypt when no identity can open the file
+var ErrNoIdentity = errors.New("no identity matched any of the file's recipients")
+
+// Recipient is an X25519 public key, written as "age1..."
+type Recipient struct {
+	key []byte
+}
+
+// NewRecipient returns the recipient for a 32-byte X25519 public key
+func NewRecipient(publicKey []byte) (*Recipient, error) {
+	if len(publicKey) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid X25519 public key length %d", len(publicKey))
+	}
+	return &Recipient{key: bytes.Clone(publicKey)}, nil
+}
+
+// ParseRecipient parses an "age1..." recipient
+func ParseRecipient(s string) (*Recipient, error) {
+	hrp, key, err := bech32Decode(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %w", s, err)
+	}
+	if hrp != recipientHRP {
+		return nil, fmt.Errorf("malformed recipient %q: not an age X25519 recipient", s)
+	}
+	return NewRecipient(key)
+}
+
+// String returns the "age1..." encoding of the recipient
+func (r *Recipient) String() string {
+	s, _ := bech32Encode(recipientHRP, r.key)
+	return s
+}
+
+// Identity is an X25519 private key, written as "AGE-SECRET-KEY-1..."
+type Identity struct {
+	scalar *crypto.Secret
+	public []byte
+	sshKey []byte // SSH encoding of the Ed25519 public key, for NewSSHIdentity
+}
+
+// NewIdentity moves a 32-byte X25519 private key into a new identity and
+// zeroes scalar
+func NewIdentity(scalar []byte) (*Identity, error) {
+	if len(scalar) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid X25519 private key length %d", len(scalar))
+	}
+	public, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 private key: %w", err)
+	}
+	secret, err := crypto.SecretFrom(scalar)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{scalar: secret, public: public}, nil
+}
+
+// ParseIdentities reads an age identity file: one "AGE-SECRET-KEY-1..." per
+// line, with empty lines and '#' comments ignored
+func ParseIdentities(r io.Reader) ([]*Identity, error) {
+	var ids []*Identity
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hrp, scalar, err := bech32Decode(text)
+		if err == nil && hrp != identityHRP {
+			err = fmt.Errorf("not an age X25519 identity")
+		}
+		if err == nil {
+			var id *Identity
+			if id, err = NewIdentity(scalar); err == nil {
+				ids = append(ids, id)
+				continue
+			}
+		}
+		for _, id := range ids {
+			id.Close()
+		}
+		return nil, fmt.Errorf("identity file line %d: %w", n, err)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read identities: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no identities found")
+	}
+	return ids, nil
+}
+
+// Recipient returns the public key matching the identity
+func (id *Identity) Recipient() *Recipient {
+	return &Recipient{key: id.public}
+}
+
+// Close wipes the private key
+func (id *Identity) Close() {
+	id.scalar.Destroy()
+}
+
+// stanza is one recipient entry of the header
+type stanza struct {
+	typ  string
+	args []string
+	body []byte
+}
+
+// wrap encrypts the file key to the recipient
+func (r *Recipient) wrap(fileKey []byte) (*stanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	defer crypto.Wipe(ephemeral)
+	share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, r.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient: %w", err)
+	}
+	defer crypto.Wipe(shared)
+
+	wrapKey, err := deriveKey(shared, append(bytes.Clone(share), r.key...), x25519Label)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(wrapKey)
+	body, err := aeadSeal(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &stanza{typ: x25519Type, args: []string{b64.EncodeToString(share)}, body: body}, nil
+}
+
+// unwrap decrypts the file key from an X25519 stanza, or an ssh-ed25519
+// stanza for an SSH identity; it returns nil, nil if the stanza is for a
+// different key or of another type
+func (id *Identity) unwrap(s *stanza) ([]byte, error) {
+	if s.typ == sshEd25519Type && id.sshKey != nil {
+		return id.unwrapSSH(s)
+	}
+	if s.typ != x25519Type {
+		return nil, nil
+	}
+	if len(s.args) != 1 {
+		return nil, fmt.Errorf("invalid X25519 stanza")
+	}
+	share, err := b64.DecodeString(s.args[0])
+	if err != nil || len(share) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid X25519 stanza share")
+	}
+	if len(s.body) != fileKeySize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("invalid X25519 stanza body")
+	}
+	shared, err := curve25519.X25519(id.scalar.Bytes(), share)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 stanza share: %w", err)
+	}
+	defer crypto.Wipe(shared)
+
+	wrapKey, err := deriveKey(shared, append(share, id.public...), x25519Label)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(wrapKey)
+	fileKey, err := aeadOpen(wrapKey, s.body)
+	if err != nil {
+		return nil, nil
+	}
+	return fileKey, nil
+}
+
+// Encrypt writes an age header for the recipients to dst and returns a
+// writer for the plaintext; Close must be called to write the last chunk
+func Encrypt(dst io.Writer, recipients ...*Recipient) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients")
+	}
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %w", err)
+	}
+	defer crypto.Wipe(fileKey)
+
+	var header bytes.Buffer
+	header.WriteString(intro)
+	for _, r := range recipients {
+		s, err := r.wrap(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		s.marshal(&header)
+	}
+	header.WriteString(footer)
+	mac, err := headerMAC(fileKey, header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	header.WriteString(" " + b64.EncodeToString(mac) + "\n")
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	header.Write(nonce)
+	if _, err := dst.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return newWriter(fileKey, nonce, dst)
+}
+
+// Decrypt reads the age header from src and returns a reader for the
+// plaintext; tampering with the payload is reported by Read. Stanzas no
+// identity can open, including those of unsupported types, are skipped
+func Decrypt(src io.Reader, identities ...*Identity) (io.Reader, error) {
+	br := bufio.NewReader(src)
+	stanzas, headerBytes, mac, err := parseHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileKey []byte
+	var unsupported []string
+	for _, s := range stanzas {
+		if s.typ != x25519Type && s.typ != sshEd25519Type && !slices.Contains(unsupported, s.typ) {
+			unsupported = append(unsupported, s.typ)
+		}
+	}
+	for _, s := range stanzas {
+		for _, id := range identities {
+			if fileKey, err = id.unwrap(s); err != nil {
+				return nil, err
+			}
+			if fileKey != nil {
+				break
+			}
+		}
+		if fileKey != nil {
+			break
+		}
+	}
+	if fileKey == nil && len(unsupported) > 0 {
+		return nil, fmt.Errorf("%w (recipient types not supported: %s)", ErrNoIdentity, strings.Join(unsupported, ", "))
+	}
+	if fileKey == nil {
+		return nil, ErrNoIdentity
+	}
+	defer crypto.Wipe(fileKey)
+
+	want, err := headerMAC(fileKey, headerBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, want) {
+		return nil, fmt.Errorf("bad header MAC")
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(br, nonce); err != nil {
+		return nil, fmt.Errorf("failed to read payload nonce: %w", err)
+	}
+	return newReader(fileKey, nonce, br)
+}
+
+// marshal writes the stanza in header format
+func (s *stanza) marshal(w *bytes.Buffer) {
+	w.WriteString(stanzaStart + " " + s.typ)
+	for _, a := range s.args {
+		w.WriteString(" " + a)
+	}
+	w.WriteByte('\n')
+	body := b64.EncodeToString(s.body)
+	for len(body) >= columnsPerLn {
+		w.WriteString(body[:columnsPerLn] + "\n")
+		body = body[columnsPerLn:]
+	}
+	w.WriteString(body + "\n") // The last line is always shorter than a full one
+}
+
+// parseHeader reads the header; headerBytes is the part covered by the MAC
+func parseHeader(br *bufio.Reader) (stanzas []*stanza, headerBytes, mac []byte, err error) {
+	var header bytes.Buffer
+	readLine := func() (string, error) {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("failed to read header: %w", err)
+		}
+		if header.Len()+len(l) > maxHeader {
+			return "", fmt.Errorf("header too large")
+		}
+		header.WriteString(l)
+		return strings.TrimSuffix(l, "\n"), nil
+	}
+
+	l, err := readLine()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if l+"\n" != intro {
+		return nil, nil, nil, fmt.Errorf("not an age v1 file")
+	}
+
+	for {
+		l, err := readLine()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if rest, ok := strings.CutPrefix(l, footer+" "); ok {
+			if mac, err = b64.DecodeString(rest); err != nil || len(mac) != macSize {
+				return nil, nil, nil, fmt.Errorf("malformed header MAC")
+			}
+			if len(stanzas) == 0 {
+				return nil, nil, nil, fmt.Errorf("no recipients in header")
+			}
+			headerBytes = header.Bytes()[:header.Len()-len(l)-1+len(footer)]
+			return stanzas, headerBytes, mac, nil
+		}
+
+		fields := strings.Split(l, " ")
+		if fields[0] != stanzaStart || len(fields) < 2 {
+			return nil, nil, nil, fmt.Errorf("malformed stanza line %q", l)
+		}
+		for _, f := range fields[1:] {
+			if !isArg(f) {
+				return nil, nil, nil, fmt.Errorf("malformed stanza line %q", l)
+			}
+		}
+		s := &stanza{typ: fields[1], args: fields[2:]}
+		for {
+			l, err := readLine()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			chunk, err := b64.DecodeString(l)
+			if err != nil || len(l) > columnsPerLn {
+				return nil, nil, nil, fmt.Errorf("malformed stanza body")
+			}
+			s.body = append(s.body, chunk...)
+			if len(l) < columnsPerLn {
+				break
+			}
+		}
+		stanzas = append(stanzas, s)
+	}
+}
+
+// isArg reports whether a is a non-empty string of visible ASCII characters
+func isArg(a string) bool {
+	if a == "" {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if a[i] < 33 || a[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+func headerMAC(fileKey, header []byte) ([]byte, error) {
+	key, err := deriveKey(fileKey, nil, "header")
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(key)
+	h := hmac.New(sha256.New, key)
+	h.Write(header)
+	return h.Sum(nil), nil
+}
+
+// deriveKey returns a 32-byte HKDF-SHA256 key
+func deriveKey(secret, salt []byte, info string) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
+
+// aeadSeal encrypts with ChaCha20-Poly1305 and an all-zero nonce, which is
+// safe because every key is used once
+func aeadSeal(key, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), plaintext, nil), nil
+}
+
+func aeadOpen(key, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), ciphertext, nil)
+}
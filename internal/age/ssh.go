@@ -0,0 +1,85 @@
+package age
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+
+	"e2e-message/internal/crypto"
+)
+
+// age encrypts to an SSH Ed25519 key (age -R key.pub) with an ssh-ed25519
+// stanza: an X25519 exchange with the converted key, tweaked with a key
+// derived from the SSH public key so the stanza is bound to it
+
+const (
+	sshEd25519Type  = "ssh-ed25519"
+	sshEd25519Label = "age-encryption.org/v1/ssh-ed25519"
+	sshTagSize      = 4
+)
+
+// NewSSHIdentity moves the X25519 form of an Ed25519 private key into a new
+// identity and zeroes scalar; besides X25519 stanzas for the converted key,
+// it opens ssh-ed25519 stanzas for the Ed25519 public key
+func NewSSHIdentity(publicKey ed25519.PublicKey, scalar []byte) (*Identity, error) {
+	pub, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 public key: %w", err)
+	}
+	id, err := NewIdentity(scalar)
+	if err != nil {
+		return nil, err
+	}
+	id.sshKey = pub.Marshal()
+	return id, nil
+}
+
+// unwrapSSH decrypts the file key from an ssh-ed25519 stanza; it returns
+// nil, nil if the stanza is for a different key
+func (id *Identity) unwrapSSH(s *stanza) ([]byte, error) {
+	if len(s.args) != 2 {
+		return nil, fmt.Errorf("invalid ssh-ed25519 stanza")
+	}
+	tag := sha256.Sum256(id.sshKey)
+	if s.args[0] != b64.EncodeToString(tag[:sshTagSize]) {
+		return nil, nil
+	}
+	share, err := b64.DecodeString(s.args[1])
+	if err != nil || len(share) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid ssh-ed25519 stanza share")
+	}
+	if len(s.body) != fileKeySize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("invalid ssh-ed25519 stanza body")
+	}
+
+	shared, err := curve25519.X25519(id.scalar.Bytes(), share)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh-ed25519 stanza share: %w", err)
+	}
+	defer crypto.Wipe(shared)
+	tweak, err := deriveKey(nil, id.sshKey, sshEd25519Label)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(tweak)
+	tweaked, err := curve25519.X25519(tweak, shared)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh-ed25519 stanza share: %w", err)
+	}
+	defer crypto.Wipe(tweaked)
+
+	wrapKey, err := deriveKey(tweaked, append(share, id.public...), sshEd25519Label)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(wrapKey)
+	fileKey, err := aeadOpen(wrapKey, s.body)
+	if err != nil {
+		return nil, nil
+	}
+	return fileKey, nil
+}
@@ -0,0 +1,163 @@
+package age
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"e2e-message/internal/crypto"
+)
+
+// The payload is the STREAM construction: 64 KiB chunks sealed with
+// ChaCha20-Poly1305 under a nonce of an 11-byte big-endian counter and a
+// final byte that is 1 for the last chunk and 0 otherwise
+
+const chunkSize = 64 << 10
+
+func newPayloadAEAD(fileKey, nonce []byte) (cipher.AEAD, error) {
+	key, err := deriveKey(fileKey, nonce, "payload")
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(key)
+	return chacha20poly1305.New(key)
+}
+
+// chunkNonce returns the nonce of chunk n
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	for i := 10; i >= 3; i-- {
+		nonce[i] = byte(n)
+		n >>= 8
+	}
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type writer struct {
+	aead   cipher.AEAD
+	dst    io.Writer
+	buf    []byte // Plaintext of the current chunk
+	n      uint64 // Number of the current chunk
+	closed bool
+}
+
+func newWriter(fileKey, nonce []byte, dst io.Writer) (*writer, error) {
+	aead, err := newPayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{aead: aead, dst: dst, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// Write buffers p, writing a chunk whenever a full one is followed by more data
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed age writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == chunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last chunk; it does not close the underlying writer
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.flush(true)
+	crypto.Wipe(w.buf[:cap(w.buf)])
+	return err
+}
+
+func (w *writer) flush(last bool) error {
+	out := w.aead.Seal(nil, chunkNonce(w.n, last), w.buf, nil)
+	w.n++
+	crypto.Wipe(w.buf)
+	w.buf = w.buf[:0]
+	_, err := w.dst.Write(out)
+	return err
+}
+
+type reader struct {
+	aead cipher.AEAD
+	src  *bufio.Reader
+	buf  []byte // Ciphertext of the next chunk
+	out  []byte // Unread plaintext
+	n    uint64 // Number of the next chunk
+	err  error  // Sticky error, io.EOF after the last chunk
+}
+
+func newReader(fileKey, nonce []byte, src *bufio.Reader) (*reader, error) {
+	aead, err := newPayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{aead: aead, src: src, buf: make([]byte, chunkSize+chacha20poly1305.Overhead)}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.out, r.err = r.readChunk()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// readChunk decrypts the next chunk, returning io.EOF with the last one
+func (r *reader) readChunk() ([]byte, error) {
+	n, err := io.ReadFull(r.src, r.buf)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		// A short chunk is the last one
+	case err != nil:
+		return nil, err
+	default:
+		// A full chunk is the last one if nothing follows it
+		_, err := r.src.Peek(1)
+		if err == nil {
+			plaintext, err := r.aead.Open(r.buf[:0], chunkNonce(r.n, false), r.buf, nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt payload chunk %d: %w", r.n, err)
+			}
+			r.n++
+			return plaintext, nil
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+	}
+
+	if n < chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("truncated payload")
+	}
+	if n == chacha20poly1305.Overhead && r.n > 0 {
+		return nil, fmt.Errorf("empty last chunk")
+	}
+	plaintext, err := r.aead.Open(r.buf[:0], chunkNonce(r.n, true), r.buf[:n], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt last payload chunk: %w", err)
+	}
+	return plaintext, io.EOF
+}
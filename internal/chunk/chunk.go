@@ -0,0 +1,205 @@
+// Package chunk splits encrypted messages into numbered parts for channels
+// with message-size limits, and reassembles parts that arrive in any order.
+//
+// A part is written as "msgNum/index/total payload", for example "3/1/4 ...".
+// Each payload is encoded independently, so parts can use any encoding.
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"e2e-message/internal/codec"
+)
+
+const (
+	MinSize  = 40   // Smallest allowed line length for a part
+	MaxParts = 1024 // Largest number of parts per message
+)
+
+// headerPattern matches the "msgNum/index/total " prefix of a part
+var headerPattern = regexp.MustCompile(`^(\d+)/(\d+)/(\d+) `)
+
+// Part is one fragment of an encrypted message
+type Part struct {
+	MsgNum uint32
+	Index  int // 1-based
+	Total  int
+	Data   []byte
+}
+
+// Split encodes ciphertext for message msgNum as parts of at most maxLen characters
+// Parts are of similar size, so that no short tail part is mistaken for
+// another encoding by Parse (e.g. "4812" is valid Base64 but reads as Base32)
+func Split(msgNum uint32, ciphertext []byte, enc codec.Encoding, maxLen int) ([]string, error) {
+	if maxLen < MinSize {
+		return nil, fmt.Errorf("part size must be at least %d characters", MinSize)
+	}
+
+	// The header width depends on the total, so grow the estimate until it fits
+	for total := 1; total <= MaxParts; {
+		budget := maxLen - len(header(msgNum, total, total))
+		pieces := split(ciphertext, enc, budget, total)
+		if pieces == nil {
+			return nil, fmt.Errorf("part size %d is too small", maxLen)
+		}
+		if len(pieces) <= total && decodable(pieces, enc) {
+			lines := make([]string, len(pieces))
+			for i, p := range pieces {
+				lines[i] = header(msgNum, i+1, len(pieces)) + enc.Encode(p)
+			}
+			return lines, nil
+		}
+		// Too many pieces, or one that decodes differently: try other boundaries
+		total = max(len(pieces), total+1)
+	}
+	return nil, fmt.Errorf("message needs more than %d parts", MaxParts)
+}
+
+// split cuts data into pieces that encode within budget characters, spread
+// evenly over total pieces where they fit; it returns nil if budget is too small
+func split(data []byte, enc codec.Encoding, budget, total int) [][]byte {
+	var pieces [][]byte
+	for rest := data; len(rest) > 0; {
+		n := fit(rest, enc, budget)
+		if n == 0 {
+			return nil
+		}
+		if left := total - len(pieces); left > 1 {
+			n = min(n, (len(rest)+left-1)/left)
+		}
+		pieces = append(pieces, rest[:n])
+		rest = rest[n:]
+	}
+	return pieces
+}
+
+// decodable reports whether every piece reads back unchanged with the
+// encoding auto-detected, as Parse does
+func decodable(pieces [][]byte, enc codec.Encoding) bool {
+	for _, p := range pieces {
+		data, err := codec.Decode(enc.Encode(p))
+		if err != nil || !bytes.Equal(data, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func header(msgNum uint32, index, total int) string {
+	return fmt.Sprintf("%d/%d/%d ", msgNum, index, total)
+}
+
+// fit returns how many leading bytes of data encode within budget characters
+func fit(data []byte, enc codec.Encoding, budget int) int {
+	// Encoded length grows with the input, so binary search works
+	return sort.Search(len(data), func(n int) bool {
+		return len(enc.Encode(data[:n+1])) > budget
+	})
+}
+
+// IsPart reports whether a line starts with a part header
+func IsPart(line string) bool {
+	return headerPattern.MatchString(line)
+}
+
+// Parse parses a part line; the payload encoding is auto-detected
+func Parse(line string) (*Part, error) {
+	m := headerPattern.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("invalid part: expected 'msgNum/part/total data'")
+	}
+	msgNum, err := strconv.ParseUint(m[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message number: %w", err)
+	}
+	index, err1 := strconv.Atoi(m[2])
+	total, err2 := strconv.Atoi(m[3])
+	if err1 != nil || err2 != nil || total < 1 || total > MaxParts || index < 1 || index > total {
+		return nil, fmt.Errorf("invalid part number %s/%s", m[2], m[3])
+	}
+
+	data, err := codec.Decode(strings.TrimSpace(line[len(m[0]):]))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty part")
+	}
+	return &Part{MsgNum: uint32(msgNum), Index: index, Total: total, Data: data}, nil
+}
+
+// Status reports the progress of a fragmented message
+type Status struct {
+	MsgNum   uint32
+	Received int
+	Total    int
+	Missing  []int // 1-based part numbers not yet received
+}
+
+// Complete reports whether all parts have arrived
+func (s Status) Complete() bool {
+	return s.Total > 0 && s.Received == s.Total
+}
+
+// Assembler collects parts until a message is complete
+type Assembler struct {
+	pending map[uint32][][]byte // msgNum -> parts by index (nil = missing)
+}
+
+// NewAssembler creates an empty assembler
+func NewAssembler() *Assembler {
+	return &Assembler{pending: make(map[uint32][][]byte)}
+}
+
+// Add stores a part and returns the joined data once every part is present,
+// forgetting the message so that it can be sent again if it fails to decrypt.
+// The earlier copy of a conflicting part may have been garbled, so the new one
+// wins: another total starts the message over, other data replaces the part.
+func (a *Assembler) Add(p *Part) ([]byte, Status) {
+	parts, ok := a.pending[p.MsgNum]
+	if !ok || len(parts) != p.Total {
+		parts = make([][]byte, p.Total)
+		a.pending[p.MsgNum] = parts
+	}
+	parts[p.Index-1] = p.Data
+
+	status := a.status(p.MsgNum)
+	if !status.Complete() {
+		return nil, status
+	}
+
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	delete(a.pending, p.MsgNum)
+	return data, status
+}
+
+// Pending returns the status of every incomplete message, lowest number first
+func (a *Assembler) Pending() []Status {
+	var out []Status
+	for msgNum := range a.pending {
+		out = append(out, a.status(msgNum))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].MsgNum < out[j].MsgNum })
+	return out
+}
+
+func (a *Assembler) status(msgNum uint32) Status {
+	parts := a.pending[msgNum]
+	st := Status{MsgNum: msgNum, Total: len(parts)}
+	for i, part := range parts {
+		if part == nil {
+			st.Missing = append(st.Missing, i+1)
+		} else {
+			st.Received++
+		}
+	}
+	return st
+}
@@ -0,0 +1,186 @@
+// Package codec converts binary keys and ciphertexts to text for channels
+// with different character restrictions, and detects the encoding on input.
+package codec
+
+import (
+	"encoding/ascii85"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Encoding selects a text representation for binary data
+type Encoding int
+
+const (
+	Base64    Encoding = iota // Standard padded Base64 (default)
+	Base64URL                 // URL-safe Base64 without padding
+	Base32                    // Base32 Crockford in groups of four, for dictation
+	Base85                    // Ascii85 wrapped in <~ ~>, the densest option
+	Words                     // One word per byte, for reading aloud
+)
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var crockford = base32.NewEncoding(crockfordAlphabet).WithPadding(base32.NoPadding)
+
+// String returns the name used by Parse
+func (e Encoding) String() string {
+	switch e {
+	case Base64:
+		return "base64"
+	case Base64URL:
+		return "base64url"
+	case Base32:
+		return "base32"
+	case Base85:
+		return "base85"
+	case Words:
+		return "words"
+	default:
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+}
+
+// Parse parses an encoding name
+func Parse(name string) (Encoding, error) {
+	switch strings.ToLower(name) {
+	case "base64", "std":
+		return Base64, nil
+	case "base64url", "url":
+		return Base64URL, nil
+	case "base32", "crockford":
+		return Base32, nil
+	case "base85", "ascii85":
+		return Base85, nil
+	case "words", "wordlist":
+		return Words, nil
+	default:
+		return 0, fmt.Errorf("unknown encoding %q (use base64, base64url, base32, base85 or words)", name)
+	}
+}
+
+// Encode converts data to text in this encoding
+func (e Encoding) Encode(data []byte) string {
+	switch e {
+	case Base64URL:
+		return base64.RawURLEncoding.EncodeToString(data)
+	case Base32:
+		s := crockford.EncodeToString(data)
+		var sb strings.Builder
+		for i := 0; i < len(s); i += 4 {
+			if i > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteString(s[i:min(i+4, len(s))])
+		}
+		return sb.String()
+	case Base85:
+		buf := make([]byte, ascii85.MaxEncodedLen(len(data)))
+		n := ascii85.Encode(buf, data)
+		return "<~" + string(buf[:n]) + "~>"
+	case Words:
+		words := make([]string, len(data))
+		for i, b := range data {
+			words[i] = byteWords[b]
+		}
+		return strings.Join(words, " ")
+	default:
+		return base64.StdEncoding.EncodeToString(data)
+	}
+}
+
+// Decode converts text in this encoding back to data
+func (e Encoding) Decode(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	switch e {
+	case Base64URL:
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	case Base32:
+		// Crockford decoding is case-insensitive and forgives look-alikes
+		s = strings.ToUpper(strings.ReplaceAll(s, "-", ""))
+		s = strings.NewReplacer("O", "0", "I", "1", "L", "1").Replace(s)
+		return crockford.DecodeString(s)
+	case Base85:
+		if !strings.HasPrefix(s, "<~") || !strings.HasSuffix(s, "~>") {
+			return nil, fmt.Errorf("missing <~ ~> delimiters")
+		}
+		body := s[2 : len(s)-2]
+		buf := make([]byte, 4*len(body)) // 'z' expands to four bytes
+		n, _, err := ascii85.Decode(buf, []byte(body), true)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case Words:
+		fields := strings.Fields(strings.ToLower(s))
+		data := make([]byte, len(fields))
+		for i, w := range fields {
+			b, ok := wordIndex[w]
+			if !ok {
+				return nil, fmt.Errorf("unknown word %q", w)
+			}
+			data[i] = b
+		}
+		return data, nil
+	default:
+		return base64.StdEncoding.DecodeString(s)
+	}
+}
+
+// Detect guesses the encoding of s:
+//   - <~ ... ~> is Base85
+//   - anything with whitespace is Words
+//   - + / or = means standard Base64, _ means URL-safe Base64
+//   - letters of one case, digits and hyphens only is Base32 Crockford, which
+//     is case-insensitive for dictation; random Base64 mixes both cases
+//   - otherwise Base64 when the length is a multiple of four, else URL-safe
+func Detect(s string) Encoding {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "<~"):
+		return Base85
+	case strings.ContainsAny(s, " \t\r\n"):
+		return Words
+	case strings.ContainsAny(s, "+/="):
+		return Base64
+	case strings.Contains(s, "_"):
+		return Base64URL
+	case isCrockford(s):
+		return Base32
+	case strings.Contains(s, "-") || len(s)%4 != 0:
+		return Base64URL
+	default:
+		return Base64
+	}
+}
+
+func isCrockford(s string) bool {
+	if s == "" {
+		return false
+	}
+	var upper, lower bool
+	for _, c := range s {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9' || c == '-':
+		default:
+			return false
+		}
+	}
+	return !(upper && lower)
+}
+
+// Decode detects the encoding of s and decodes it
+func Decode(s string) ([]byte, error) {
+	enc := Detect(s)
+	data, err := enc.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s encoding: %w", enc, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,47 @@
+package codec
+
+// byteWords maps each byte value to a distinct, easily pronounced word
+// It is separate from the verification wordlist, which has duplicates
+// and cannot change without changing everyone's verification words
+var byteWords = [256]string{
+	"acorn", "actor", "agent", "alarm", "album", "alley", "amber", "angel",
+	"ankle", "apple", "arena", "armor", "arrow", "atlas", "attic", "autumn",
+	"avenue", "bacon", "badge", "bagel", "baker", "bamboo", "banjo", "barrel",
+	"basin", "basket", "beacon", "beaver", "blanket", "blender", "bonus", "border",
+	"bottle", "boxer", "bucket", "buffalo", "burger", "butter", "cabin", "cactus",
+	"camel", "canal", "candle", "canyon", "carbon", "carpet", "castle", "cattle",
+	"cello", "chalk", "cheetah", "cherry", "chimney", "cider", "cinema", "circus",
+	"citrus", "closet", "cobra", "cocoa", "comet", "compass", "copper", "cotton",
+	"cougar", "coyote", "crater", "cricket", "crystal", "cupcake", "dagger", "dancer",
+	"denim", "desert", "dinner", "doctor", "dolphin", "donkey", "dragon", "drummer",
+	"eagle", "easel", "echo", "eclipse", "elbow", "elephant", "ember", "engine",
+	"falcon", "farmer", "feather", "ferry", "fiddle", "finger", "flannel", "flute",
+	"fossil", "fountain", "gadget", "galaxy", "garlic", "gazelle", "geyser", "giant",
+	"ginger", "glacier", "goblin", "gravel", "guitar", "hammer", "harbor", "harvest",
+	"hazel", "helmet", "hockey", "honey", "hornet", "hunter", "husky", "igloo",
+	"indigo", "insect", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly",
+	"jigsaw", "jungle", "kayak", "kernel", "kettle", "kitten", "koala", "ladder",
+	"lagoon", "lantern", "laptop", "lemon", "leopard", "lettuce", "lizard", "lobster",
+	"locket", "lumber", "magnet", "mango", "maple", "marble", "meadow", "melon",
+	"metal", "mitten", "monkey", "mosaic", "muffin", "museum", "napkin", "nectar",
+	"needle", "nickel", "noodle", "nugget", "oasis", "octopus", "olive", "onion",
+	"orbit", "orchid", "ostrich", "otter", "oyster", "paddle", "palace", "panda",
+	"parrot", "pebble", "pelican", "pepper", "piano", "pickle", "pigeon", "pillow",
+	"pirate", "planet", "pocket", "pony", "potato", "pretzel", "pumpkin", "puzzle",
+	"quartz", "quiver", "rabbit", "radar", "radish", "raven", "ribbon", "riddle",
+	"robot", "rocket", "saddle", "salmon", "sandal", "saucer", "scooter", "shadow",
+	"shovel", "signal", "silver", "skater", "sketch", "sloth", "socket", "spider",
+	"sponge", "stable", "statue", "sugar", "summit", "sunset", "sweater", "tablet",
+	"teapot", "temple", "tennis", "thunder", "ticket", "tiger", "toaster", "tomato",
+	"tractor", "trumpet", "tulip", "tunnel", "turkey", "turtle", "tuxedo", "umbrella",
+	"unicorn", "valley", "velvet", "violin", "volcano", "waffle", "wagon", "walnut",
+	"walrus", "whistle", "willow", "window", "wizard", "yogurt", "zebra", "zipper",
+}
+
+var wordIndex = func() map[string]byte {
+	m := make(map[string]byte, len(byteWords))
+	for i, w := range byteWords {
+		m[w] = byte(i)
+	}
+	return m
+}()
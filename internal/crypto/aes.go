@@ -8,60 +8,88 @@ import (
 )
 
 const (
-	nonceSize = 12 // GCM standard nonce size
+	NonceSize = 12 // GCM standard nonce size
+	Overhead  = 16 // GCM authentication tag size
 )
 
 // Encrypt encrypts plaintext using AES-256-GCM
 // Output format: nonce (12 bytes) + ciphertext + auth tag (16 bytes)
 func Encrypt(plaintext, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	// Generate random nonce
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
+	return Seal(nil, key, nonce, plaintext, nil)
+}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+// EncryptWithNonce is Encrypt with a given nonce and associated data, for
+// test vectors
+// A nonce must never be used twice with the same key
+func EncryptWithNonce(plaintext, key, nonce, additionalData []byte) ([]byte, error) {
+	return Seal(nil, key, nonce, plaintext, additionalData)
+}
+
+// Seal is EncryptWithNonce appending to dst, which must not overlap
+// plaintext; with enough capacity in dst it allocates only the cipher
+// additionalData is authenticated but not encrypted, and Open must be
+// given the same
+func Seal(dst, key, nonce, plaintext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != NonceSize {
+		return nil, fmt.Errorf("nonce must be %d bytes", NonceSize)
 	}
 
-	// Generate random nonce
-	nonce := make([]byte, nonceSize)
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
 	}
 
 	// Encrypt and append to nonce
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-
-	return ciphertext, nil
+	return gcm.Seal(append(dst, nonce...), nonce, plaintext, additionalData), nil
 }
 
 // Decrypt decrypts ciphertext using AES-256-GCM
 // Input format: nonce (12 bytes) + ciphertext + auth tag (16 bytes)
 func Decrypt(ciphertext, key []byte) ([]byte, error) {
-	if len(ciphertext) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
+	return Open(nil, key, ciphertext, nil)
+}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+// Open is Decrypt appending the plaintext to dst, for a ciphertext sealed
+// with additionalData
+func Open(dst, key, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < NonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return nil, err
 	}
 
 	// Extract nonce and ciphertext
-	nonce := ciphertext[:nonceSize]
-	encryptedData := ciphertext[nonceSize:]
+	nonce := ciphertext[:NonceSize]
+	encryptedData := ciphertext[NonceSize:]
 
 	// Decrypt and verify
-	plaintext, err := gcm.Open(nil, nonce, encryptedData, nil)
+	plaintext, err := gcm.Open(dst, nonce, encryptedData, additionalData)
 	if err != nil {
 		return nil, fmt.Errorf("decryption failed: %w", err)
 	}
 
 	return plaintext, nil
 }
+
+// newGCM sets up AES-256-GCM for key; every message has its own key, so
+// there is nothing to cache between calls
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
@@ -15,18 +15,88 @@ func GenerateKeyPair() (*ecdh.PrivateKey, error) {
 	return ecdh.P256().GenerateKey(rand.Reader)
 }
 
+// GenerateKeyPairFrom generates a P-256 key pair from the bytes of r
+// Unlike ecdh.GenerateKey, the result depends only on what r returns, so a
+// fixed r gives a fixed key; use crypto/rand.Reader outside of tests
+func GenerateKeyPairFrom(r io.Reader) (*ecdh.PrivateKey, error) {
+	scalar := make([]byte, 32)
+	defer Wipe(scalar)
+	for {
+		if _, err := io.ReadFull(r, scalar); err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		// Zero and values above the group order are rejected; try again
+		if key, err := ecdh.P256().NewPrivateKey(scalar); err == nil {
+			return key, nil
+		}
+	}
+}
+
+// PrivateKeySecret moves a private key's scalar into a Secret
+// The ecdh.PrivateKey itself should be dropped afterwards; its internal
+// copy cannot be wiped and is left to the garbage collector
+func PrivateKeySecret(privateKey *ecdh.PrivateKey) (*Secret, error) {
+	return SecretFrom(privateKey.Bytes())
+}
+
 // ComputeSharedSecret computes the ECDH shared secret
 func ComputeSharedSecret(privateKey *ecdh.PrivateKey, peerPublicKey *ecdh.PublicKey) ([]byte, error) {
 	return privateKey.ECDH(peerPublicKey)
 }
 
+// ComputeSharedSecretFrom computes the ECDH shared secret with a private key
+// held in a Secret (see PrivateKeySecret)
+func ComputeSharedSecretFrom(privateKey *Secret, peerPublicKey *ecdh.PublicKey) (*Secret, error) {
+	key, err := ecdh.P256().NewPrivateKey(privateKey.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	shared, err := key.ECDH(peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return SecretFrom(shared)
+}
+
+// X25519SharedSecret computes the X25519 shared secret of a private key held
+// in a Secret and a peer's 32-byte public key
+func X25519SharedSecret(privateKey *Secret, peerPublicKey []byte) (*Secret, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(peerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	shared, err := key.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	return SecretFrom(shared)
+}
+
+// X25519PublicKey returns the public key of an X25519 private key
+func X25519PublicKey(privateKey *Secret) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	return key.PublicKey().Bytes(), nil
+}
+
 // DeriveAESKey derives a 32-byte AES key from the shared secret using HKDF-SHA256
-func DeriveAESKey(sharedSecret []byte) ([]byte, error) {
+// context, such as the handshake both sides saw, is the HKDF salt
+func DeriveAESKey(sharedSecret, context []byte) (*Secret, error) {
 	// Use HKDF with SHA-256 to derive a 32-byte key
-	hkdfReader := hkdf.New(sha256.New, sharedSecret, nil, []byte("e2e-message-aes-key"))
+	hkdfReader := hkdf.New(sha256.New, sharedSecret, context, []byte("e2e-message-aes-key"))
 
-	aesKey := make([]byte, 32)
-	if _, err := io.ReadFull(hkdfReader, aesKey); err != nil {
+	aesKey, err := NewSecret(32)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(hkdfReader, aesKey.Bytes()); err != nil {
+		aesKey.Destroy()
 		return nil, fmt.Errorf("failed to derive AES key: %w", err)
 	}
 
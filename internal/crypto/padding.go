@@ -0,0 +1,98 @@
+package crypto
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// PaddingScheme selects how plaintext is padded before encryption
+// so that ciphertext length reveals less about message length
+type PaddingScheme int
+
+const (
+	PaddingNone       PaddingScheme = iota // Only the end marker is added
+	PaddingPadme                           // Padmé: at most ~12% overhead, leaks O(log log n) bits
+	PaddingPowerOfTwo                      // Next power of two: coarse buckets, up to 100% overhead
+)
+
+const (
+	DefaultMinBucket = 32      // Default smallest padded size in bytes
+	MaxMinBucket     = 1 << 16 // Upper bound for the minimum bucket setting
+)
+
+// String returns the name used by ParsePaddingScheme
+func (p PaddingScheme) String() string {
+	switch p {
+	case PaddingNone:
+		return "none"
+	case PaddingPadme:
+		return "padme"
+	case PaddingPowerOfTwo:
+		return "pow2"
+	default:
+		return fmt.Sprintf("PaddingScheme(%d)", int(p))
+	}
+}
+
+// ParsePaddingScheme parses a padding scheme name
+func ParsePaddingScheme(name string) (PaddingScheme, error) {
+	switch strings.ToLower(name) {
+	case "none", "off":
+		return PaddingNone, nil
+	case "padme":
+		return PaddingPadme, nil
+	case "pow2", "power-of-two":
+		return PaddingPowerOfTwo, nil
+	default:
+		return 0, fmt.Errorf("unknown padding scheme %q (use none, padme or pow2)", name)
+	}
+}
+
+// PaddedLen returns the padded length for n bytes of data,
+// including the one-byte end marker
+func PaddedLen(n int, scheme PaddingScheme, minBucket int) int {
+	n++ // End marker
+	if scheme == PaddingNone {
+		return n
+	}
+	if n < minBucket {
+		n = minBucket
+	}
+
+	switch scheme {
+	case PaddingPadme:
+		if n < 2 {
+			return n
+		}
+		// Keep only the top log2(log2(n))+1 bits of the length
+		e := bits.Len(uint(n)) - 1
+		s := bits.Len(uint(e))
+		mask := 1<<(e-s) - 1
+		return (n + mask) &^ mask
+	case PaddingPowerOfTwo:
+		return 1 << bits.Len(uint(n-1))
+	}
+	return n
+}
+
+// Pad appends an 0x80 end marker followed by zero bytes up to the padded length
+// The padding is encrypted along with the data, so it is authenticated by GCM
+func Pad(data []byte, scheme PaddingScheme, minBucket int) []byte {
+	padded := make([]byte, PaddedLen(len(data), scheme, minBucket))
+	copy(padded, data)
+	padded[len(data)] = 0x80
+	return padded
+}
+
+// Unpad strips the padding added by Pad
+func Unpad(padded []byte) ([]byte, error) {
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+	if i < 0 || padded[i] != 0x80 {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return padded[:i], nil
+}
@@ -0,0 +1,252 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// PAKE is one side of a CPace password-authenticated key exchange over
+// P-256 (draft-irtf-cfrg-cpace). Both sides derive a generator from the
+// shared code, send one point, and end up with the same secret only if
+// they used the same code; an attacker in the middle gets one guess per
+// exchange and learns nothing from observing it.
+//
+// The roles are symmetric: messages are ordered by value, not by who
+// sent first, so either side may start.
+type PAKE struct {
+	scalar *Secret         // Our secret scalar
+	gen    *ecdh.PublicKey // Generator derived from the code
+	msg    []byte          // Our message: x-coordinate of scalar * gen
+}
+
+const (
+	PAKEMessageSize = 32 // Size of a PAKE message
+
+	pakeDST  = "e2e-message-CPace-P256_XMD:SHA-256_SSWU_RO_"
+	pakeInfo = "e2e-message CPace P-256 v1"
+)
+
+// NewPAKE starts an exchange for a shared code, drawing the secret scalar
+// from r
+func NewPAKE(r io.Reader, code string) (*PAKE, error) {
+	if code == "" {
+		return nil, errors.New("empty PAKE code")
+	}
+	x, y := HashToP256([]byte(code), []byte(pakeDST))
+	gen, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive generator: %w", err)
+	}
+
+	key, err := GenerateKeyPairFrom(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate PAKE key: %w", err)
+	}
+	msg, err := key.ECDH(gen)
+	if err != nil {
+		return nil, err
+	}
+	scalar, err := PrivateKeySecret(key)
+	if err != nil {
+		return nil, err
+	}
+	return &PAKE{scalar: scalar, gen: gen, msg: msg}, nil
+}
+
+// Message returns the message to send to the peer
+func (p *PAKE) Message() []byte {
+	return p.msg
+}
+
+// Finish combines the peer's message into the shared secret
+// The secret is only shared if both sides used the same code; a wrong
+// code is noticed when the first message fails to decrypt
+func (p *PAKE) Finish(peerMsg []byte) (*Secret, error) {
+	if p.scalar.Bytes() == nil {
+		return nil, errors.New("PAKE already finished")
+	}
+	if len(peerMsg) != PAKEMessageSize {
+		return nil, fmt.Errorf("invalid PAKE message length %d", len(peerMsg))
+	}
+	if bytes.Equal(peerMsg, p.msg) {
+		return nil, errors.New("received our own PAKE message")
+	}
+	peer, err := liftX(peerMsg)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ComputeSharedSecretFrom(p.scalar, peer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PAKE message: %w", err)
+	}
+	defer shared.Destroy()
+	p.Close()
+
+	// Bind the secret to both messages, in a fixed order
+	info := []byte(pakeInfo)
+	first, second := p.msg, peerMsg
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	info = append(append(info, first...), second...)
+
+	key, err := NewSecret(32)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared.Bytes(), nil, info), key.Bytes()); err != nil {
+		key.Destroy()
+		return nil, fmt.Errorf("failed to derive PAKE key: %w", err)
+	}
+	return key, nil
+}
+
+// Close wipes the secret scalar
+func (p *PAKE) Close() {
+	p.scalar.Destroy()
+}
+
+// P-256 field arithmetic for hash-to-curve and point decompression
+var (
+	p256   = elliptic.P256().Params()
+	fieldP = p256.P
+	curveB = p256.B
+	curveA = new(big.Int).Sub(fieldP, big.NewInt(3))  // -3
+	sswuZ  = new(big.Int).Sub(fieldP, big.NewInt(10)) // -10
+)
+
+// liftX returns the point with x-coordinate x; which of the two points is
+// irrelevant because only x-coordinates of multiples are used
+func liftX(x []byte) (*ecdh.PublicKey, error) {
+	xi := new(big.Int).SetBytes(x)
+	if xi.Cmp(fieldP) >= 0 {
+		return nil, errors.New("invalid PAKE message")
+	}
+	y := new(big.Int).ModSqrt(curveRHS(xi), fieldP)
+	if y == nil {
+		return nil, errors.New("invalid PAKE message: not a curve point")
+	}
+	point := make([]byte, 65)
+	point[0] = 4
+	xi.FillBytes(point[1:33])
+	y.FillBytes(point[33:])
+	return ecdh.P256().NewPublicKey(point)
+}
+
+// curveRHS returns x^3 + ax + b
+func curveRHS(x *big.Int) *big.Int {
+	r := new(big.Int).Exp(x, big.NewInt(3), fieldP)
+	r.Add(r, new(big.Int).Mul(curveA, x))
+	r.Add(r, curveB)
+	return r.Mod(r, fieldP)
+}
+
+// HashToP256 hashes msg to a P-256 point with the P256_XMD:SHA-256_SSWU_RO_
+// suite of RFC 9380 and returns its affine coordinates as 32-byte slices
+func HashToP256(msg, dst []byte) (x, y []byte) {
+	uniform := expandMessageXMD(msg, dst, 96)
+	u0 := new(big.Int).Mod(new(big.Int).SetBytes(uniform[:48]), fieldP)
+	u1 := new(big.Int).Mod(new(big.Int).SetBytes(uniform[48:]), fieldP)
+	x0, y0 := mapToCurveSSWU(u0)
+	x1, y1 := mapToCurveSSWU(u1)
+	px, py := addPoints(x0, y0, x1, y1) // The cofactor of P-256 is 1
+	x, y = make([]byte, 32), make([]byte, 32)
+	px.FillBytes(x)
+	py.FillBytes(y)
+	return x, y
+}
+
+// expandMessageXMD is expand_message_xmd with SHA-256 (RFC 9380, 5.3.1)
+func expandMessageXMD(msg, dst []byte, length int) []byte {
+	dstPrime := append(bytes.Clone(dst), byte(len(dst)))
+	h := sha256.New()
+	h.Write(make([]byte, h.BlockSize()))
+	h.Write(msg)
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(length)))
+	h.Write([]byte{0})
+	h.Write(dstPrime)
+	b0 := h.Sum(nil)
+
+	var out, prev []byte
+	for i := 1; len(out) < length; i++ {
+		h.Reset()
+		block := bytes.Clone(b0)
+		for j := range prev {
+			block[j] ^= prev[j]
+		}
+		h.Write(block)
+		h.Write([]byte{byte(i)})
+		h.Write(dstPrime)
+		prev = h.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+// mapToCurveSSWU is the simplified SWU map for P-256 (RFC 9380, 6.6.2)
+func mapToCurveSSWU(u *big.Int) (x, y *big.Int) {
+	mod := func(v *big.Int) *big.Int { return v.Mod(v, fieldP) }
+	inv := func(v *big.Int) *big.Int { return new(big.Int).ModInverse(v, fieldP) }
+
+	u2 := mod(new(big.Int).Mul(u, u))
+	zu2 := mod(new(big.Int).Mul(sswuZ, u2))
+	den := mod(new(big.Int).Add(new(big.Int).Mul(zu2, zu2), zu2)) // Z^2 u^4 + Z u^2
+
+	var x1 *big.Int
+	if den.Sign() == 0 {
+		// x1 = B / (Z * A)
+		x1 = mod(new(big.Int).Mul(curveB, inv(mod(new(big.Int).Mul(sswuZ, curveA)))))
+	} else {
+		// x1 = (-B / A) * (1 + 1/den)
+		negBOverA := mod(new(big.Int).Mul(new(big.Int).Sub(fieldP, curveB), inv(curveA)))
+		x1 = mod(new(big.Int).Mul(negBOverA, new(big.Int).Add(big.NewInt(1), inv(den))))
+	}
+
+	x = x1
+	y = new(big.Int).ModSqrt(curveRHS(x1), fieldP)
+	if y == nil {
+		x = mod(new(big.Int).Mul(zu2, x1))
+		y = new(big.Int).ModSqrt(curveRHS(x), fieldP)
+	}
+	if u.Bit(0) != y.Bit(0) {
+		y.Sub(fieldP, y)
+	}
+	return x, y
+}
+
+// addPoints adds two affine points that are not the point at infinity
+func addPoints(x1, y1, x2, y2 *big.Int) (x, y *big.Int) {
+	var lambda *big.Int
+	switch {
+	case x1.Cmp(x2) != 0:
+		num := new(big.Int).Sub(y2, y1)
+		den := new(big.Int).Sub(x2, x1)
+		lambda = num.Mul(num, den.ModInverse(den.Mod(den, fieldP), fieldP))
+	case y1.Cmp(y2) == 0 && y1.Sign() != 0:
+		// Doubling: lambda = (3x^2 + a) / 2y
+		num := new(big.Int).Mul(x1, x1)
+		num.Mul(num, big.NewInt(3)).Add(num, curveA)
+		den := new(big.Int).Lsh(y1, 1)
+		lambda = num.Mul(num, den.ModInverse(den.Mod(den, fieldP), fieldP))
+	default:
+		// P + (-P) is the point at infinity, which the caller never gets
+		// from hashing (probability 2^-256)
+		return new(big.Int), new(big.Int)
+	}
+	lambda.Mod(lambda, fieldP)
+
+	x = new(big.Int).Mul(lambda, lambda)
+	x.Sub(x, x1).Sub(x, x2).Mod(x, fieldP)
+	y = new(big.Int).Sub(x1, x)
+	y.Mul(y, lambda).Sub(y, y1).Mod(y, fieldP)
+	return x, y
+}
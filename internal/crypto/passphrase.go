@@ -0,0 +1,35 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	SaltSize = 16 // Size of passphrase salts
+
+	// scrypt cost parameters (about 100 ms and 32 MiB per derivation)
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// NewSalt returns a random salt for DeriveKeyFromPassphrase
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return salt, nil
+}
+
+// DeriveKeyFromPassphrase derives a 32-byte AES key from a passphrase with scrypt
+func DeriveKeyFromPassphrase(passphrase string, salt []byte) (*Secret, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return SecretFrom(key)
+}
@@ -3,44 +3,89 @@ package crypto
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"sort"
 	"sync"
 
 	"golang.org/x/crypto/hkdf"
 )
 
+var (
+	errRatchetClosed = errors.New("ratchet closed")
+
+	// ErrAlreadyReceived is returned for a message number whose key was used or dropped
+	ErrAlreadyReceived = errors.New("already received or too old")
+
+	// ErrTooManySkipped is returned for a message number too far ahead of the chain
+	ErrTooManySkipped = errors.New("too many skipped messages")
+)
+
 // Ratchet implements a symmetric key ratchet for forward secrecy
 // Each message uses a unique key derived from the chain, and old keys are deleted
+// Chain keys are overwritten in place on every step, so old ones do not linger
 type Ratchet struct {
-	sendChainKey []byte // Chain key for sending
-	recvChainKey []byte // Chain key for receiving
-	sendMsgNum   uint32 // Send message counter
-	recvMsgNum   uint32 // Receive message counter
-	skippedKeys  map[uint32][]byte // Cache for out-of-order messages
-	maxSkip      uint32 // Maximum messages to skip
+	sendChainKey *Secret               // Chain key for sending
+	recvChainKey *Secret               // Chain key for receiving
+	sendMsgNum   uint32                // Send message counter
+	recvMsgNum   uint32                // Receive message counter
+	skippedKeys  map[uint32]skippedKey // Cache for out-of-order messages
+	maxSkip      uint32                // Maximum messages to skip
+	scratch      *Secret               // Message key and chain key copy of the current step
+	kdf          keyDeriver            // Reused for every step
 	mu           sync.Mutex
 }
 
-// NewRatchet creates a new ratchet from a shared secret
-// The initiator and responder get mirrored send/recv chains
-func NewRatchet(sharedSecret []byte, isInitiator bool) (*Ratchet, error) {
-	// Derive two chain keys from the shared secret
-	hkdfReader := hkdf.New(sha256.New, sharedSecret, nil, []byte("e2e-ratchet-chains"))
+// skippedKey is a cached message key inside the slab of keys skipped with it
+type skippedKey struct {
+	slab *keySlab
+	key  []byte
+}
+
+// keySlab holds the keys skipped in one go in a single Secret, which is
+// destroyed once the last of them is used
+type keySlab struct {
+	mem  *Secret
+	live int
+}
 
-	chainKey1 := make([]byte, 32)
-	chainKey2 := make([]byte, 32)
+// NewRatchet creates a new ratchet from a shared secret and a context that
+// DeriveChainKeys binds the chains to
+// The initiator and responder get mirrored send/recv chains. The ratchet
+// draws no randomness and reads no clock: every key follows from the
+// shared secret and context, so it is deterministic as it is
+func NewRatchet(sharedSecret, context []byte, isInitiator bool) (*Ratchet, error) {
+	chainKey1, err := NewSecret(32)
+	if err != nil {
+		return nil, err
+	}
+	chainKey2, err := NewSecret(32)
+	if err != nil {
+		chainKey1.Destroy()
+		return nil, err
+	}
 
-	if _, err := io.ReadFull(hkdfReader, chainKey1); err != nil {
-		return nil, fmt.Errorf("failed to derive chain key 1: %w", err)
+	// Derive two chain keys from the shared secret
+	if err := DeriveChainKeys(sharedSecret, context, chainKey1.Bytes(), chainKey2.Bytes()); err != nil {
+		chainKey1.Destroy()
+		chainKey2.Destroy()
+		return nil, err
 	}
-	if _, err := io.ReadFull(hkdfReader, chainKey2); err != nil {
-		return nil, fmt.Errorf("failed to derive chain key 2: %w", err)
+
+	scratch, err := NewSecret(64)
+	if err != nil {
+		chainKey1.Destroy()
+		chainKey2.Destroy()
+		return nil, err
 	}
 
 	r := &Ratchet{
-		skippedKeys: make(map[uint32][]byte),
+		skippedKeys: make(map[uint32]skippedKey),
 		maxSkip:     100, // Allow up to 100 skipped messages
+		scratch:     scratch,
+		kdf:         keyDeriver{h: sha256.New()},
 	}
 
 	// Initiator and responder use opposite chains
@@ -55,91 +100,224 @@ func NewRatchet(sharedSecret []byte, isInitiator bool) (*Ratchet, error) {
 	return r, nil
 }
 
+// DeriveChainKeys derives the initiator's and the responder's sending
+// chain keys from a shared secret into two 32-byte buffers; context, such
+// as the handshake both sides saw, is the HKDF salt
+func DeriveChainKeys(sharedSecret, context []byte, initiator, responder []byte) error {
+	hkdfReader := hkdf.New(sha256.New, sharedSecret, context, []byte("e2e-ratchet-chains"))
+	if _, err := io.ReadFull(hkdfReader, initiator); err != nil {
+		return fmt.Errorf("failed to derive chain key 1: %w", err)
+	}
+	if _, err := io.ReadFull(hkdfReader, responder); err != nil {
+		return fmt.Errorf("failed to derive chain key 2: %w", err)
+	}
+	return nil
+}
+
 // NextSendKey returns the next message key for sending and ratchets forward
-func (r *Ratchet) NextSendKey() ([]byte, uint32, error) {
+// The caller must Destroy the key after use
+func (r *Ratchet) NextSendKey() (*Secret, uint32, error) {
+	var msgKey *Secret
+	var msgNum uint32
+	err := r.UseSendKey(func(key []byte, num uint32) error {
+		var err error
+		msgKey, err = copySecret(key)
+		msgNum = num
+		return err
+	})
+	return msgKey, msgNum, err
+}
+
+// UseSendKey ratchets forward and passes the next message key and its
+// number to use, e.g. to encrypt. The key lives in reused locked memory and
+// is wiped when use returns, so it must not be kept; use must not call back
+// into the ratchet
+func (r *Ratchet) UseSendKey(use func(key []byte, msgNum uint32) error) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	msgKey, newChainKey, err := r.deriveKeys(r.sendChainKey, r.sendMsgNum)
-	if err != nil {
-		return nil, 0, err
+	if r.sendChainKey == nil {
+		return errRatchetClosed
 	}
 
+	msgKey := r.scratch.Bytes()[:32]
+	defer Wipe(msgKey)
+	r.kdf.step(r.sendChainKey.Bytes(), r.sendMsgNum, msgKey)
+
 	msgNum := r.sendMsgNum
-	r.sendChainKey = newChainKey
 	r.sendMsgNum++
 
-	// Clear old chain key from memory (best effort)
-	return msgKey, msgNum, nil
+	return use(msgKey, msgNum)
 }
 
 // GetRecvKey returns the message key for a specific message number
-// Handles out-of-order message delivery
-func (r *Ratchet) GetRecvKey(msgNum uint32) ([]byte, error) {
+// Handles out-of-order message delivery. The caller must Destroy the key after use
+func (r *Ratchet) GetRecvKey(msgNum uint32) (*Secret, error) {
+	var msgKey *Secret
+	err := r.OpenRecvKey(msgNum, func(key []byte) error {
+		var err error
+		msgKey, err = copySecret(key)
+		return err
+	})
+	return msgKey, err
+}
+
+// OpenRecvKey passes the message key for msgNum to open, e.g. to decrypt
+// The key is only used up, and the chain only advanced, if open succeeds, so
+// a forged message cannot burn the key of the genuine one. As with
+// UseSendKey, the key is wiped when open returns
+func (r *Ratchet) OpenRecvKey(msgNum uint32, open func(key []byte) error) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.recvChainKey == nil {
+		return errRatchetClosed
+	}
+
 	// Check if we already have this key cached (out-of-order message)
-	if key, ok := r.skippedKeys[msgNum]; ok {
+	if sk, ok := r.skippedKeys[msgNum]; ok {
+		if err := open(sk.key); err != nil {
+			return err
+		}
 		delete(r.skippedKeys, msgNum)
-		return key, nil
+		sk.release()
+		return nil
 	}
 
 	// Message from the past that we already processed
 	if msgNum < r.recvMsgNum {
-		return nil, fmt.Errorf("message %d already received or too old", msgNum)
+		return fmt.Errorf("message %d %w", msgNum, ErrAlreadyReceived)
 	}
 
 	// Check if we need to skip too many messages
-	if msgNum-r.recvMsgNum > r.maxSkip {
-		return nil, fmt.Errorf("too many skipped messages: %d", msgNum-r.recvMsgNum)
+	skip := msgNum - r.recvMsgNum
+	if skip > r.maxSkip {
+		return fmt.Errorf("%w: %d", ErrTooManySkipped, skip)
 	}
 
-	// Skip ahead and cache intermediate keys
-	for r.recvMsgNum < msgNum {
-		skipKey, newChainKey, err := r.deriveKeys(r.recvChainKey, r.recvMsgNum)
+	// Step a copy of the chain key, keeping the skipped keys aside until
+	// the message opens
+	var slab *keySlab
+	if skip > 0 {
+		mem, err := NewSecret(32 * int(skip))
 		if err != nil {
-			return nil, err
+			return err
 		}
-		r.skippedKeys[r.recvMsgNum] = skipKey
-		r.recvChainKey = newChainKey
-		r.recvMsgNum++
+		slab = &keySlab{mem: mem, live: int(skip)}
 	}
+	msgKey, chainKey := r.scratch.Bytes()[:32], r.scratch.Bytes()[32:]
+	defer Wipe(r.scratch.Bytes())
+	copy(chainKey, r.recvChainKey.Bytes())
+	for i := uint32(0); i < skip; i++ {
+		r.kdf.step(chainKey, r.recvMsgNum+i, slab.mem.Bytes()[32*i:32*i+32])
+	}
+	r.kdf.step(chainKey, msgNum, msgKey)
+	if err := open(msgKey); err != nil {
+		if slab != nil {
+			slab.mem.Destroy()
+		}
+		return err
+	}
+
+	// Commit: cache the skipped keys and move the chain forward
+	for i := uint32(0); i < skip; i++ {
+		r.skippedKeys[r.recvMsgNum+i] = skippedKey{slab: slab, key: slab.mem.Bytes()[32*i : 32*i+32]}
+	}
+	copy(r.recvChainKey.Bytes(), chainKey)
+	r.recvMsgNum = msgNum + 1
+	return nil
+}
+
+// release wipes a used key and destroys its slab with the last one
+func (sk skippedKey) release() {
+	Wipe(sk.key)
+	sk.slab.live--
+	if sk.slab.live == 0 {
+		sk.slab.mem.Destroy()
+	}
+}
 
-	// Now derive the key for the requested message
-	msgKey, newChainKey, err := r.deriveKeys(r.recvChainKey, r.recvMsgNum)
+// copySecret copies key into a new Secret
+func copySecret(key []byte) (*Secret, error) {
+	s, err := NewSecret(len(key))
 	if err != nil {
 		return nil, err
 	}
+	copy(s.Bytes(), key)
+	return s, nil
+}
+
+// DeriveMessageKey derives the key of message msgNum and the next chain key
+// from the current chain key into two 32-byte buffers
+func DeriveMessageKey(chainKey []byte, msgNum uint32, msgKey, newChainKey []byte) error {
+	if len(chainKey) != 32 || len(msgKey) != 32 || len(newChainKey) != 32 {
+		return fmt.Errorf("chain and message keys must be 32 bytes")
+	}
+	d := keyDeriver{h: sha256.New()}
+	copy(newChainKey, chainKey)
+	d.step(newChainKey, msgNum, msgKey)
+	return nil
+}
 
-	r.recvChainKey = newChainKey
-	r.recvMsgNum++
+// Each step is HKDF-SHA256 over chain key | uint32be(msgNum) without salt,
+// expanded once with info "e2e-msg-key" for the message key and once with
+// "e2e-chain-key" for the next chain key. Both outputs are a single SHA-256
+// block, so each expand is one HMAC after a shared extract
+var (
+	zeroSalt     [sha256.Size]byte
+	msgKeyInfo   = []byte("e2e-msg-key\x01")   // Info | block counter
+	chainKeyInfo = []byte("e2e-chain-key\x01") // Info | block counter
+)
 
-	return msgKey, nil
+// keyDeriver computes ratchet steps with one reused SHA-256 and fixed
+// buffers instead of allocating HKDF readers
+type keyDeriver struct {
+	h     hash.Hash
+	input [36]byte
+	pad   [sha256.BlockSize]byte
+	prk   [sha256.Size]byte
+	inner [sha256.Size]byte
 }
 
-// deriveKeys derives a message key and the next chain key from the current chain key
-func (r *Ratchet) deriveKeys(chainKey []byte, msgNum uint32) ([]byte, []byte, error) {
-	// Create input with message number for uniqueness
-	input := make([]byte, 36)
-	copy(input[:32], chainKey)
-	binary.BigEndian.PutUint32(input[32:], msgNum)
+// step writes the message key for msgNum to msgKey and replaces the 32-byte
+// chain key with the next one in place
+func (d *keyDeriver) step(chainKey []byte, msgNum uint32, msgKey []byte) {
+	copy(d.input[:32], chainKey)
+	binary.BigEndian.PutUint32(d.input[32:], msgNum)
+	d.hmac(d.prk[:], zeroSalt[:], d.input[:])
+	d.hmac(msgKey, d.prk[:], msgKeyInfo)
+	d.hmac(chainKey, d.prk[:], chainKeyInfo)
 
-	hkdfReader := hkdf.New(sha256.New, input, nil, []byte("e2e-msg-key"))
+	Wipe(d.input[:])
+	Wipe(d.prk[:])
+	Wipe(d.inner[:])
+	Wipe(d.pad[:])
+	// Overwrite the hash's block buffer, which holds the last HMAC input
+	d.h.Reset()
+	d.h.Write(d.pad[:sha256.BlockSize-1])
+	d.h.Reset()
+}
 
-	msgKey := make([]byte, 32)
-	if _, err := io.ReadFull(hkdfReader, msgKey); err != nil {
-		return nil, nil, fmt.Errorf("failed to derive message key: %w", err)
+// hmac writes HMAC-SHA256(key, msg) to out; key is at most one block
+func (d *keyDeriver) hmac(out, key, msg []byte) {
+	for i := range d.pad {
+		d.pad[i] = 0x36
 	}
-
-	// Derive next chain key
-	hkdfReader = hkdf.New(sha256.New, input, nil, []byte("e2e-chain-key"))
-	newChainKey := make([]byte, 32)
-	if _, err := io.ReadFull(hkdfReader, newChainKey); err != nil {
-		return nil, nil, fmt.Errorf("failed to derive chain key: %w", err)
+	for i, b := range key {
+		d.pad[i] ^= b
 	}
+	d.h.Reset()
+	d.h.Write(d.pad[:])
+	d.h.Write(msg)
+	d.h.Sum(d.inner[:0])
 
-	return msgKey, newChainKey, nil
+	for i := range d.pad {
+		d.pad[i] ^= 0x36 ^ 0x5c
+	}
+	d.h.Reset()
+	d.h.Write(d.pad[:])
+	d.h.Write(d.inner[:])
+	d.h.Sum(out[:0])
 }
 
 // GetSendMsgNum returns the current send message number
@@ -155,3 +333,39 @@ func (r *Ratchet) GetRecvMsgNum() uint32 {
 	defer r.mu.Unlock()
 	return r.recvMsgNum
 }
+
+// Received reports whether message msgNum has already been received
+func (r *Ratchet) Received(msgNum uint32) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, skipped := r.skippedKeys[msgNum]
+	return msgNum < r.recvMsgNum && !skipped
+}
+
+// GetSkippedMsgNums returns the skipped message numbers whose keys are
+// still cached, i.e. messages that have not arrived yet, in ascending order
+func (r *Ratchet) GetSkippedMsgNums() []uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nums := make([]uint32, 0, len(r.skippedKeys))
+	for n := range r.skippedKeys {
+		nums = append(nums, n)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums
+}
+
+// Close destroys the chain keys and all cached message keys
+// The ratchet cannot be used afterwards
+func (r *Ratchet) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sendChainKey.Destroy()
+	r.recvChainKey.Destroy()
+	r.scratch.Destroy()
+	r.sendChainKey, r.recvChainKey = nil, nil
+	for n, sk := range r.skippedKeys {
+		sk.release()
+		delete(r.skippedKeys, n)
+	}
+}
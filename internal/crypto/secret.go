@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Secret holds key material outside the garbage-collected heap
+// Where the platform allows, the memory is locked into RAM (never swapped)
+// and excluded from core dumps. Destroy zeroes and releases it.
+type Secret struct {
+	mem    []byte // Whole allocation (page-aligned on Unix)
+	b      []byte // The secret itself, a prefix of mem
+	locked bool
+}
+
+// NewSecret allocates a zeroed secret of the given size
+func NewSecret(size int) (*Secret, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid secret size %d", size)
+	}
+	mem, locked, err := allocSecret(size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate secure memory: %w", err)
+	}
+	s := &Secret{mem: mem, b: mem[:size:size], locked: locked}
+	runtime.SetFinalizer(s, (*Secret).finalize)
+	return s, nil
+}
+
+// SecretFrom moves b into a new secret and zeroes b
+func SecretFrom(b []byte) (*Secret, error) {
+	s, err := NewSecret(len(b))
+	if err != nil {
+		return nil, err
+	}
+	copy(s.b, b)
+	Wipe(b)
+	return s, nil
+}
+
+// Bytes returns the secret's memory; it must not be used after Destroy
+// The slice does not keep the Secret alive: once the Secret is unreachable
+// its memory is zeroed, so keep it alive (runtime.KeepAlive) while the slice
+// is in use, or copy the bytes
+func (s *Secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.b
+}
+
+// Locked reports whether the memory is locked against swapping
+func (s *Secret) Locked() bool {
+	return s != nil && s.locked
+}
+
+// Destroy zeroes and releases the secret; it is safe to call more than once
+func (s *Secret) Destroy() {
+	if s == nil || s.mem == nil {
+		return
+	}
+	Wipe(s.mem)
+	freeSecret(s.mem, s.locked)
+	s.mem, s.b, s.locked = nil, nil, false
+	runtime.SetFinalizer(s, nil)
+}
+
+// finalize zeroes a secret that was never destroyed. A slice from Bytes may
+// still point into it, so the memory stays mapped instead of being released.
+func (s *Secret) finalize() {
+	if s.mem == nil {
+		return
+	}
+	Wipe(s.mem)
+	retireSecret(s.mem, s.locked)
+}
+
+// Wipe zeroes b
+func Wipe(b []byte) {
+	clear(b)
+	runtime.KeepAlive(b)
+}
@@ -0,0 +1,13 @@
+package crypto
+
+import "golang.org/x/sys/unix"
+
+func excludeFromCoreDump(mem []byte) {
+	unix.Madvise(mem, unix.MADV_DONTDUMP)
+}
+
+// releasePages frees the physical pages of an anonymous mapping; they read
+// as zeroes afterwards
+func releasePages(mem []byte) {
+	unix.Madvise(mem, unix.MADV_DONTNEED)
+}
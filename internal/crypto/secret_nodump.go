@@ -0,0 +1,9 @@
+//go:build unix && !linux
+
+package crypto
+
+// excludeFromCoreDump is a no-op where madvise has no MADV_DONTDUMP
+func excludeFromCoreDump(mem []byte) {}
+
+// releasePages is a no-op; the wiped pages stay resident
+func releasePages(mem []byte) {}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package crypto
+
+// allocSecret falls back to ordinary memory, which is still zeroed on Destroy
+func allocSecret(size int) ([]byte, bool, error) {
+	return make([]byte, size), false, nil
+}
+
+func freeSecret(mem []byte, locked bool) {}
+
+func retireSecret(mem []byte, locked bool) {}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package crypto
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocSecret maps whole pages outside the Go heap and tries to lock them
+func allocSecret(size int) ([]byte, bool, error) {
+	page := os.Getpagesize()
+	mem, err := unix.Mmap(-1, 0, (size+page-1)/page*page,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		return nil, false, err
+	}
+	excludeFromCoreDump(mem)
+	// Locking fails without privileges or above RLIMIT_MEMLOCK; the memory
+	// is still usable, it may just be swapped out
+	locked := unix.Mlock(mem) == nil
+	return mem, locked, nil
+}
+
+func freeSecret(mem []byte, locked bool) {
+	if locked {
+		unix.Munlock(mem)
+	}
+	unix.Munmap(mem)
+}
+
+// retireSecret unlocks a wiped allocation and hands its pages back to the
+// system where possible, but keeps it mapped so stale slices never fault
+func retireSecret(mem []byte, locked bool) {
+	if locked {
+		unix.Munlock(mem)
+	}
+	releasePages(mem)
+}
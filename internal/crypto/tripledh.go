@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"fmt"
+	"io"
+)
+
+// GenerateX25519Key generates an X25519 key pair from the bytes of r; the
+// private key is held in a Secret
+func GenerateX25519Key(r io.Reader) (*Secret, []byte, error) {
+	privateKey, err := NewSecret(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(r, privateKey.Bytes()); err != nil {
+		privateKey.Destroy()
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	publicKey, err := X25519PublicKey(privateKey)
+	if err != nil {
+		privateKey.Destroy()
+		return nil, nil, err
+	}
+	return privateKey, publicKey, nil
+}
+
+// TripleDH computes the triple Diffie-Hellman secret of X25519 identity and
+// ephemeral keys, as in Signal's X3DH without signed prekeys:
+//
+//	DH(IK_init, EK_resp) | DH(EK_init, IK_resp) | DH(EK_init, EK_resp)
+//
+// Both sides get the same secret; initiator tells which side we are. No
+// signature is involved, so the secret proves nothing to a third party:
+// the responder can compute it for an ephemeral key of its own choosing
+func TripleDH(ourIdentity, ourEphemeral *Secret, peerIdentity, peerEphemeral []byte, initiator bool) (*Secret, error) {
+	type dh struct {
+		priv *Secret
+		pub  []byte
+	}
+	parts := []dh{
+		{ourIdentity, peerEphemeral},
+		{ourEphemeral, peerIdentity},
+		{ourEphemeral, peerEphemeral},
+	}
+	if !initiator {
+		parts[0], parts[1] = parts[1], parts[0]
+	}
+
+	out, err := NewSecret(32 * len(parts))
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range parts {
+		shared, err := X25519SharedSecret(p.priv, p.pub)
+		if err != nil {
+			out.Destroy()
+			return nil, err
+		}
+		copy(out.Bytes()[32*i:], shared.Bytes())
+		shared.Destroy()
+	}
+	return out, nil
+}
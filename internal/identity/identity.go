@@ -0,0 +1,156 @@
+// Package identity manages a long-term Ed25519 identity key, the store of
+// known peers' identity keys, and signed messages.
+//
+// Unlike session keys, the identity key is kept on disk so that signatures
+// made today can be verified against the same key later.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"e2e-message/internal/crypto"
+)
+
+const pemType = "PRIVATE KEY"
+
+// Identity is an Ed25519 key pair whose private seed is held in a crypto.Secret
+type Identity struct {
+	seed   *crypto.Secret // Private key seed
+	public ed25519.PublicKey
+}
+
+// Generate creates a new random identity
+func Generate() (*Identity, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %w", err)
+	}
+	return fromPrivateKey(private, public)
+}
+
+// fromPrivateKey moves the seed of private into a secret and wipes private
+func fromPrivateKey(private ed25519.PrivateKey, public ed25519.PublicKey) (*Identity, error) {
+	defer crypto.Wipe(private)
+	seed, err := crypto.SecretFrom(private.Seed())
+	if err != nil {
+		return nil, fmt.Errorf("failed to store identity key: %w", err)
+	}
+	return &Identity{seed: seed, public: public}, nil
+}
+
+// privateKey expands the seed into a private key on the heap, which the
+// caller must wipe; crypto/ed25519 does not accept keys outside the heap
+func (id *Identity) privateKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(id.seed.Bytes())
+}
+
+// Load reads an identity from a PEM-encoded PKCS #8 file or an OpenSSH
+// private key such as ~/.ssh/id_ed25519; it returns ErrPassphraseRequired
+// for SSH keys protected by a passphrase
+func Load(path string) (*Identity, error) {
+	return LoadWithPassphrase(path, nil)
+}
+
+// LoadWithPassphrase is like Load, decrypting SSH keys with passphrase
+func LoadWithPassphrase(path string, passphrase []byte) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+	defer crypto.Wipe(data)
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not an identity file", path)
+	}
+	defer crypto.Wipe(block.Bytes)
+
+	var key any
+	switch block.Type {
+	case pemType:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case sshPEMType:
+		key, err = parseSSHPrivateKey(data, passphrase)
+	default:
+		return nil, fmt.Errorf("%s is not an identity file", path)
+	}
+	if err != nil {
+		if errors.Is(err, ErrPassphraseRequired) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("invalid identity file: %w", err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity in %s is not an Ed25519 key", path)
+	}
+	return fromPrivateKey(private, private.Public().(ed25519.PublicKey))
+}
+
+// LoadOrCreate loads the identity at path, generating and saving a new one
+// if the file does not exist; created reports which happened
+func LoadOrCreate(path string) (id *Identity, created bool, err error) {
+	id, err = Load(path)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return id, false, err
+	}
+	if id, err = Generate(); err != nil {
+		return nil, false, err
+	}
+	if err := id.Save(path); err != nil {
+		id.Close()
+		return nil, false, err
+	}
+	return id, true, nil
+}
+
+// Save writes the identity to a new file readable only by the owner
+func (id *Identity) Save(path string) error {
+	private := id.privateKey()
+	defer crypto.Wipe(private)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return fmt.Errorf("failed to encode identity: %w", err)
+	}
+	defer crypto.Wipe(der)
+	data := pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})
+	defer crypto.Wipe(data)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to save identity: %w", err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to save identity: %w", err)
+	}
+	return nil
+}
+
+// PublicKey returns the public identity key
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.public
+}
+
+// sign signs data with the private key
+func (id *Identity) sign(data []byte) []byte {
+	private := id.privateKey()
+	defer crypto.Wipe(private)
+	return ed25519.Sign(private, data)
+}
+
+// Close wipes the private key
+func (id *Identity) Close() {
+	id.seed.Destroy()
+}
@@ -0,0 +1,140 @@
+package identity
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"e2e-message/internal/session"
+)
+
+// Peer is a named identity key
+type Peer struct {
+	Name string
+	Key  ed25519.PublicKey
+}
+
+// KnownPeers is the store of identity keys the user has vouched for
+// The file holds one "name base64-key" line per peer; '#' starts a comment
+type KnownPeers struct {
+	path  string
+	peers []Peer
+}
+
+// LoadPeers reads the known-peers file; a missing file is an empty store
+func LoadPeers(path string) (*KnownPeers, error) {
+	k := &KnownPeers{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known peers: %w", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"name key\"", path, n)
+		}
+		key, err := ParsePublicKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		k.peers = append(k.peers, Peer{Name: fields[0], Key: key})
+	}
+	return k, nil
+}
+
+// ParsePublicKey decodes an identity public key in any supported encoding,
+// or an "ssh-ed25519 AAAA..." line
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	if isSSHKey(encoded) {
+		return parseSSHPublicKey(encoded)
+	}
+	key, err := session.DecodeKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid identity key: expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Path returns the known-peers file path
+func (k *KnownPeers) Path() string {
+	return k.path
+}
+
+// List returns the known peers in the order they were added
+func (k *KnownPeers) List() []Peer {
+	return append([]Peer(nil), k.peers...)
+}
+
+// Lookup returns the peer with the given key
+func (k *KnownPeers) Lookup(key ed25519.PublicKey) (Peer, bool) {
+	for _, p := range k.peers {
+		if p.Key.Equal(key) {
+			return p, true
+		}
+	}
+	return Peer{}, false
+}
+
+// Add stores a peer and saves the file; names and keys must be unique
+func (k *KnownPeers) Add(name string, key ed25519.PublicKey) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n#") {
+		return fmt.Errorf("invalid peer name %q", name)
+	}
+	for _, p := range k.peers {
+		if p.Name == name {
+			return fmt.Errorf("peer %s already exists", name)
+		}
+		if p.Key.Equal(key) {
+			return fmt.Errorf("key already belongs to %s", p.Name)
+		}
+	}
+	k.peers = append(k.peers, Peer{Name: name, Key: key})
+	return k.save()
+}
+
+// Remove deletes a peer by name and saves the file
+func (k *KnownPeers) Remove(name string) error {
+	for i, p := range k.peers {
+		if p.Name == name {
+			k.peers = append(k.peers[:i], k.peers[i+1:]...)
+			return k.save()
+		}
+	}
+	return fmt.Errorf("unknown peer %s", name)
+}
+
+// save atomically replaces the file
+func (k *KnownPeers) save() error {
+	var buf bytes.Buffer
+	buf.WriteString("# Known peers: name and Ed25519 identity key\n")
+	for _, p := range k.peers {
+		fmt.Fprintf(&buf, "%s %s\n", p.Name, session.EncodeKey(p.Key))
+	}
+
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to save known peers: %w", err)
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save known peers: %w", err)
+	}
+	return nil
+}
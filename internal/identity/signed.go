@@ -0,0 +1,119 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Armor lines of a signed message:
+//
+//	-----BEGIN E2E-MESSAGE SIGNED MESSAGE-----
+//	the message text, lines whose first non-blank character is '-' escaped
+//	as "- -..." so no text line reads as an armor line, even when trimmed
+//	-----BEGIN E2E-MESSAGE SIGNATURE-----
+//	Base64(public key (32 bytes) | signature (64 bytes))
+//	-----END E2E-MESSAGE SIGNATURE-----
+const (
+	BeginMessage   = "-----BEGIN E2E-MESSAGE SIGNED MESSAGE-----"
+	beginSignature = "-----BEGIN E2E-MESSAGE SIGNATURE-----"
+	EndSignature   = "-----END E2E-MESSAGE SIGNATURE-----"
+)
+
+// signContext separates these signatures from any other use of the key
+const signContext = "e2e-message signed message v1\x00"
+
+// Signed is a parsed signed message
+type Signed struct {
+	Text      string
+	Key       ed25519.PublicKey
+	Signature []byte
+}
+
+// Sign signs text and returns it in the armored format
+func (id *Identity) Sign(text string) string {
+	text = normalize(text)
+	sig := id.sign([]byte(signContext + text))
+
+	var b strings.Builder
+	b.WriteString(BeginMessage + "\n")
+	for _, l := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimLeft(l, " \t"), "-") {
+			b.WriteString("- ")
+		}
+		b.WriteString(l + "\n")
+	}
+	b.WriteString(beginSignature + "\n")
+	b.WriteString(base64.StdEncoding.EncodeToString(append(id.PublicKey(), sig...)) + "\n")
+	b.WriteString(EndSignature + "\n")
+	return b.String()
+}
+
+// ParseSigned parses an armored signed message; it does not verify it
+// Text before the BEGIN line and after the END line is ignored
+func ParseSigned(armored string) (*Signed, error) {
+	lines := strings.Split(strings.ReplaceAll(armored, "\r\n", "\n"), "\n")
+	start := -1
+	for i, l := range lines {
+		if strings.TrimSpace(l) == BeginMessage {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("no signed message found")
+	}
+
+	var text []string
+	i := start
+	for ; i < len(lines) && strings.TrimSpace(lines[i]) != beginSignature; i++ {
+		l := strings.TrimRight(lines[i], " \t")
+		if strings.HasPrefix(l, "-") {
+			unescaped, ok := strings.CutPrefix(l, "- ")
+			if !ok {
+				return nil, fmt.Errorf("malformed signed message: unescaped line %q", l)
+			}
+			l = unescaped
+		}
+		text = append(text, l)
+	}
+
+	var encoded strings.Builder
+	for i++; i < len(lines) && strings.TrimSpace(lines[i]) != EndSignature; i++ {
+		encoded.WriteString(strings.TrimSpace(lines[i]))
+	}
+	if i >= len(lines) {
+		return nil, fmt.Errorf("malformed signed message: missing %s", EndSignature)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, fmt.Errorf("malformed signature: expected %d bytes, got %d",
+			ed25519.PublicKeySize+ed25519.SignatureSize, len(raw))
+	}
+
+	return &Signed{
+		Text:      strings.Join(text, "\n"),
+		Key:       ed25519.PublicKey(raw[:ed25519.PublicKeySize]),
+		Signature: raw[ed25519.PublicKeySize:],
+	}, nil
+}
+
+// Valid reports whether the signature was made by Key over Text
+// A valid signature only proves who signed if Key is known to belong to them
+func (s *Signed) Valid() bool {
+	return ed25519.Verify(s.Key, []byte(signContext+s.Text), s.Signature)
+}
+
+// normalize makes text survive the armor unchanged: CRLF becomes LF and
+// trailing whitespace is removed from every line
+func normalize(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,90 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH Ed25519 keys can be used as identities: ~/.ssh/id_ed25519 as our
+// own, and "ssh-ed25519 AAAA..." lines, such as those in authorized_keys
+// files or https://github.com/<user>.keys, as the keys of peers
+
+const sshPEMType = "OPENSSH PRIVATE KEY"
+
+// ErrPassphraseRequired is returned by Load for passphrase-protected SSH keys
+var ErrPassphraseRequired = errors.New("identity is protected by a passphrase")
+
+func parseSSHPrivateKey(data, passphrase []byte) (any, error) {
+	var key any
+	var err error
+	if passphrase == nil {
+		key, err = ssh.ParseRawPrivateKey(data)
+	} else {
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	}
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, ErrPassphraseRequired
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(*ed25519.PrivateKey); ok {
+		return *k, nil
+	}
+	return key, nil
+}
+
+// isSSHKey reports whether s looks like an SSH public key line
+func isSSHKey(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "ssh-")
+}
+
+// parseSSHPublicKey parses one "ssh-ed25519 AAAA... [comment]" line
+func parseSSHPublicKey(line string) (ed25519.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH public key: %w", err)
+	}
+	if key.Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("SSH key type %s is not supported, only %s", key.Type(), ssh.KeyAlgoED25519)
+	}
+	return key.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey), nil
+}
+
+// ParseAuthorizedKeys returns the Ed25519 keys of an authorized_keys style
+// file, such as a saved https://github.com/<user>.keys; other key types
+// are skipped
+func ParseAuthorizedKeys(data []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid SSH public key: %w", n+1, err)
+		}
+		if key.Type() == ssh.KeyAlgoED25519 {
+			keys = append(keys, key.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no %s keys found", ssh.KeyAlgoED25519)
+	}
+	return keys, nil
+}
+
+// SSHPublicKey formats an identity key as an "ssh-ed25519 AAAA..." line
+func SSHPublicKey(key ed25519.PublicKey) string {
+	pub, err := ssh.NewPublicKey(key)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
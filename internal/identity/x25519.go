@@ -0,0 +1,68 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+
+	"e2e-message/internal/crypto"
+)
+
+// The identity key also serves as an X25519 key for file encryption, using
+// the same mapping as libsodium and age's SSH support: the X25519 private
+// key is the Ed25519 signing scalar, and the public key is the Montgomery
+// form of the Edwards point
+
+// curveP is the field prime 2^255 - 19
+var curveP = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// X25519 returns the X25519 private key of the identity; the caller must
+// wipe it
+func (id *Identity) X25519() []byte {
+	h := sha512.Sum512(id.seed.Bytes())
+	defer crypto.Wipe(h[:])
+	scalar := make([]byte, 32)
+	copy(scalar, h[:32])
+	scalar[0] &= 248
+	scalar[31] &= 127
+	scalar[31] |= 64
+	return scalar
+}
+
+// X25519PublicKey converts an Ed25519 public key to the X25519 public key
+// matching X25519: u = (1 + y) / (1 - y) mod p
+func X25519PublicKey(key ed25519.PublicKey) ([]byte, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid identity key length %d", len(key))
+	}
+	le := make([]byte, 32)
+	copy(le, key)
+	le[31] &= 127 // Drop the sign of x
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(curveP) >= 0 {
+		return nil, fmt.Errorf("invalid identity key")
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curveP)
+	if den.Sign() == 0 {
+		return nil, fmt.Errorf("invalid identity key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, curveP))
+	u.Mod(u, curveP)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	return reverse(out), nil
+}
+
+// reverse reverses b in place and returns it
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
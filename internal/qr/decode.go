@@ -0,0 +1,503 @@
+package qr
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Decode locates a QR code in an image and returns its payload.
+// The symbol may be scaled and rotated, but not perspective-distorted,
+// so straight-on photos and screenshots work best.
+func Decode(img image.Image) ([]byte, error) {
+	lum := luminance(img)
+
+	var lastErr error
+	for _, adaptive := range []bool{false, true} {
+		g := binarize(lum, adaptive)
+		data, err := g.decode()
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// grid is a binarized image, true = dark
+type grid struct {
+	w, h int
+	dark []bool
+}
+
+func (g *grid) at(x, y int) bool {
+	if x < 0 || y < 0 || x >= g.w || y >= g.h {
+		return false
+	}
+	return g.dark[y*g.w+x]
+}
+
+type lumImage struct {
+	w, h int
+	pix  []uint8
+}
+
+func luminance(img image.Image) *lumImage {
+	b := img.Bounds()
+	l := &lumImage{w: b.Dx(), h: b.Dy(), pix: make([]uint8, b.Dx()*b.Dy())}
+	for y := 0; y < l.h; y++ {
+		for x := 0; x < l.w; x++ {
+			r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			// Colors are alpha-premultiplied: composite onto white
+			v := (299*r+587*g+114*bl)/1000 + (0xFFFF - a)
+			l.pix[y*l.w+x] = uint8(v >> 8)
+		}
+	}
+	return l
+}
+
+// binarize thresholds the image globally, or against the local mean
+// when adaptive is set (for unevenly lit photos)
+func binarize(l *lumImage, adaptive bool) *grid {
+	g := &grid{w: l.w, h: l.h, dark: make([]bool, len(l.pix))}
+
+	if !adaptive {
+		lo, hi := uint8(255), uint8(0)
+		for _, v := range l.pix {
+			lo = min(lo, v)
+			hi = max(hi, v)
+		}
+		threshold := (int(lo) + int(hi)) / 2
+		for i, v := range l.pix {
+			g.dark[i] = int(v) < threshold
+		}
+		return g
+	}
+
+	// Summed-area table for fast window means
+	sum := make([]int, (l.w+1)*(l.h+1))
+	for y := 0; y < l.h; y++ {
+		row := 0
+		for x := 0; x < l.w; x++ {
+			row += int(l.pix[y*l.w+x])
+			sum[(y+1)*(l.w+1)+x+1] = sum[y*(l.w+1)+x+1] + row
+		}
+	}
+	radius := max(min(l.w, l.h)/16, 4)
+	for y := 0; y < l.h; y++ {
+		for x := 0; x < l.w; x++ {
+			x0, y0 := max(x-radius, 0), max(y-radius, 0)
+			x1, y1 := min(x+radius+1, l.w), min(y+radius+1, l.h)
+			total := sum[y1*(l.w+1)+x1] - sum[y0*(l.w+1)+x1] - sum[y1*(l.w+1)+x0] + sum[y0*(l.w+1)+x0]
+			mean := total / ((x1 - x0) * (y1 - y0))
+			g.dark[y*l.w+x] = int(l.pix[y*l.w+x])*100 < mean*90
+		}
+	}
+	return g
+}
+
+type point struct{ x, y float64 }
+
+func dist(a, b point) float64 { return math.Hypot(a.x-b.x, a.y-b.y) }
+
+// finder is a candidate finder pattern center
+type finder struct {
+	point
+	module float64 // Estimated module size in pixels
+	hits   int
+}
+
+// ratioOK checks five run lengths against the 1:1:3:1:1 finder ratio
+func ratioOK(runs [5]int) bool {
+	total := 0
+	for _, r := range runs {
+		if r == 0 {
+			return false
+		}
+		total += r
+	}
+	if total < 7 {
+		return false
+	}
+	unit := float64(total) / 7
+	tol := unit / 2
+	return math.Abs(unit-float64(runs[0])) < tol &&
+		math.Abs(unit-float64(runs[1])) < tol &&
+		math.Abs(3*unit-float64(runs[2])) < 3*tol &&
+		math.Abs(unit-float64(runs[3])) < tol &&
+		math.Abs(unit-float64(runs[4])) < tol
+}
+
+// crossCheck measures the finder runs along a line through (x, y) with
+// direction (dx, dy) and returns the refined center offset and total length
+func (g *grid) crossCheck(x, y, dx, dy int) (center float64, total int, ok bool) {
+	if !g.at(x, y) {
+		return 0, 0, false
+	}
+	var runs [5]int
+
+	// Walk backwards through the center, inner light ring and outer dark ring
+	i := 0
+	for ; g.at(x-i*dx, y-i*dy); i++ {
+		runs[2]++
+	}
+	for ; !g.at(x-i*dx, y-i*dy) && inBounds(g, x-i*dx, y-i*dy); i++ {
+		runs[1]++
+	}
+	for ; g.at(x-i*dx, y-i*dy); i++ {
+		runs[0]++
+	}
+	back := i
+
+	// Walk forwards
+	i = 1
+	for ; g.at(x+i*dx, y+i*dy); i++ {
+		runs[2]++
+	}
+	for ; !g.at(x+i*dx, y+i*dy) && inBounds(g, x+i*dx, y+i*dy); i++ {
+		runs[3]++
+	}
+	for ; g.at(x+i*dx, y+i*dy); i++ {
+		runs[4]++
+	}
+
+	if !ratioOK(runs) {
+		return 0, 0, false
+	}
+	total = runs[0] + runs[1] + runs[2] + runs[3] + runs[4]
+	start := -back + 1
+	center = float64(start) + float64(runs[0]+runs[1]) + float64(runs[2])/2 - 0.5
+	return center, total, true
+}
+
+func inBounds(g *grid, x, y int) bool {
+	return x >= 0 && y >= 0 && x < g.w && y < g.h
+}
+
+// findFinders scans rows for 1:1:3:1:1 runs and confirms them vertically
+func (g *grid) findFinders() []*finder {
+	var found []*finder
+
+	add := func(p point, module float64) {
+		for _, f := range found {
+			if dist(f.point, p) < f.module*2 && math.Abs(f.module-module) < f.module {
+				n := float64(f.hits)
+				f.x = (f.x*n + p.x) / (n + 1)
+				f.y = (f.y*n + p.y) / (n + 1)
+				f.module = (f.module*n + module) / (n + 1)
+				f.hits++
+				return
+			}
+		}
+		found = append(found, &finder{point: p, module: module, hits: 1})
+	}
+
+	for y := 0; y < g.h; y++ {
+		var runs [5]int
+		state := 0
+		for x := 0; x <= g.w; x++ {
+			dark := x < g.w && g.at(x, y)
+			// States 0, 2, 4 expect dark runs and 1, 3 light runs
+			if dark == (state%2 == 0) {
+				runs[state]++
+				continue
+			}
+			if state < 4 {
+				if state == 0 && runs[0] == 0 {
+					continue // Leading light pixels
+				}
+				state++
+				runs[state] = 1
+				continue
+			}
+
+			// Five runs collected: check ratio, then slide the window by two
+			if ratioOK(runs) {
+				cx := x - runs[4] - runs[3] - runs[2]/2 - 1
+				if oy, vtotal, ok := g.crossCheck(cx, y, 0, 1); ok {
+					cy := y + int(math.Round(oy))
+					if ox, htotal, ok := g.crossCheck(cx, cy, 1, 0); ok {
+						module := float64(vtotal+htotal) / 14
+						add(point{float64(cx) + ox + 0.5, float64(y) + oy + 0.5}, module)
+					}
+				}
+			}
+			runs = [5]int{runs[2], runs[3], runs[4], 1, 0}
+			state = 3
+		}
+	}
+	return found
+}
+
+// selectFinders picks the three candidates that best form a right isosceles
+// triangle and orders them top-left, top-right, bottom-left
+func selectFinders(found []*finder) (tl, tr, bl *finder, err error) {
+	if len(found) < 3 {
+		return nil, nil, nil, fmt.Errorf("no QR code found")
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].hits > found[j].hits })
+	if len(found) > 8 {
+		found = found[:8]
+	}
+
+	best := math.Inf(1)
+	for i := 0; i < len(found); i++ {
+		for j := i + 1; j < len(found); j++ {
+			for k := j + 1; k < len(found); k++ {
+				a, b, c := found[i], found[j], found[k]
+				// Make a the corner opposite the longest side
+				ab, ac, bc := dist(a.point, b.point), dist(a.point, c.point), dist(b.point, c.point)
+				if ab > bc && ab > ac {
+					a, c = c, a
+					ab, bc = bc, ab
+				} else if ac > bc && ac > ab {
+					a, b = b, a
+					ac, bc = bc, ac
+				}
+				mod := (a.module + b.module + c.module) / 3
+				score := math.Abs(ab-ac)/mod +
+					math.Abs(bc-math.Sqrt2*(ab+ac)/2)/mod +
+					(math.Abs(a.module-b.module)+math.Abs(a.module-c.module))/mod*4
+				if score < best {
+					best = score
+					tl, tr, bl = a, b, c
+				}
+			}
+		}
+	}
+
+	// In image coordinates (y down) top-right is clockwise from bottom-left
+	cross := (tr.x-tl.x)*(bl.y-tl.y) - (tr.y-tl.y)*(bl.x-tl.x)
+	if cross < 0 {
+		tr, bl = bl, tr
+	}
+	return tl, tr, bl, nil
+}
+
+func (g *grid) decode() ([]byte, error) {
+	tl, tr, bl, err := selectFinders(g.findFinders())
+	if err != nil {
+		return nil, err
+	}
+
+	module := (tl.module + tr.module + bl.module) / 3
+	dim := int(math.Round((dist(tl.point, tr.point)+dist(tl.point, bl.point))/2/module)) + 7
+	switch dim & 3 {
+	case 0:
+		dim++
+	case 2:
+		dim--
+	case 3:
+		dim -= 2
+	}
+
+	// The size estimate can be off by one version on small or skewed images
+	estimate := (dim - 17) / 4
+	var lastErr error
+	for _, version := range []int{estimate, estimate + 1, estimate - 1} {
+		if version < 1 || version > maxVersion {
+			continue
+		}
+		data, err := g.sample(version, tl.point, tr.point, bl.point).decode()
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("unsupported QR code size")
+	}
+	return nil, lastErr
+}
+
+// sample reads the module grid using the affine map defined by the finders
+func (g *grid) sample(version int, tl, tr, bl point) *matrix {
+	m := newMatrix(version)
+	m.drawFunctionPatterns()
+
+	span := float64(m.size - 7)
+	for my := 0; my < m.size; my++ {
+		for mx := 0; mx < m.size; mx++ {
+			u := (float64(mx) + 0.5 - 3.5) / span
+			v := (float64(my) + 0.5 - 3.5) / span
+			px := tl.x + u*(tr.x-tl.x) + v*(bl.x-tl.x)
+			py := tl.y + u*(tr.y-tl.y) + v*(bl.y-tl.y)
+			m.modules[my][mx] = g.at(int(math.Floor(px)), int(math.Floor(py)))
+		}
+	}
+	return m
+}
+
+// decode reads format information, unmasks, corrects errors and parses the
+// data segments of a sampled matrix
+func (m *matrix) decode() ([]byte, error) {
+	level, mask, err := m.readFormat()
+	if err != nil {
+		return nil, err
+	}
+	m.applyMask(mask)
+	raw := m.readCodewords()
+
+	// De-interleave and correct each block
+	ecLen := ecPerBlock[level][m.version]
+	lens := blockLayout(m.version, level)
+	blocks := make([][]byte, len(lens))
+	for i, n := range lens {
+		blocks[i] = make([]byte, 0, n+ecLen)
+	}
+	idx := 0
+	for i := 0; i <= lens[len(lens)-1]; i++ {
+		for b, n := range lens {
+			if i < n {
+				blocks[b] = append(blocks[b], raw[idx])
+				idx++
+			}
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], raw[idx])
+			idx++
+		}
+	}
+
+	var data []byte
+	for b, block := range blocks {
+		if err := rsCorrect(block, ecLen); err != nil {
+			return nil, fmt.Errorf("QR code is damaged: %w", err)
+		}
+		data = append(data, block[:lens[b]]...)
+	}
+	return parseSegments(data, m.version)
+}
+
+// readFormat finds the level and mask from either copy of the format bits
+func (m *matrix) readFormat() (Level, int, error) {
+	get := func(x, y int) int {
+		if m.modules[y][x] {
+			return 1
+		}
+		return 0
+	}
+
+	var first, second int
+	for i := 0; i <= 5; i++ {
+		first |= get(8, i) << i
+	}
+	first |= get(8, 7) << 6
+	first |= get(8, 8) << 7
+	first |= get(7, 8) << 8
+	for i := 9; i < 15; i++ {
+		first |= get(14-i, 8) << i
+	}
+	for i := 0; i < 8; i++ {
+		second |= get(m.size-1-i, 8) << i
+	}
+	for i := 8; i < 15; i++ {
+		second |= get(8, m.size-15+i) << i
+	}
+
+	bestDist := 16
+	var bestLevel Level
+	bestMask := 0
+	for level := LevelL; level <= LevelH; level++ {
+		for mask := 0; mask < 8; mask++ {
+			want := formatInfo(level, mask)
+			for _, got := range []int{first, second} {
+				if d := bits.OnesCount(uint(want ^ got)); d < bestDist {
+					bestDist, bestLevel, bestMask = d, level, mask
+				}
+			}
+		}
+	}
+	if bestDist > 3 {
+		return 0, 0, fmt.Errorf("unreadable QR format information")
+	}
+	return bestLevel, bestMask, nil
+}
+
+// parseSegments decodes numeric, alphanumeric and byte mode segments
+func parseSegments(data []byte, version int) ([]byte, error) {
+	pos := 0
+	read := func(n int) (int, bool) {
+		if pos+n > len(data)*8 {
+			return 0, false
+		}
+		v := 0
+		for i := 0; i < n; i++ {
+			v = v<<1 | int(data[(pos+i)>>3]>>(7-(pos+i)&7)&1)
+		}
+		pos += n
+		return v, true
+	}
+
+	// Count field widths for versions 1-9 and 10-26
+	sizeClass := 0
+	if version >= 10 {
+		sizeClass = 1
+	}
+
+	var out []byte
+	for {
+		mode, ok := read(4)
+		if !ok || mode == 0 {
+			return out, nil
+		}
+		switch mode {
+		case 1: // Numeric
+			count, ok := read([2]int{10, 12}[sizeClass])
+			if !ok {
+				return nil, fmt.Errorf("truncated QR data")
+			}
+			for count > 0 {
+				digits := min(count, 3)
+				v, ok := read([4]int{0, 4, 7, 10}[digits])
+				if !ok {
+					return nil, fmt.Errorf("truncated QR data")
+				}
+				out = append(out, []byte(fmt.Sprintf("%0*d", digits, v))...)
+				count -= digits
+			}
+		case 2: // Alphanumeric
+			const alnum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+			count, ok := read([2]int{9, 11}[sizeClass])
+			if !ok {
+				return nil, fmt.Errorf("truncated QR data")
+			}
+			for ; count >= 2; count -= 2 {
+				v, ok := read(11)
+				if !ok || v/45 >= len(alnum) {
+					return nil, fmt.Errorf("invalid QR data")
+				}
+				out = append(out, alnum[v/45], alnum[v%45])
+			}
+			if count == 1 {
+				v, ok := read(6)
+				if !ok || v >= len(alnum) {
+					return nil, fmt.Errorf("invalid QR data")
+				}
+				out = append(out, alnum[v])
+			}
+		case 4: // Byte
+			count, ok := read([2]int{8, 16}[sizeClass])
+			if !ok {
+				return nil, fmt.Errorf("truncated QR data")
+			}
+			for i := 0; i < count; i++ {
+				v, ok := read(8)
+				if !ok {
+					return nil, fmt.Errorf("truncated QR data")
+				}
+				out = append(out, byte(v))
+			}
+		case 7: // ECI designator: skip it, payloads here are ASCII
+			if _, ok := read(8); !ok {
+				return nil, fmt.Errorf("truncated QR data")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported QR data mode %d", mode)
+		}
+	}
+}
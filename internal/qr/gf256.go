@@ -0,0 +1,196 @@
+package qr
+
+import "fmt"
+
+// GF(256) arithmetic with the QR code polynomial x^8 + x^4 + x^3 + x^2 + 1
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	// Duplicate the table so products never need a modulo
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// rsGenerator returns the generator polynomial of the given degree,
+// highest-order coefficient first (the leading 1 is omitted)
+func rsGenerator(degree int) []byte {
+	gen := make([]byte, degree)
+	gen[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < degree {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return gen
+}
+
+// rsEncode computes the error correction codewords for a data block
+func rsEncode(data []byte, ecLen int) []byte {
+	gen := rsGenerator(ecLen)
+	ec := make([]byte, ecLen)
+	for _, b := range data {
+		factor := b ^ ec[0]
+		copy(ec, ec[1:])
+		ec[ecLen-1] = 0
+		for i := range ec {
+			ec[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	return ec
+}
+
+// rsCorrect fixes up to ecLen/2 byte errors in a block of data followed by
+// its error correction codewords, in place
+func rsCorrect(block []byte, ecLen int) error {
+	n := len(block)
+
+	// Syndromes: evaluate the received polynomial at alpha^0 .. alpha^(ecLen-1)
+	synd := make([]byte, ecLen)
+	clean := true
+	for i := 0; i < ecLen; i++ {
+		var s byte
+		for _, b := range block {
+			s = gfMul(s, gfExp[i]) ^ b
+		}
+		synd[i] = s
+		if s != 0 {
+			clean = false
+		}
+	}
+	if clean {
+		return nil
+	}
+
+	// Berlekamp-Massey: find the error locator polynomial (lowest order first)
+	locator := []byte{1}
+	prev := []byte{1}
+	for i := 0; i < ecLen; i++ {
+		delta := synd[i]
+		for j := 1; j < len(locator); j++ {
+			delta ^= gfMul(locator[j], synd[i-j])
+		}
+		prev = append([]byte{0}, prev...)
+		if delta == 0 {
+			continue
+		}
+		if len(prev) > len(locator) {
+			next := make([]byte, len(prev))
+			for j := range prev {
+				next[j] = gfMul(prev[j], delta)
+			}
+			inv := gfInv(delta)
+			for j := range locator {
+				prev[j] = gfMul(locator[j], inv)
+			}
+			prev = prev[:len(locator)]
+			for j := range locator {
+				next[j] ^= locator[j]
+			}
+			locator = next
+		} else {
+			for j := range prev {
+				locator[j] ^= gfMul(prev[j], delta)
+			}
+		}
+	}
+	numErrors := len(locator) - 1
+	for numErrors > 0 && locator[numErrors] == 0 {
+		numErrors--
+	}
+	locator = locator[:numErrors+1]
+	if numErrors*2 > ecLen {
+		return fmt.Errorf("too many errors to correct")
+	}
+
+	// Chien search: positions where the locator has a root
+	var positions []int
+	for i := 0; i < n; i++ {
+		// Position i (from the start) corresponds to power n-1-i
+		xInv := gfExp[(255-(n-1-i))%255]
+		var v byte
+		for j := len(locator) - 1; j >= 0; j-- {
+			v = gfMul(v, xInv) ^ locator[j]
+		}
+		if v == 0 {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) != numErrors {
+		return fmt.Errorf("could not locate errors")
+	}
+
+	// Forney: error evaluator omega = synd * locator mod x^ecLen
+	omega := make([]byte, ecLen)
+	for i := 0; i < ecLen; i++ {
+		for j := 0; j <= i && j < len(locator); j++ {
+			omega[i] ^= gfMul(synd[i-j], locator[j])
+		}
+	}
+	for _, pos := range positions {
+		power := n - 1 - pos
+		x := gfExp[power]
+		xInv := gfInv(x)
+
+		var num byte
+		for j := len(omega) - 1; j >= 0; j-- {
+			num = gfMul(num, xInv) ^ omega[j]
+		}
+		// Formal derivative of the locator keeps only odd-order terms
+		var den byte
+		for j := 1; j < len(locator); j += 2 {
+			den ^= gfMul(locator[j], gfExp[(int(gfLog[xInv])*(j-1))%255])
+		}
+		if den == 0 {
+			return fmt.Errorf("could not correct errors")
+		}
+		block[pos] ^= gfMul(x, gfDiv(num, den))
+	}
+
+	// Verify the correction
+	for i := 0; i < ecLen; i++ {
+		var s byte
+		for _, b := range block {
+			s = gfMul(s, gfExp[i]) ^ b
+		}
+		if s != 0 {
+			return fmt.Errorf("could not correct errors")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// Package qr implements a small QR code encoder and decoder for exchanging
+// public keys between devices. Only byte mode and versions 1-10 are supported,
+// which is plenty for keys and verification words.
+package qr
+
+import "fmt"
+
+// Level is the error correction level of a QR code
+type Level int
+
+const (
+	LevelL Level = iota // Recovers ~7% of codewords
+	LevelM              // Recovers ~15% of codewords
+	LevelQ              // Recovers ~25% of codewords
+	LevelH              // Recovers ~30% of codewords
+)
+
+const maxVersion = 10
+
+// formatBits maps a level to the two bits stored in the format information
+var formatBits = [4]int{LevelL: 1, LevelM: 0, LevelQ: 3, LevelH: 2}
+
+// ecPerBlock and numBlocks are indexed by [level][version]
+var ecPerBlock = [4][maxVersion + 1]int{
+	{0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18},
+	{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26},
+	{0, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24},
+	{0, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28},
+}
+
+var numBlocks = [4][maxVersion + 1]int{
+	{0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4},
+	{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5},
+	{0, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8},
+	{0, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8},
+}
+
+// alignmentPositions lists the alignment pattern centers for each version
+var alignmentPositions = [maxVersion + 1][]int{
+	nil, nil,
+	{6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// Code is an encoded QR symbol
+type Code struct {
+	Version int
+	Level   Level
+	Size    int      // Modules per side
+	modules [][]bool // [row][col], true = dark
+}
+
+// Black reports whether the module at column x, row y is dark
+func (c *Code) Black(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y][x]
+}
+
+// Encode encodes data in byte mode using the smallest version that fits
+func Encode(data []byte, level Level) (*Code, error) {
+	if level < LevelL || level > LevelH {
+		return nil, fmt.Errorf("invalid error correction level")
+	}
+
+	version := 0
+	for v := 1; v <= maxVersion; v++ {
+		if 4+countBits(v)+8*len(data) <= 8*dataCodewords(v, level) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("data too long for a QR code: %d bytes", len(data))
+	}
+
+	codewords := addErrorCorrection(encodeData(data, version, level), version, level)
+
+	m := newMatrix(version)
+	m.drawFunctionPatterns()
+	m.drawCodewords(codewords)
+
+	// Pick the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		m.applyMask(mask)
+		m.drawFormatBits(level, mask)
+		if p := m.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		m.applyMask(mask) // XOR again to undo
+	}
+	m.applyMask(best)
+	m.drawFormatBits(level, best)
+
+	return &Code{Version: version, Level: level, Size: m.size, modules: m.modules}, nil
+}
+
+// countBits returns the length of the byte mode character count field
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// rawDataModules returns the number of modules available for codewords
+func rawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+// dataCodewords returns the number of data codewords for a version and level
+func dataCodewords(version int, level Level) int {
+	return rawDataModules(version)/8 - ecPerBlock[level][version]*numBlocks[level][version]
+}
+
+// encodeData builds the data codeword sequence: mode, count, bytes, padding
+func encodeData(data []byte, version int, level Level) []byte {
+	capacity := dataCodewords(version, level)
+
+	var bits []bool
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value>>i)&1 == 1)
+		}
+	}
+
+	appendBits(0x4, 4) // Byte mode
+	appendBits(len(data), countBits(version))
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+
+	// Terminator and byte alignment
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+
+	out := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		out = append(out, b)
+	}
+
+	// Alternating pad bytes
+	for pad := byte(0xEC); len(out) < capacity; pad ^= 0xEC ^ 0x11 {
+		out = append(out, pad)
+	}
+	return out
+}
+
+// blockLayout returns the data length of each block; short blocks come first
+func blockLayout(version int, level Level) []int {
+	blocks := numBlocks[level][version]
+	ecLen := ecPerBlock[level][version]
+	raw := rawDataModules(version) / 8
+	numShort := blocks - raw%blocks
+	shortLen := raw/blocks - ecLen
+
+	lens := make([]int, blocks)
+	for i := range lens {
+		lens[i] = shortLen
+		if i >= numShort {
+			lens[i]++
+		}
+	}
+	return lens
+}
+
+// addErrorCorrection splits data into blocks, appends EC codewords and interleaves
+func addErrorCorrection(data []byte, version int, level Level) []byte {
+	ecLen := ecPerBlock[level][version]
+	lens := blockLayout(version, level)
+
+	dataBlocks := make([][]byte, len(lens))
+	ecBlocks := make([][]byte, len(lens))
+	offset := 0
+	for i, n := range lens {
+		dataBlocks[i] = data[offset : offset+n]
+		ecBlocks[i] = rsEncode(dataBlocks[i], ecLen)
+		offset += n
+	}
+
+	out := make([]byte, 0, rawDataModules(version)/8)
+	for i := 0; i <= lens[len(lens)-1]; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package qr
+
+import (
+	"image"
+	"image/color"
+	"strings"
+)
+
+const quietZone = 4 // Modules of light border around the symbol, as ISO/IEC 18004 requires
+
+// String renders the code with Unicode half blocks, two module rows per text
+// line. Light modules are drawn as blocks so the symbol scans correctly on
+// terminals with a dark background.
+func (c *Code) String() string {
+	var sb strings.Builder
+	light := func(x, y int) bool { return !c.Black(x, y) }
+
+	for y := -quietZone; y < c.Size+quietZone; y += 2 {
+		for x := -quietZone; x < c.Size+quietZone; x++ {
+			top := light(x, y)
+			bottom := y+1 < c.Size+quietZone && light(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteRune('█')
+			case top:
+				sb.WriteRune('▀')
+			case bottom:
+				sb.WriteRune('▄')
+			default:
+				sb.WriteRune(' ')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// Image renders the code as a black-on-white image with scale pixels per module
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	dim := (c.Size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, dim, dim))
+	for py := 0; py < dim; py++ {
+		for px := 0; px < dim; px++ {
+			v := color.Gray{Y: 0xFF}
+			if c.Black(px/scale-quietZone, py/scale-quietZone) {
+				v = color.Gray{Y: 0}
+			}
+			img.SetGray(px, py, v)
+		}
+	}
+	return img
+}
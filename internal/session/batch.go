@@ -0,0 +1,109 @@
+package session
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"e2e-message/internal/chunk"
+)
+
+// BatchResult summarizes a batch of pasted message lines
+type BatchResult struct {
+	Messages   []*Message     // Decrypted messages, lowest number first
+	Duplicates []uint32       // Numbers received before, or more than once in the batch
+	Failed     []BatchFailure // Lines that did not decrypt
+	Invalid    []int          // 1-based numbers of lines that are not messages
+	Incomplete []chunk.Status // Split messages that still miss parts
+	Missing    []uint32       // Numbers below the highest received that have not arrived
+}
+
+// BatchFailure is a message line of a batch that did not decrypt
+type BatchFailure struct {
+	Line int // 1-based line number in the batch
+	Num  uint32
+	Err  error
+}
+
+// batchLine is a message line or part waiting to be decrypted
+type batchLine struct {
+	line int
+	num  uint32
+	part int // 0 for a whole message
+	text string
+}
+
+// DecryptBatch decrypts many "msgNum ciphertext" lines and parts pasted at
+// once. Lines may come in any order and are decrypted by message number, so
+// nothing is skipped needlessly; blank lines are ignored
+func (s *Session) DecryptBatch(lines []string) (*BatchResult, error) {
+	if err := s.checkEstablished(); err != nil {
+		return nil, err
+	}
+
+	res := &BatchResult{}
+	var queue []batchLine
+	for i, text := range lines {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		l := batchLine{line: i + 1, text: text}
+		if chunk.IsPart(text) {
+			part, err := chunk.Parse(text)
+			if err != nil {
+				res.Invalid = append(res.Invalid, l.line)
+				continue
+			}
+			l.num, l.part = part.MsgNum, part.Index
+		} else {
+			num, _, _ := strings.Cut(text, " ")
+			n, err := strconv.ParseUint(num, 10, 32)
+			if err != nil || !strings.Contains(text, " ") {
+				res.Invalid = append(res.Invalid, l.line)
+				continue
+			}
+			l.num = uint32(n)
+		}
+		queue = append(queue, l)
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		if queue[i].num != queue[j].num {
+			return queue[i].num < queue[j].num
+		}
+		return queue[i].part < queue[j].part
+	})
+
+	// A forged copy fails without using up the key, so a genuine copy later
+	// in the batch still decrypts; only successes count as seen
+	seen := make(map[batchLine]bool)
+	for _, l := range queue {
+		key := batchLine{num: l.num, part: l.part}
+		if seen[key] || s.ratchet.Received(l.num) {
+			if n := len(res.Duplicates); n == 0 || res.Duplicates[n-1] != l.num {
+				res.Duplicates = append(res.Duplicates, l.num)
+			}
+			continue
+		}
+
+		var m *Message
+		var err error
+		if l.part == 0 {
+			m, err = s.DecryptMessage(l.text)
+		} else {
+			m, _, err = s.DecryptPart(l.text)
+		}
+		if err != nil {
+			res.Failed = append(res.Failed, BatchFailure{Line: l.line, Num: l.num, Err: err})
+			continue
+		}
+		seen[key] = true
+		if m != nil {
+			res.Messages = append(res.Messages, m)
+		}
+	}
+
+	res.Incomplete = s.PendingParts()
+	res.Missing = s.ratchet.GetSkippedMsgNums()
+	return res, nil
+}
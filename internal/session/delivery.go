@@ -0,0 +1,117 @@
+package session
+
+import (
+	"fmt"
+	"sort"
+)
+
+// maxUnconfirmed is how many unconfirmed messages are kept for resend; beyond
+// it the oldest are forgotten, so a peer that never acks costs bounded memory
+const maxUnconfirmed = 256
+
+// Delivery summarizes which sent messages the peer has confirmed; only text
+// and file messages are tracked, not acks and other control messages
+type Delivery struct {
+	Sent        uint32   // Text and file messages sent
+	Confirmed   uint32   // Sent messages confirmed by the peer's acks
+	Missing     []uint32 // Messages the peer reported as not arrived
+	Unconfirmed []uint32 // Sent messages not confirmed yet, including Missing
+}
+
+// NewAck returns an ack message describing what we have received:
+// the highest message number and every lower number still missing
+// It returns nil before the first message has arrived
+func (s *Session) NewAck() *Message {
+	if !s.established {
+		return nil
+	}
+	next := s.ratchet.GetRecvMsgNum()
+	if next == 0 {
+		return nil
+	}
+	return &Message{
+		Type: TypeAck,
+		Ack:  &Ack{Highest: next - 1, Missing: s.ratchet.GetSkippedMsgNums()},
+	}
+}
+
+// trackSent remembers the lines of a sent text or file message until the
+// peer confirms it
+func (s *Session) trackSent(m *Message, lines []string) {
+	if m.Type != TypeText && m.Type != TypeFileChunk {
+		return
+	}
+	s.sent++
+	s.unconfirmed[m.Num] = lines
+	if len(s.unconfirmed) > maxUnconfirmed {
+		oldest := m.Num
+		for n := range s.unconfirmed {
+			oldest = min(oldest, n)
+		}
+		delete(s.unconfirmed, oldest)
+	}
+}
+
+// applyAck marks the messages covered by a peer's ack as confirmed
+func (s *Session) applyAck(ack *Ack) {
+	missing := make(map[uint32]bool, len(ack.Missing))
+	for _, n := range ack.Missing {
+		missing[n] = true
+	}
+	for n := range s.unconfirmed {
+		if n <= ack.Highest && !missing[n] {
+			delete(s.unconfirmed, n)
+			s.confirmed++
+		}
+	}
+
+	// Acks can arrive out of order; keep the most complete one
+	if s.peerAck == nil || ack.Highest >= s.peerAck.Highest {
+		s.peerAck = ack
+	}
+}
+
+// GetDelivery returns the delivery state of our sent messages
+func (s *Session) GetDelivery() Delivery {
+	d := Delivery{Sent: s.sent, Confirmed: s.confirmed}
+	for n := range s.unconfirmed {
+		d.Unconfirmed = append(d.Unconfirmed, n)
+	}
+	sort.Slice(d.Unconfirmed, func(i, j int) bool { return d.Unconfirmed[i] < d.Unconfirmed[j] })
+
+	if s.peerAck != nil {
+		for _, n := range s.peerAck.Missing {
+			if _, ok := s.unconfirmed[n]; ok {
+				d.Missing = append(d.Missing, n)
+			}
+		}
+	}
+	return d
+}
+
+// GetSentLines returns the lines of an unconfirmed message so they can be
+// sent again unchanged; the peer still holds the key for a missing message
+func (s *Session) GetSentLines(msgNum uint32) ([]string, error) {
+	lines, ok := s.unconfirmed[msgNum]
+	if !ok {
+		return nil, fmt.Errorf("message %d is not awaiting confirmation", msgNum)
+	}
+	return lines, nil
+}
+
+// Resend encrypts m as a new message that replaces the unconfirmed message
+// msgNum, for when the original ciphertext is lost or can no longer be
+// decrypted; the old number is no longer tracked
+func (s *Session) Resend(msgNum uint32, m *Message) ([]string, error) {
+	if _, ok := s.unconfirmed[msgNum]; !ok {
+		return nil, fmt.Errorf("message %d is not awaiting confirmation", msgNum)
+	}
+	lines, err := s.EncryptMessage(m)
+	if err != nil {
+		return nil, err
+	}
+	// The new message takes the old one's place instead of counting again
+	delete(s.unconfirmed, msgNum)
+	s.sent--
+	return lines, nil
+}
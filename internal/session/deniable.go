@@ -0,0 +1,75 @@
+package session
+
+import (
+	"fmt"
+
+	"e2e-message/internal/crypto"
+)
+
+// In deniable mode the session key is X25519 instead of P-256, and the
+// channel is authenticated by a triple Diffie-Hellman handshake of both
+// identity keys and both session keys (see crypto.TripleDH). Each side
+// could have computed every key on its own, so a transcript proves to no
+// one who wrote a message, while the peer is still sure it was the holder
+// of the pinned identity. Unlike pinning alone, a stolen identity key does
+// not let the thief impersonate others to its owner
+
+// SetDeniable switches deniable mode on or off, replacing the session key;
+// it must be chosen before the channel is established
+func (s *Session) SetDeniable(enabled bool) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.established || s.pake != nil {
+		return fmt.Errorf("deniable mode must be chosen before the channel is established")
+	}
+	if enabled == s.deniable {
+		return nil
+	}
+
+	var privateKey *crypto.Secret
+	var publicKey []byte
+	var err error
+	if enabled {
+		privateKey, publicKey, err = crypto.GenerateX25519Key(s.rand)
+	} else {
+		key, kerr := crypto.GenerateKeyPairFrom(s.rand)
+		if kerr != nil {
+			return fmt.Errorf("failed to generate key pair: %w", kerr)
+		}
+		publicKey = key.PublicKey().Bytes()
+		privateKey, err = crypto.PrivateKeySecret(key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	s.privateKey.Destroy()
+	s.privateKey, s.publicKey = privateKey, publicKey
+	s.deniable = enabled
+	return nil
+}
+
+// GetDeniable returns whether deniable mode is on
+func (s *Session) GetDeniable() bool {
+	return s.deniable
+}
+
+// deniableSecret computes the triple Diffie-Hellman secret with the
+// peer's X25519 session key
+func (s *Session) deniableSecret(peerKeyBytes []byte) (*crypto.Secret, error) {
+	if len(peerKeyBytes) != 32 {
+		return nil, fmt.Errorf("%w: the peer is not in deniable mode", ErrInvalidKey)
+	}
+	if s.identityKey == nil {
+		return nil, fmt.Errorf("deniable mode requires your own identity key")
+	}
+	if s.peerIdentity == nil {
+		return nil, fmt.Errorf("deniable mode requires the peer's pinned identity key")
+	}
+	shared, err := crypto.TripleDH(s.identityKey, s.privateKey, s.peerIdentity, peerKeyBytes,
+		string(s.publicKey) < string(peerKeyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	return shared, nil
+}
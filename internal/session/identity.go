@@ -0,0 +1,94 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+
+	"e2e-message/internal/crypto"
+)
+
+// Long-term identity keys authenticate a session without comparing
+// verification words. The session keys stay fresh: the shared secret is
+// the ephemeral ECDH secret followed by the X25519 secret of the two
+// identity keys, so only the holders of both identity keys can derive it,
+// and no two sessions share keys
+
+// SetIdentityKey sets our long-term X25519 private key; it is moved into
+// secure memory and privateKey is zeroed
+func (s *Session) SetIdentityKey(privateKey []byte) error {
+	if s.closed {
+		return ErrClosed
+	}
+	key, err := crypto.SecretFrom(privateKey)
+	if err != nil {
+		return err
+	}
+	public, err := crypto.X25519PublicKey(key)
+	if err != nil {
+		key.Destroy()
+		return err
+	}
+	s.identityKey.Destroy()
+	s.identityKey, s.identityPub = key, public
+	return s.reestablish()
+}
+
+// GetIdentityPublicKey returns our long-term X25519 public key, or nil
+func (s *Session) GetIdentityPublicKey() []byte {
+	return s.identityPub
+}
+
+// SetPeerIdentityKey pins the peer's long-term X25519 public key; the
+// channel is then only established with the holder of the matching private key
+func (s *Session) SetPeerIdentityKey(publicKey []byte) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if len(publicKey) != 32 {
+		return fmt.Errorf("invalid identity key length %d", len(publicKey))
+	}
+	s.peerIdentity = bytes.Clone(publicKey)
+	return s.reestablish()
+}
+
+// GetPeerIdentityKey returns the peer's pinned long-term X25519 key, or nil
+func (s *Session) GetPeerIdentityKey() []byte {
+	return s.peerIdentity
+}
+
+// reestablish re-derives the channel keys after an identity change
+// Message numbers start again from zero, as after importing a new peer key
+func (s *Session) reestablish() error {
+	if s.pakeSecret != nil {
+		return s.establishPAKE(s.isInitiator, s.peerHello)
+	}
+	if s.peerPubKey == nil {
+		return nil
+	}
+	return s.establish(s.peerPubKey, s.peerHello)
+}
+
+// mixIdentity appends the identity secret to the ECDH secret when a peer
+// identity is pinned; it takes ownership of shared
+func (s *Session) mixIdentity(shared *crypto.Secret) (*crypto.Secret, error) {
+	if s.peerIdentity == nil {
+		return shared, nil
+	}
+	defer shared.Destroy()
+	if s.identityKey == nil {
+		return nil, fmt.Errorf("a pinned peer identity requires your own identity key")
+	}
+
+	static, err := crypto.X25519SharedSecret(s.identityKey, s.peerIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute identity secret: %w", err)
+	}
+	defer static.Destroy()
+	mixed, err := crypto.NewSecret(len(shared.Bytes()) + len(static.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	n := copy(mixed.Bytes(), shared.Bytes())
+	copy(mixed.Bytes()[n:], static.Bytes())
+	return mixed, nil
+}
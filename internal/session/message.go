@@ -0,0 +1,130 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MessageType identifies what a message carries
+type MessageType uint8
+
+const (
+	TypeText      MessageType = iota // Chat text
+	TypeFileChunk                    // One chunk of a file
+	TypeAck                          // Delivery acknowledgement
+	TypeRekey                        // Request to switch to a new key pair
+	TypeReceipt                      // Read receipt
+	TypeClose                        // Peer is ending the session
+)
+
+var messageTypeNames = []string{"text", "file-chunk", "ack", "rekey", "receipt", "close"}
+
+// String returns the name of the message type
+func (t MessageType) String() string {
+	if int(t) < len(messageTypeNames) {
+		return messageTypeNames[t]
+	}
+	return fmt.Sprintf("type(%d)", uint8(t))
+}
+
+// Message is a typed message with its authenticated metadata
+type Message struct {
+	Type   MessageType
+	Num    uint32        // Message number (set by the session)
+	SentAt time.Time     // Sender's clock when encrypted (set by the session)
+	TTL    time.Duration // Lifetime after SentAt; 0 means the message never expires
+
+	Text     string     // Text (TypeText), or optional reason (TypeClose)
+	File     *FileChunk // TypeFileChunk
+	Ack      *Ack       // TypeAck
+	Receipt  []uint32   // TypeReceipt: message numbers that were read
+	RekeyKey []byte     // TypeRekey: sender's new public key
+}
+
+// FileChunk is one chunk of a file transfer
+type FileChunk struct {
+	Name  string
+	Index uint32 // 1-based
+	Total uint32
+	Data  []byte
+}
+
+// Ack reports which messages have been received
+type Ack struct {
+	Highest uint32   // Highest message number received
+	Missing []uint32 // Lower message numbers that have not arrived
+}
+
+// validate checks that the fields required by the message type are present
+func (m *Message) validate() error {
+	if m.TTL < 0 || m.TTL > MaxTTL {
+		return fmt.Errorf("TTL must be between 0 and %v", MaxTTL)
+	}
+	switch m.Type {
+	case TypeText, TypeClose:
+	case TypeFileChunk:
+		if m.File == nil || m.File.Total == 0 || m.File.Index == 0 || m.File.Index > m.File.Total {
+			return fmt.Errorf("invalid file chunk")
+		}
+	case TypeAck:
+		if m.Ack == nil {
+			return fmt.Errorf("ack message without ack data")
+		}
+	case TypeReceipt:
+		if len(m.Receipt) == 0 {
+			return fmt.Errorf("receipt message without message numbers")
+		}
+	case TypeRekey:
+		if len(m.RekeyKey) == 0 {
+			return fmt.Errorf("rekey message without a public key")
+		}
+	default:
+		return fmt.Errorf("unsupported message type %s", m.Type)
+	}
+	return nil
+}
+
+// ExpiresAt returns when the message expires, or the zero time if it never does
+func (m *Message) ExpiresAt() time.Time {
+	if m.TTL == 0 {
+		return time.Time{}
+	}
+	return m.SentAt.Add(m.TTL)
+}
+
+// Expired reports whether the message has expired at the given time
+func (m *Message) Expired(now time.Time) bool {
+	return m.TTL != 0 && now.After(m.ExpiresAt())
+}
+
+// ExpiryPolicy controls what Decrypt does with expired messages
+type ExpiryPolicy int
+
+const (
+	ExpiryRefuse ExpiryPolicy = iota // Return ErrExpired instead of the plaintext
+	ExpiryWarn                       // Return the message; the caller checks Expired
+)
+
+// String returns the name used by ParseExpiryPolicy
+func (p ExpiryPolicy) String() string {
+	if p == ExpiryWarn {
+		return "warn"
+	}
+	return "refuse"
+}
+
+// ParseExpiryPolicy parses an expiry policy name
+func ParseExpiryPolicy(name string) (ExpiryPolicy, error) {
+	switch name {
+	case "refuse":
+		return ExpiryRefuse, nil
+	case "warn":
+		return ExpiryWarn, nil
+	default:
+		return 0, fmt.Errorf("unknown expiry policy %q (use refuse or warn)", name)
+	}
+}
+
+// ErrExpired is returned when decrypting a message whose TTL has passed
+var ErrExpired = errors.New("message expired")
@@ -0,0 +1,31 @@
+package session
+
+import (
+	"io"
+	"time"
+)
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the real time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Option configures a new session
+type Option func(*Session)
+
+// WithRand makes the session draw keys and nonces from r instead of
+// crypto/rand. Every key is as predictable as r, so this is only for tests
+// and test vectors
+func WithRand(r io.Reader) Option {
+	return func(s *Session) { s.rand = r }
+}
+
+// WithClock makes the session read send times and check expiry with c
+func WithClock(c Clock) Option {
+	return func(s *Session) { s.clock = c }
+}
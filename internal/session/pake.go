@@ -0,0 +1,124 @@
+package session
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"e2e-message/internal/codec"
+	"e2e-message/internal/crypto"
+)
+
+// A PAKE bootstraps the channel from a short one-time code that both sides
+// type, such as "7-guitar-ocean", instead of public keys whose verification
+// words must be compared. A man in the middle who does not know the code
+// gets a single guess per exchange, and a wrong guess only makes the first
+// message fail to decrypt
+
+// NewPAKECode returns a random one-time code: a number from 1 to 99
+// followed by two words, about 22 bits of entropy
+func NewPAKECode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(99))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate code: %w", err)
+	}
+	words := make([]byte, 2)
+	if _, err := rand.Read(words); err != nil {
+		return "", fmt.Errorf("failed to generate code: %w", err)
+	}
+	return fmt.Sprintf("%d-%s", n.Int64()+1, strings.ReplaceAll(codec.Words.Encode(words), " ", "-")), nil
+}
+
+// NormalizePAKECode lower-cases a code and joins its parts with hyphens,
+// so "7 Guitar ocean" and "7-guitar-ocean" are the same code
+func NormalizePAKECode(code string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(code), func(r rune) bool {
+		return r == '-' || r == ' ' || r == '\t'
+	}), "-")
+}
+
+// StartPAKE begins an exchange with code and returns the message to send
+// to the peer; an exchange that was already started is abandoned
+func (s *Session) StartPAKE(code string) (string, error) {
+	if s.closed {
+		return "", ErrClosed
+	}
+	p, err := crypto.NewPAKE(s.rand, NormalizePAKECode(code))
+	if err != nil {
+		return "", err
+	}
+	s.CancelPAKE()
+	s.pake = p
+	return s.encoding.Encode(ourHello().prefix(p.Message())), nil
+}
+
+// PAKEPending reports whether StartPAKE is waiting for the peer's message
+func (s *Session) PAKEPending() bool {
+	return s.pake != nil
+}
+
+// CancelPAKE abandons a started exchange
+func (s *Session) CancelPAKE() {
+	if s.pake != nil {
+		s.pake.Close()
+		s.pake = nil
+	}
+}
+
+// FinishPAKE completes the exchange with the peer's message and establishes
+// the channel; the message may be in any encoding supported by codec.Detect
+func (s *Session) FinishPAKE(encodedMsg string) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.pake == nil {
+		return fmt.Errorf("no PAKE in progress: start one with a code first")
+	}
+	data, err := DecodeKey(encodedMsg)
+	if err != nil {
+		return err
+	}
+	peerHello, peerMsg, err := parseHello(data)
+	if err != nil {
+		return err
+	}
+	version, caps, err := negotiate(ourHello(), peerHello)
+	if err != nil {
+		return err
+	}
+	ourMsg := s.pake.Message()
+	secret, err := s.pake.Finish(peerMsg)
+	if err != nil {
+		return err
+	}
+	s.pake = nil
+
+	s.pakeSecret.Destroy()
+	s.pakeSecret = secret
+	s.peerPubKey = nil
+	if err := s.establishPAKE(string(ourMsg) < string(peerMsg), peerHello); err != nil {
+		return err
+	}
+	s.peerHello, s.version, s.caps = peerHello, version, caps
+	return nil
+}
+
+// establishPAKE derives the channel keys from the PAKE secret
+func (s *Session) establishPAKE(isInitiator bool, peerHello hello) error {
+	shared, err := crypto.NewSecret(len(s.pakeSecret.Bytes()))
+	if err != nil {
+		return err
+	}
+	copy(shared.Bytes(), s.pakeSecret.Bytes())
+	if shared, err = s.mixIdentity(shared); err != nil {
+		return err
+	}
+	defer shared.Destroy()
+	return s.setChannel(shared.Bytes(), isInitiator, peerHello)
+}
+
+// EstablishedByPAKE reports whether the channel was established with a PAKE
+func (s *Session) EstablishedByPAKE() bool {
+	return s.established && s.pakeSecret != nil
+}
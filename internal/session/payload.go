@@ -0,0 +1,273 @@
+package session
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Inner payload layout (inside the padding, so it is encrypted and authenticated):
+//
+//	version (1 byte) | flags (1 byte) | fields
+//
+// Each field is tag (1 byte) | length (uvarint) | value. Integers are uvarints,
+// absent fields take their zero value and unknown tags are skipped, so newer
+// senders can add fields without breaking older receivers. When compressed,
+// the fields are DEFLATE-compressed as a whole.
+const (
+	payloadVersion = 1
+
+	flagCompressed = 0x01 // Fields are DEFLATE-compressed
+
+	knownFlags = flagCompressed
+
+	payloadHeaderSize = 2
+)
+
+// Field tags
+const (
+	tagType      = 1  // MessageType
+	tagSentAt    = 2  // Unix ms
+	tagTTL       = 3  // ms
+	tagText      = 4  // UTF-8 text
+	tagFileName  = 5  // File chunk: file name
+	tagFileIndex = 6  // File chunk: 1-based chunk number
+	tagFileTotal = 7  // File chunk: number of chunks
+	tagFileData  = 8  // File chunk: data
+	tagAckHigh   = 9  // Ack: highest message number received
+	tagAckMiss   = 10 // Ack: missing message numbers (uvarints)
+	tagReceipt   = 11 // Receipt: message numbers read (uvarints)
+	tagRekeyKey  = 12 // Rekey: new public key
+)
+
+const (
+	// compressMinSize is the smallest encoded payload worth compressing
+	compressMinSize = 128
+
+	// MaxDecompressedSize bounds the output of decompression to defuse
+	// decompression bombs
+	MaxDecompressedSize = 1 << 20
+
+	// MaxTTL is the longest message lifetime allowed (~49 days)
+	MaxTTL = time.Duration(1<<32-1) * time.Millisecond
+)
+
+// encodePayload builds the inner payload for m, compressing the fields
+// when enabled and when they actually get smaller
+func encodePayload(m *Message, compress bool) ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	// The header goes first so the fields need not be copied after it
+	var f fieldWriter
+	f.buf.Grow(payloadHeaderSize + len(m.Text) + 64)
+	f.buf.Write([]byte{payloadVersion, 0})
+	if m.Type != TypeText {
+		f.putUint(tagType, uint64(m.Type))
+	}
+	f.putUint(tagSentAt, uint64(m.SentAt.UnixMilli()))
+	if m.TTL != 0 {
+		f.putUint(tagTTL, uint64(m.TTL.Milliseconds()))
+	}
+	if m.Text != "" {
+		f.putString(tagText, m.Text)
+	}
+	switch m.Type {
+	case TypeFileChunk:
+		f.putBytes(tagFileName, []byte(m.File.Name))
+		f.putUint(tagFileIndex, uint64(m.File.Index))
+		f.putUint(tagFileTotal, uint64(m.File.Total))
+		f.putBytes(tagFileData, m.File.Data)
+	case TypeAck:
+		f.putUint(tagAckHigh, uint64(m.Ack.Highest))
+		if len(m.Ack.Missing) > 0 {
+			f.putUints(tagAckMiss, m.Ack.Missing)
+		}
+	case TypeReceipt:
+		f.putUints(tagReceipt, m.Receipt)
+	case TypeRekey:
+		f.putBytes(tagRekeyKey, m.RekeyKey)
+	}
+	payload := f.buf.Bytes()
+	fields := payload[payloadHeaderSize:]
+
+	if compress && len(fields) >= compressMinSize {
+		var buf bytes.Buffer
+		buf.Write([]byte{payloadVersion, flagCompressed})
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create compressor: %w", err)
+		}
+		if _, err := w.Write(fields); err != nil {
+			return nil, fmt.Errorf("compression failed: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("compression failed: %w", err)
+		}
+		if buf.Len() < payloadHeaderSize+len(fields) {
+			return buf.Bytes(), nil
+		}
+	}
+
+	return payload, nil
+}
+
+// decodePayload parses the inner payload into a message (without its number)
+func decodePayload(data []byte) (*Message, error) {
+	if len(data) < payloadHeaderSize {
+		return nil, fmt.Errorf("payload too short")
+	}
+	if data[0] != payloadVersion {
+		return nil, fmt.Errorf("unsupported payload version %d", data[0])
+	}
+	flags := data[1]
+	if flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("unsupported payload flags: %#02x", flags)
+	}
+
+	fields := data[payloadHeaderSize:]
+	if flags&flagCompressed != 0 {
+		r := flate.NewReader(bytes.NewReader(fields))
+		defer r.Close()
+		out, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("decompression failed: %w", err)
+		}
+		if len(out) > MaxDecompressedSize {
+			return nil, fmt.Errorf("decompressed message exceeds %d bytes", MaxDecompressedSize)
+		}
+		fields = out
+	}
+
+	m := &Message{}
+	var file FileChunk
+	var ack Ack
+	seen := make(map[byte]bool)
+	for len(fields) > 0 {
+		tag := fields[0]
+		n, size := binary.Uvarint(fields[1:])
+		if size <= 0 || n > uint64(len(fields)-1-size) {
+			return nil, fmt.Errorf("truncated payload field %d", tag)
+		}
+		value := fields[1+size : 1+size+int(n)]
+		fields = fields[1+size+int(n):]
+
+		if seen[tag] {
+			return nil, fmt.Errorf("duplicate payload field %d", tag)
+		}
+		seen[tag] = true
+
+		var err error
+		switch tag {
+		case tagType:
+			var v uint64
+			v, err = readUint(value, 0xFF)
+			m.Type = MessageType(v)
+		case tagSentAt:
+			var v uint64
+			v, err = readUint(value, 1<<63-1)
+			m.SentAt = time.UnixMilli(int64(v))
+		case tagTTL:
+			var v uint64
+			v, err = readUint(value, uint64(MaxTTL/time.Millisecond))
+			m.TTL = time.Duration(v) * time.Millisecond
+		case tagText:
+			m.Text = string(value)
+		case tagFileName:
+			file.Name = string(value)
+		case tagFileIndex:
+			var v uint64
+			v, err = readUint(value, 1<<32-1)
+			file.Index = uint32(v)
+		case tagFileTotal:
+			var v uint64
+			v, err = readUint(value, 1<<32-1)
+			file.Total = uint32(v)
+		case tagFileData:
+			file.Data = value
+		case tagAckHigh:
+			var v uint64
+			v, err = readUint(value, 1<<32-1)
+			ack.Highest = uint32(v)
+		case tagAckMiss:
+			ack.Missing, err = readUints(value)
+		case tagReceipt:
+			m.Receipt, err = readUints(value)
+		case tagRekeyKey:
+			m.RekeyKey = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload field %d: %w", tag, err)
+		}
+	}
+
+	switch m.Type {
+	case TypeFileChunk:
+		m.File = &file
+	case TypeAck:
+		m.Ack = &ack
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fieldWriter appends tag-length-value fields
+type fieldWriter struct {
+	buf bytes.Buffer
+}
+
+func (f *fieldWriter) putBytes(tag byte, value []byte) {
+	f.buf.WriteByte(tag)
+	f.buf.Write(binary.AppendUvarint(nil, uint64(len(value))))
+	f.buf.Write(value)
+}
+
+func (f *fieldWriter) putString(tag byte, value string) {
+	f.buf.WriteByte(tag)
+	f.buf.Write(binary.AppendUvarint(nil, uint64(len(value))))
+	f.buf.WriteString(value)
+}
+
+func (f *fieldWriter) putUint(tag byte, v uint64) {
+	f.putBytes(tag, binary.AppendUvarint(nil, v))
+}
+
+func (f *fieldWriter) putUints(tag byte, vs []uint32) {
+	var value []byte
+	for _, v := range vs {
+		value = binary.AppendUvarint(value, uint64(v))
+	}
+	f.putBytes(tag, value)
+}
+
+// readUint parses a field holding a single uvarint no larger than max
+func readUint(value []byte, max uint64) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n <= 0 || n != len(value) {
+		return 0, fmt.Errorf("malformed integer")
+	}
+	if v > max {
+		return 0, fmt.Errorf("value %d out of range", v)
+	}
+	return v, nil
+}
+
+// readUints parses a field holding a sequence of 32-bit uvarints
+func readUints(value []byte) ([]uint32, error) {
+	var out []uint32
+	for len(value) > 0 {
+		v, n := binary.Uvarint(value)
+		if n <= 0 || v > 1<<32-1 {
+			return nil, fmt.Errorf("malformed integer list")
+		}
+		out = append(out, uint32(v))
+		value = value[n:]
+	}
+	return out, nil
+}
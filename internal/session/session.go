@@ -1,82 +1,316 @@
 package session
 
 import (
-	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"time"
 
+	"e2e-message/internal/chunk"
+	"e2e-message/internal/codec"
 	"e2e-message/internal/crypto"
 )
 
 // Session represents an E2E encryption session with forward secrecy
 type Session struct {
-	privateKey     *ecdh.PrivateKey // Our private key
-	publicKey      []byte           // Our public key bytes
-	peerPubKey     []byte           // Peer's public key bytes
-	ratchet        *crypto.Ratchet  // Key ratchet for forward secrecy
-	aesKey         []byte           // Base AES key (for verification words)
-	established    bool             // Whether the session is established
-	isInitiator    bool             // Whether we initiated (our pubkey < peer's)
-	lastRecvMsgNum uint32           // Last successfully received message number
+	privateKey     *crypto.Secret  // Our private key
+	publicKey      []byte          // Our public key bytes
+	peerPubKey     []byte          // Peer's public key bytes
+	peerHello      hello           // Versions and capabilities the peer announced
+	version        uint8           // Negotiated protocol version
+	caps           Capabilities    // Capabilities both sides have
+	ratchet        *crypto.Ratchet // Key ratchet for forward secrecy
+	aesKey         *crypto.Secret  // Base AES key (for verification words)
+	established    bool            // Whether the session is established
+	isInitiator    bool            // Whether we initiated (our pubkey < peer's)
+	lastRecvMsgNum uint32          // Last successfully received message number
+
+	padding   crypto.PaddingScheme // How plaintext is padded before encryption
+	minBucket int                  // Smallest padded plaintext size in bytes
+	compress  bool                 // Whether long messages are compressed
+	encoding  codec.Encoding       // Text encoding for keys and ciphertexts we output
+	partSize  int                  // Maximum line length for EncryptMessage (0 = no limit)
+	assembler *chunk.Assembler     // Collects parts of fragmented incoming messages
+	ttl       time.Duration        // Default lifetime of outgoing messages (0 = forever)
+	expiry    ExpiryPolicy         // What Decrypt does with expired messages
+
+	unconfirmed map[uint32][]string // Lines of sent messages the peer has not acked
+	sent        uint32              // Text and file messages sent
+	confirmed   uint32              // Sent messages confirmed by the peer's acks
+	peerAck     *Ack                // Most complete ack received from the peer
+
+	identityKey  *crypto.Secret // Our long-term X25519 key, if any
+	identityPub  []byte         // Its public key
+	peerIdentity []byte         // The peer's pinned long-term X25519 key, if any
+
+	pake       *crypto.PAKE   // Exchange waiting for the peer's message, if any
+	pakeSecret *crypto.Secret // Secret of a completed PAKE, if that established the channel
+	deniable   bool           // Whether the channel uses the triple-DH handshake
+
+	rand  io.Reader // Source of keys and nonces
+	clock Clock     // Source of send times and the time for expiry checks
+
+	closed bool // Whether Close has wiped the session
 }
 
+var (
+	// ErrClosed is returned when using a session after Close
+	ErrClosed = errors.New("session closed")
+
+	// ErrNotEstablished is returned when encrypting or decrypting before a
+	// channel is established
+	ErrNotEstablished = errors.New("session not established")
+
+	// ErrInvalidKey is returned for a peer key that cannot be decoded or used
+	ErrInvalidKey = errors.New("invalid public key")
+
+	// ErrInvalidMessage is returned for input that is not a well-formed message
+	ErrInvalidMessage = errors.New("invalid message")
+
+	// ErrDecryption is returned when a message does not open with the key for
+	// its number: it was forged, corrupted or encrypted in another session
+	ErrDecryption = errors.New("decryption failed")
+)
+
 // NewSession creates a new session and generates a key pair
-func NewSession() (*Session, error) {
-	privateKey, err := crypto.GenerateKeyPair()
+// Options replace the sources of randomness and time, for tests
+func NewSession(opts ...Option) (*Session, error) {
+	s := &Session{
+		established: false,
+		padding:     crypto.PaddingPadme,
+		minBucket:   crypto.DefaultMinBucket,
+		assembler:   chunk.NewAssembler(),
+		unconfirmed: make(map[uint32][]string),
+		rand:        rand.Reader,
+		clock:       systemClock{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	key, err := crypto.GenerateKeyPairFrom(s.rand)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate key pair: %w", err)
 	}
+	privateKey, err := crypto.PrivateKeySecret(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store private key: %w", err)
+	}
+	s.privateKey, s.publicKey = privateKey, key.PublicKey().Bytes()
+	return s, nil
+}
 
-	return &Session{
-		privateKey:  privateKey,
-		publicKey:   privateKey.PublicKey().Bytes(),
-		established: false,
-	}, nil
+// SetPadding configures how plaintext is padded to hide its length
+// Messages padded into the same bucket produce ciphertexts of equal length
+func (s *Session) SetPadding(scheme crypto.PaddingScheme, minBucket int) error {
+	if minBucket < 0 || minBucket > crypto.MaxMinBucket {
+		return fmt.Errorf("minimum bucket must be between 0 and %d bytes", crypto.MaxMinBucket)
+	}
+	if s.compress && scheme == crypto.PaddingNone {
+		return fmt.Errorf("padding is required while compression is enabled")
+	}
+	s.padding = scheme
+	s.minBucket = minBucket
+	return nil
 }
 
-// GetPublicKeyBase64 returns our public key encoded in Base64
+// GetPadding returns the current padding scheme and minimum bucket size
+func (s *Session) GetPadding() (crypto.PaddingScheme, int) {
+	return s.padding, s.minBucket
+}
+
+// SetCompression enables DEFLATE compression of long messages before encryption
+// Compressed length depends on content (CRIME-style leaks), so padding must
+// stay enabled to blur it
+func (s *Session) SetCompression(enabled bool) error {
+	if enabled && s.padding == crypto.PaddingNone {
+		return fmt.Errorf("compression requires padding: set a padding scheme first")
+	}
+	s.compress = enabled
+	return nil
+}
+
+// GetCompression returns whether compression is enabled
+func (s *Session) GetCompression() bool {
+	return s.compress
+}
+
+// EncodeKey encodes a public key in Base64
+func EncodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// DecodeKey decodes a public key in any encoding supported by codec.Detect
+func DecodeKey(encoded string) ([]byte, error) {
+	return codec.Decode(strings.TrimSpace(encoded))
+}
+
+// GetPublicKeyBase64 returns our public key, with its protocol hello, encoded in Base64
 func (s *Session) GetPublicKeyBase64() string {
-	return base64.StdEncoding.EncodeToString(s.publicKey)
+	return EncodeKey(ourHello().prefix(s.publicKey))
+}
+
+// GetPublicKeyEncoded returns our public key in the selected output encoding
+func (s *Session) GetPublicKeyEncoded() string {
+	return s.encoding.Encode(ourHello().prefix(s.publicKey))
+}
+
+// SetEncoding selects the text encoding for our public key and ciphertexts
+// Input is always auto-detected, so peers may use different encodings
+func (s *Session) SetEncoding(enc codec.Encoding) {
+	s.encoding = enc
 }
 
-// SetPeerPublicKey imports the peer's public key and derives the shared secret
-func (s *Session) SetPeerPublicKey(base64Key string) error {
-	// Decode Base64 public key
-	peerKeyBytes, err := base64.StdEncoding.DecodeString(base64Key)
+// GetEncoding returns the selected output encoding
+func (s *Session) GetEncoding() codec.Encoding {
+	return s.encoding
+}
+
+// SetPartSize sets the maximum line length used by EncryptMessage
+// Zero disables splitting
+func (s *Session) SetPartSize(maxLen int) error {
+	if maxLen != 0 && maxLen < chunk.MinSize {
+		return fmt.Errorf("part size must be 0 (off) or at least %d characters", chunk.MinSize)
+	}
+	s.partSize = maxLen
+	return nil
+}
+
+// GetPartSize returns the maximum line length used by EncryptMessage
+func (s *Session) GetPartSize() int {
+	return s.partSize
+}
+
+// SetTTL sets the default lifetime of outgoing messages; zero disables expiry
+func (s *Session) SetTTL(ttl time.Duration) error {
+	if ttl < 0 || ttl > MaxTTL {
+		return fmt.Errorf("TTL must be between 0 and %v", MaxTTL)
+	}
+	s.ttl = ttl
+	return nil
+}
+
+// GetTTL returns the default lifetime of outgoing messages
+func (s *Session) GetTTL() time.Duration {
+	return s.ttl
+}
+
+// SetExpiryPolicy sets whether expired incoming messages are refused or returned
+func (s *Session) SetExpiryPolicy(policy ExpiryPolicy) {
+	s.expiry = policy
+}
+
+// GetExpiryPolicy returns the expiry policy for incoming messages
+func (s *Session) GetExpiryPolicy() ExpiryPolicy {
+	return s.expiry
+}
+
+// SetPeerPublicKey imports the peer's public key, negotiates the protocol
+// version and derives the shared secret
+// The key may be in any encoding supported by codec.Detect
+func (s *Session) SetPeerPublicKey(encodedKey string) error {
+	if s.closed {
+		return ErrClosed
+	}
+
+	// Decode the public key
+	data, err := DecodeKey(encodedKey)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+	peerHello, peerKeyBytes, err := parseHello(data)
+	if err != nil {
+		return err
+	}
+	version, caps, err := negotiate(ourHello(), peerHello)
+	if err != nil {
+		return err
+	}
+
+	if err := s.establish(peerKeyBytes, peerHello); err != nil {
+		return err
+	}
+	s.peerHello, s.version, s.caps = peerHello, version, caps
+	return nil
+}
+
+// establish derives the channel keys from the peer's session key and, if a
+// peer identity is pinned, the identity keys
+func (s *Session) establish(peerKeyBytes []byte, peerHello hello) error {
+	sharedSecret, err := s.sharedSecret(peerKeyBytes)
 	if err != nil {
-		return fmt.Errorf("invalid Base64 encoding: %w", err)
+		return err
+	}
+	defer sharedSecret.Destroy()
+
+	// Determine who is initiator (lexicographically smaller pubkey)
+	if err := s.setChannel(sharedSecret.Bytes(), string(s.publicKey) < string(peerKeyBytes), peerHello); err != nil {
+		return err
+	}
+	s.peerPubKey = peerKeyBytes
+	s.pakeSecret.Destroy()
+	s.pakeSecret = nil
+	return nil
+}
+
+// sharedSecret computes the secret of our and the peer's session keys
+func (s *Session) sharedSecret(peerKeyBytes []byte) (*crypto.Secret, error) {
+	if s.deniable {
+		return s.deniableSecret(peerKeyBytes)
 	}
 
 	// Parse the public key
 	peerPubKey, err := crypto.ParsePublicKey(peerKeyBytes)
 	if err != nil {
-		return fmt.Errorf("invalid public key: %w", err)
+		if len(peerKeyBytes) == 32 {
+			return nil, fmt.Errorf("%w: the peer is in deniable mode", ErrInvalidKey)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
 	}
 
 	// Compute shared secret
-	sharedSecret, err := crypto.ComputeSharedSecret(s.privateKey, peerPubKey)
+	sharedSecret, err := crypto.ComputeSharedSecretFrom(s.privateKey, peerPubKey)
 	if err != nil {
-		return fmt.Errorf("failed to compute shared secret: %w", err)
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
 	}
+	return s.mixIdentity(sharedSecret)
+}
+
+// setChannel derives the AES key and the ratchet from a shared secret,
+// replacing the previous channel
+// Both hellos are bound into the keys, so a hello altered in transit to
+// downgrade the version or drop a capability leaves the two sides with
+// different keys and verification words
+func (s *Session) setChannel(sharedSecret []byte, isInitiator bool, peerHello hello) error {
+	handshake := helloTranscript(ourHello(), peerHello, isInitiator)
 
 	// Derive base AES key (for verification words)
-	aesKey, err := crypto.DeriveAESKey(sharedSecret)
+	aesKey, err := crypto.DeriveAESKey(sharedSecret, handshake)
 	if err != nil {
 		return fmt.Errorf("failed to derive AES key: %w", err)
 	}
 
-	// Determine who is initiator (lexicographically smaller pubkey)
-	s.isInitiator = string(s.publicKey) < string(peerKeyBytes)
-
 	// Create ratchet for forward secrecy
-	ratchet, err := crypto.NewRatchet(sharedSecret, s.isInitiator)
+	ratchet, err := crypto.NewRatchet(sharedSecret, handshake, isInitiator)
 	if err != nil {
+		aesKey.Destroy()
 		return fmt.Errorf("failed to create ratchet: %w", err)
 	}
 
-	s.peerPubKey = peerKeyBytes
+	s.aesKey.Destroy()
+	if s.ratchet != nil {
+		s.ratchet.Close()
+	}
+
+	// Message numbers start over, so the old channel's delivery state is void
+	clear(s.unconfirmed)
+	s.sent, s.confirmed, s.peerAck = 0, 0, nil
+
+	s.isInitiator = isInitiator
 	s.aesKey = aesKey
 	s.ratchet = ratchet
 	s.established = true
@@ -84,79 +318,208 @@ func (s *Session) SetPeerPublicKey(base64Key string) error {
 	return nil
 }
 
-// Encrypt encrypts a plaintext message and returns formatted ciphertext
+// Encrypt encrypts a text message and returns formatted ciphertext
 // Each message uses a unique key (forward secrecy)
-// Format: "msgNum base64_ciphertext" (e.g., "0 abc123...")
+// Format: "msgNum ciphertext" (e.g., "0 abc123..."), ciphertext in the selected encoding
 func (s *Session) Encrypt(plaintext string) (string, error) {
-	if !s.established {
-		return "", fmt.Errorf("session not established: please import peer's public key first")
+	m := &Message{Text: plaintext}
+	ciphertext, err := s.encryptMessage(m)
+	if err != nil {
+		return "", err
 	}
 
-	// Get next message key from ratchet
-	msgKey, msgNum, err := s.ratchet.NextSendKey()
+	// Format: "msgNum encoded_ciphertext"
+	line := fmt.Sprintf("%d %s", m.Num, s.encoding.Encode(ciphertext))
+	s.trackSent(m, []string{line})
+	return line, nil
+}
+
+// EncryptMessage encrypts m and fills in its number and send time
+// A zero TTL uses the session default. The result is split into lines of at
+// most the configured part size ("msgNum/part/total ciphertext"); a message
+// that already fits is returned as a single regular line
+func (s *Session) EncryptMessage(m *Message) ([]string, error) {
+	ciphertext, err := s.encryptMessage(m)
 	if err != nil {
-		return "", fmt.Errorf("failed to get message key: %w", err)
+		return nil, err
+	}
+
+	lines := []string{fmt.Sprintf("%d %s", m.Num, s.encoding.Encode(ciphertext))}
+	if s.partSize != 0 && len(lines[0]) > s.partSize {
+		if lines, err = chunk.Split(m.Num, ciphertext, s.encoding, s.partSize); err != nil {
+			return nil, err
+		}
+	}
+	s.trackSent(m, lines)
+	return lines, nil
+}
+
+// encryptMessage pads and encrypts m with the next message key
+func (s *Session) encryptMessage(m *Message) ([]byte, error) {
+	if err := s.checkEstablished(); err != nil {
+		return nil, err
+	}
+
+	if m.TTL == 0 {
+		m.TTL = s.ttl
 	}
+	m.SentAt = s.clock.Now()
 
-	// Encrypt with the unique message key
-	ciphertext, err := crypto.Encrypt([]byte(plaintext), msgKey)
+	payload, err := encodePayload(m, s.compress && s.caps&CapCompression != 0)
 	if err != nil {
-		return "", fmt.Errorf("encryption failed: %w", err)
+		return nil, err
 	}
 
-	// Clear message key from memory (best effort)
-	for i := range msgKey {
-		msgKey[i] = 0
+	// Pad inside the ciphertext so the length is hidden and authenticated
+	padded := crypto.Pad(payload, s.padding, s.minBucket)
+
+	// Version byte, nonce and sealed message go into one buffer
+	out := make([]byte, 1, 1+crypto.NonceSize+len(padded)+crypto.Overhead)
+	out[0] = s.version
+	nonce := make([]byte, crypto.NonceSize)
+	if _, err := io.ReadFull(s.rand, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
-	// Format: "msgNum base64_ciphertext"
-	return fmt.Sprintf("%d %s", msgNum, base64.StdEncoding.EncodeToString(ciphertext)), nil
+	// Encrypt with the next message key, which the ratchet wipes afterwards
+	var sealErr error
+	err = s.ratchet.UseSendKey(func(key []byte, msgNum uint32) error {
+		out, sealErr = crypto.Seal(out, key, nonce, padded, out[:1])
+		m.Num = msgNum
+		return sealErr
+	})
+	if sealErr != nil {
+		return nil, fmt.Errorf("encryption failed: %w", sealErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message key: %w", err)
+	}
+	return out, nil
 }
 
-// Decrypt decrypts a formatted ciphertext and returns the plaintext
-// Format: "msgNum base64_ciphertext" (e.g., "0 abc123...")
+// Decrypt decrypts a formatted text message and returns the plaintext
+// Format: "msgNum ciphertext" (e.g., "0 abc123..."), encoding auto-detected
+// Other message types are an error; use DecryptMessage to receive them
 func (s *Session) Decrypt(input string) (string, error) {
-	if !s.established {
-		return "", fmt.Errorf("session not established: please import peer's public key first")
+	m, err := s.DecryptMessage(input)
+	if err != nil {
+		return "", err
 	}
+	if m.Type != TypeText {
+		return "", fmt.Errorf("message %d is a %s message, not text", m.Num, m.Type)
+	}
+	return m.Text, nil
+}
 
-	// Parse "msgNum base64_ciphertext"
+// DecryptMessage decrypts a formatted ciphertext and returns the typed
+// message with its authenticated send time and TTL
+func (s *Session) DecryptMessage(input string) (*Message, error) {
+	if err := s.checkEstablished(); err != nil {
+		return nil, err
+	}
+
+	// Parse "msgNum ciphertext"
 	parts := strings.SplitN(input, " ", 2)
 	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid format: expected 'msgNum base64_ciphertext'")
+		return nil, fmt.Errorf("%w: expected 'msgNum ciphertext'", ErrInvalidMessage)
 	}
 
 	msgNum, err := strconv.ParseUint(parts[0], 10, 32)
 	if err != nil {
-		return "", fmt.Errorf("invalid message number: %w", err)
+		return nil, fmt.Errorf("%w number: %w", ErrInvalidMessage, err)
+	}
+
+	ciphertext, err := codec.Decode(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	return s.decryptMessage(uint32(msgNum), ciphertext)
+}
+
+// DecryptPart collects one part of a fragmented message ("msgNum/part/total ciphertext")
+// The message is returned once all parts have arrived; until then it is nil
+// and the status lists the missing parts
+func (s *Session) DecryptPart(input string) (*Message, chunk.Status, error) {
+	if err := s.checkEstablished(); err != nil {
+		return nil, chunk.Status{}, err
 	}
 
-	ciphertext, err := base64.StdEncoding.DecodeString(parts[1])
+	part, err := chunk.Parse(input)
 	if err != nil {
-		return "", fmt.Errorf("invalid Base64 encoding: %w", err)
+		return nil, chunk.Status{}, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	// A late copy of a part must not start collecting the message again
+	if s.ratchet.Received(part.MsgNum) {
+		return nil, chunk.Status{}, fmt.Errorf("message %d %w", part.MsgNum, crypto.ErrAlreadyReceived)
+	}
+
+	ciphertext, status := s.assembler.Add(part)
+	if !status.Complete() {
+		return nil, status, nil
 	}
 
-	// Get the message key for this message number
-	msgKey, err := s.ratchet.GetRecvKey(uint32(msgNum))
+	m, err := s.decryptMessage(part.MsgNum, ciphertext)
+	return m, status, err
+}
+
+// PendingParts returns the fragmented messages that are still incomplete
+func (s *Session) PendingParts() []chunk.Status {
+	return s.assembler.Pending()
+}
+
+// decryptMessage decrypts a ciphertext with the key for msgNum, strips
+// padding and applies the expiry policy
+func (s *Session) decryptMessage(msgNum uint32, ciphertext []byte) (*Message, error) {
+	// The version byte must be the one negotiated for the session
+	if len(ciphertext) == 0 {
+		return nil, fmt.Errorf("%w: empty ciphertext", ErrDecryption)
+	}
+	if v := ciphertext[0]; v != s.version {
+		if v < MinProtocolVersion || v > ProtocolVersion {
+			return nil, unsupportedVersion(v)
+		}
+		return nil, fmt.Errorf("message uses protocol v%d, but the session uses v%d", v, s.version)
+	}
+	header, ciphertext := ciphertext[:1], ciphertext[1:]
+
+	// Decrypt with the message key for this number; the ratchet only moves
+	// on if decryption succeeds
+	var padded []byte
+	var decryptErr error
+	err := s.ratchet.OpenRecvKey(msgNum, func(key []byte) error {
+		padded, decryptErr = crypto.Open(nil, key, ciphertext, header)
+		return decryptErr
+	})
+	if decryptErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryption, decryptErr)
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to get message key: %w", err)
+		return nil, fmt.Errorf("failed to get message key: %w", err)
 	}
 
-	// Decrypt with the message key
-	plaintext, err := crypto.Decrypt(ciphertext, msgKey)
+	data, err := crypto.Unpad(padded)
 	if err != nil {
-		return "", fmt.Errorf("decryption failed: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrDecryption, err)
 	}
 
-	// Clear message key from memory (best effort)
-	for i := range msgKey {
-		msgKey[i] = 0
+	m, err := decodePayload(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
 	}
 
 	// Store last received message number
-	s.lastRecvMsgNum = uint32(msgNum)
+	s.lastRecvMsgNum = msgNum
 
-	return string(plaintext), nil
+	m.Num = msgNum
+	if m.Type == TypeAck {
+		s.applyAck(m.Ack)
+	}
+	if s.expiry == ExpiryRefuse && m.Expired(s.clock.Now()) {
+		return nil, fmt.Errorf("%w at %s", ErrExpired, m.ExpiresAt().Format(time.DateTime))
+	}
+	return m, nil
 }
 
 // GetLastRecvMsgNum returns the last successfully received message number
@@ -174,7 +537,7 @@ func (s *Session) GetPeerPublicKeyBase64() string {
 	if s.peerPubKey == nil {
 		return ""
 	}
-	return base64.StdEncoding.EncodeToString(s.peerPubKey)
+	return EncodeKey(s.peerHello.prefix(s.peerPubKey))
 }
 
 // GetVerificationWords returns 5 words derived from the shared secret
@@ -183,7 +546,7 @@ func (s *Session) GetVerificationWords() []string {
 	if !s.established || s.aesKey == nil {
 		return nil
 	}
-	return crypto.GenerateVerificationWords(s.aesKey)
+	return crypto.GenerateVerificationWords(s.aesKey.Bytes())
 }
 
 // GetMessageStats returns the current send/receive message counts
@@ -193,3 +556,35 @@ func (s *Session) GetMessageStats() (send, recv uint32) {
 	}
 	return s.ratchet.GetSendMsgNum(), s.ratchet.GetRecvMsgNum()
 }
+
+// checkEstablished returns an error unless the session can encrypt and decrypt
+func (s *Session) checkEstablished() error {
+	if s.closed {
+		return ErrClosed
+	}
+	if !s.established {
+		return fmt.Errorf("%w: please import peer's public key first", ErrNotEstablished)
+	}
+	return nil
+}
+
+// Close wipes the private key, the shared keys and all ratchet state, and
+// forgets incomplete and unconfirmed messages. The session cannot be used
+// afterwards; Close is safe to call more than once
+func (s *Session) Close() {
+	s.privateKey.Destroy()
+	s.aesKey.Destroy()
+	s.identityKey.Destroy()
+	s.pakeSecret.Destroy()
+	s.CancelPAKE()
+	if s.ratchet != nil {
+		s.ratchet.Close()
+	}
+	s.aesKey = nil
+	s.peerPubKey = nil
+	s.established = false
+	s.closed = true
+	s.assembler = chunk.NewAssembler()
+	clear(s.unconfirmed)
+	s.peerAck = nil
+}
@@ -0,0 +1,128 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Public keys and PAKE messages start with a hello that tells which
+// protocol versions and capabilities the sender supports:
+//
+//	magic 0xE2 | lowest version | highest version | capabilities | key
+//
+// When a peer's key is imported, the highest version both sides support is
+// chosen, along with the capabilities both have. Every message ciphertext
+// then starts with that version byte, so a peer that moves on to a newer
+// format gets a clear error instead of failed decryptions. Both hellos are
+// bound into the channel keys and the version byte is authenticated as
+// associated data, so neither can be altered unnoticed.
+//
+// Keys without a hello come from protocol v0 (e2e-message v0.1.x), whose
+// unpadded messages are not supported
+
+const (
+	// ProtocolVersion is the highest protocol version this build speaks
+	ProtocolVersion = 1
+	// MinProtocolVersion is the lowest protocol version this build speaks
+	MinProtocolVersion = 1
+
+	helloMagic = 0xE2
+	helloSize  = 4
+)
+
+// Capabilities are optional features a peer announces in its hello
+type Capabilities uint8
+
+const (
+	CapCompression Capabilities = 1 << iota // Decompresses DEFLATE payloads
+)
+
+// supportedCaps are the capabilities of this build
+const supportedCaps = CapCompression
+
+var capNames = []string{"compression"}
+
+// Names returns the names of the capabilities, e.g. ["compression"]
+func (c Capabilities) Names() []string {
+	names := []string{}
+	for i, name := range capNames {
+		if c&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// String lists the capabilities, e.g. "compression", or "none"
+func (c Capabilities) String() string {
+	if names := c.Names(); len(names) > 0 {
+		return strings.Join(names, ", ")
+	}
+	return "none"
+}
+
+// ErrUnsupportedProtocol is returned for keys and messages of a protocol
+// version this build does not speak
+var ErrUnsupportedProtocol = errors.New("peer uses unsupported protocol")
+
+// hello is the version and capability prefix of a key
+type hello struct {
+	min, max uint8
+	caps     Capabilities
+}
+
+// ourHello returns the hello this build sends
+func ourHello() hello {
+	return hello{min: MinProtocolVersion, max: ProtocolVersion, caps: supportedCaps}
+}
+
+// prefix returns the hello followed by key
+func (h hello) prefix(key []byte) []byte {
+	return append([]byte{helloMagic, h.min, h.max, byte(h.caps)}, key...)
+}
+
+// helloTranscript returns the initiator's hello followed by the responder's,
+// the same on both sides
+func helloTranscript(ours, peer hello, isInitiator bool) []byte {
+	if isInitiator {
+		return ours.prefix(peer.prefix(nil))
+	}
+	return peer.prefix(ours.prefix(nil))
+}
+
+// parseHello splits a hello off a key
+func parseHello(data []byte) (hello, []byte, error) {
+	if len(data) < helloSize || data[0] != helloMagic {
+		return hello{}, nil, fmt.Errorf("%w v0 (keys without a version, from e2e-message v0.1.x)", ErrUnsupportedProtocol)
+	}
+	h := hello{min: data[1], max: data[2], caps: Capabilities(data[3])}
+	if h.min == 0 || h.min > h.max {
+		return hello{}, nil, fmt.Errorf("invalid protocol versions v%d to v%d", h.min, h.max)
+	}
+	return h, data[helloSize:], nil
+}
+
+// negotiate returns the highest version both hellos support and the
+// capabilities both have
+func negotiate(ours, peer hello) (uint8, Capabilities, error) {
+	version := min(ours.max, peer.max)
+	if version < max(ours.min, peer.min) {
+		if peer.min > ours.max {
+			return 0, 0, unsupportedVersion(peer.min)
+		}
+		return 0, 0, unsupportedVersion(peer.max)
+	}
+	return version, ours.caps & peer.caps, nil
+}
+
+// unsupportedVersion returns the error for a peer's protocol version
+func unsupportedVersion(v uint8) error {
+	return fmt.Errorf("%w v%d (this version supports v%d to v%d)", ErrUnsupportedProtocol, v, MinProtocolVersion, ProtocolVersion)
+}
+
+// GetProtocol returns the negotiated protocol version and common
+// capabilities, or zero before the channel is established
+func (s *Session) GetProtocol() (version int, caps Capabilities) {
+	return int(s.version), s.caps
+}
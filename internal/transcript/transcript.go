@@ -0,0 +1,381 @@
+// Package transcript keeps an encrypted, searchable record of a conversation.
+//
+// File layout:
+//
+//	magic "E2ET" | version (1 byte) | salt (16 bytes) |
+//	duress salt (16 bytes) | duress check (28 bytes) | AES-256-GCM(JSON entries)
+//
+// The key is derived from a passphrase with scrypt. The duress check is an
+// empty AES-GCM message under a key derived from the duress passphrase; it
+// is random bytes when no duress passphrase is set, so the file does not
+// reveal whether one exists. The whole file is rewritten on every change,
+// through a temporary file and a rename.
+//
+// Version 1 files have no duress fields; Open upgrades them to version 2.
+package transcript
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"e2e-message/internal/crypto"
+)
+
+const (
+	magic   = "E2ET"
+	version = 2
+
+	duressCheckSize = 12 + 16 // AES-GCM nonce and tag of an empty message
+	headerSize      = len(magic) + 1 + 2*crypto.SaltSize + duressCheckSize
+	v1HeaderSize    = len(magic) + 1 + crypto.SaltSize
+)
+
+var (
+	// ErrWrongPassphrase is returned when a transcript cannot be decrypted
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted transcript")
+
+	// ErrDuress is returned by Open when the duress passphrase was entered
+	ErrDuress = errors.New("duress passphrase entered")
+)
+
+// Direction tells whether a message was sent or received
+type Direction int
+
+const (
+	Sent Direction = iota
+	Received
+)
+
+// String returns "sent" or "received"
+func (d Direction) String() string {
+	if d == Received {
+		return "received"
+	}
+	return "sent"
+}
+
+// Entry is one message in the transcript
+type Entry struct {
+	Direction Direction `json:"dir"`
+	Num       uint32    `json:"num"`
+	Time      time.Time `json:"time"`             // Send time
+	ExpiresAt time.Time `json:"expires,omitzero"` // Zero if the message never expires
+	Text      string    `json:"text"`
+}
+
+// Expired reports whether the entry has expired at the given time
+func (e Entry) Expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// String formats the entry as "2006-01-02 15:04:05 > #3 text"
+// ('>' for sent, '<' for received)
+func (e Entry) String() string {
+	arrow := ">"
+	if e.Direction == Received {
+		arrow = "<"
+	}
+	return fmt.Sprintf("%s %s #%d %s", e.Time.Local().Format(time.DateTime), arrow, e.Num, e.Text)
+}
+
+// Transcript is an open transcript file
+type Transcript struct {
+	path        string
+	salt        []byte
+	key         *crypto.Secret
+	duressSalt  []byte
+	duressCheck []byte
+	entries     []Entry
+}
+
+// Create creates a new, empty transcript file; it fails if the file exists
+func Create(path, passphrase string) (*Transcript, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("transcript %s already exists", path)
+	}
+
+	salt, err := crypto.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.DeriveKeyFromPassphrase(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Transcript{path: path, salt: salt, key: key}
+	if err := t.clearDuress(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	if err := t.save(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Open decrypts an existing transcript file and purges expired messages;
+// it returns ErrDuress if the duress passphrase was entered instead
+func Open(path, passphrase string) (*Transcript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transcript: %w", err)
+	}
+
+	if len(data) < len(magic)+1 || string(data[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%s is not a transcript file", path)
+	}
+	var salt, duressSalt, duressCheck, ciphertext []byte
+	switch v := data[len(magic)]; v {
+	case version:
+		if len(data) < headerSize {
+			return nil, fmt.Errorf("%s is not a transcript file", path)
+		}
+		header := data[len(magic)+1 : headerSize]
+		salt = header[:crypto.SaltSize]
+		duressSalt = header[crypto.SaltSize : 2*crypto.SaltSize]
+		duressCheck = header[2*crypto.SaltSize:]
+		ciphertext = data[headerSize:]
+	case 1:
+		if len(data) < v1HeaderSize {
+			return nil, fmt.Errorf("%s is not a transcript file", path)
+		}
+		salt = data[len(magic)+1 : v1HeaderSize]
+		ciphertext = data[v1HeaderSize:]
+	default:
+		return nil, fmt.Errorf("unsupported transcript version %d", v)
+	}
+
+	key, err := crypto.DeriveKeyFromPassphrase(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	// Both keys are derived and both checks made on every open, so a duress
+	// unlock takes as long as a real one
+	duress, err := isDuress(passphrase, duressSalt, duressCheck)
+	if err != nil {
+		key.Destroy()
+		return nil, err
+	}
+	plaintext, err := crypto.Decrypt(ciphertext, key.Bytes())
+	if err != nil {
+		key.Destroy()
+		if duress {
+			return nil, ErrDuress
+		}
+		return nil, ErrWrongPassphrase
+	}
+	defer crypto.Wipe(plaintext)
+
+	t := &Transcript{path: path, salt: salt, key: key, duressSalt: duressSalt, duressCheck: duressCheck}
+	if err := json.Unmarshal(plaintext, &t.entries); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("invalid transcript contents: %w", err)
+	}
+	if duressSalt == nil {
+		// Upgrade a version 1 file, which has no duress fields
+		if err := t.clearDuress(); err != nil {
+			t.Close()
+			return nil, err
+		}
+		if err := t.save(); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	if _, err := t.Purge(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// isDuress reports whether passphrase opens the duress check; a version 1
+// file has neither salt nor check, and costs the same to test
+func isDuress(passphrase string, salt, check []byte) (bool, error) {
+	if salt == nil {
+		salt, check = make([]byte, crypto.SaltSize), make([]byte, duressCheckSize)
+	}
+	key, err := crypto.DeriveKeyFromPassphrase(passphrase, salt)
+	if err != nil {
+		return false, err
+	}
+	defer key.Destroy()
+	_, err = crypto.Decrypt(check, key.Bytes())
+	return err == nil, nil
+}
+
+// SetDuressPassphrase sets a second passphrase that makes Open return
+// ErrDuress instead of the transcript; an empty passphrase removes it
+func (t *Transcript) SetDuressPassphrase(passphrase string) error {
+	if passphrase == "" {
+		if err := t.clearDuress(); err != nil {
+			return err
+		}
+		return t.save()
+	}
+
+	// The duress passphrase must not also open the transcript
+	same, err := crypto.DeriveKeyFromPassphrase(passphrase, t.salt)
+	if err != nil {
+		return err
+	}
+	equal := subtle.ConstantTimeCompare(same.Bytes(), t.key.Bytes()) == 1
+	same.Destroy()
+	if equal {
+		return fmt.Errorf("duress passphrase must differ from the transcript passphrase")
+	}
+
+	salt, err := crypto.NewSalt()
+	if err != nil {
+		return err
+	}
+	key, err := crypto.DeriveKeyFromPassphrase(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	check, err := crypto.Encrypt(nil, key.Bytes())
+	key.Destroy()
+	if err != nil {
+		return err
+	}
+	t.duressSalt, t.duressCheck = salt, check
+	return t.save()
+}
+
+// clearDuress fills the duress fields with random bytes
+func (t *Transcript) clearDuress() error {
+	fields := make([]byte, crypto.SaltSize+duressCheckSize)
+	if _, err := rand.Read(fields); err != nil {
+		return fmt.Errorf("failed to generate random data: %w", err)
+	}
+	t.duressSalt, t.duressCheck = fields[:crypto.SaltSize], fields[crypto.SaltSize:]
+	return nil
+}
+
+// Path returns the transcript file path
+func (t *Transcript) Path() string {
+	return t.path
+}
+
+// Add appends an entry and saves the transcript
+func (t *Transcript) Add(e Entry) error {
+	t.entries = append(t.entries, e)
+	t.removeExpired(time.Now())
+	return t.save()
+}
+
+// Purge removes expired messages and saves the transcript if any were removed
+func (t *Transcript) Purge() (int, error) {
+	n := t.removeExpired(time.Now())
+	if n == 0 {
+		return 0, nil
+	}
+	return n, t.save()
+}
+
+// Entries returns the unexpired entries in the order they were added
+func (t *Transcript) Entries() []Entry {
+	now := time.Now()
+	var out []Entry
+	for _, e := range t.entries {
+		if !e.Expired(now) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Search returns the unexpired entries whose text contains term, ignoring case
+func (t *Transcript) Search(term string) []Entry {
+	term = strings.ToLower(term)
+	var out []Entry
+	for _, e := range t.Entries() {
+		if strings.Contains(strings.ToLower(e.Text), term) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Export writes the unexpired entries as plain text, one per line
+func (t *Transcript) Export(w io.Writer) error {
+	for _, e := range t.Entries() {
+		if _, err := fmt.Fprintln(w, e.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close destroys the key and forgets the decrypted entries
+func (t *Transcript) Close() {
+	t.key.Destroy()
+	t.key = nil
+	t.entries = nil
+}
+
+func (t *Transcript) removeExpired(now time.Time) int {
+	kept := t.entries[:0]
+	for _, e := range t.entries {
+		if !e.Expired(now) {
+			kept = append(kept, e)
+		}
+	}
+	removed := len(t.entries) - len(kept)
+	clear(t.entries[len(kept):])
+	t.entries = kept
+	return removed
+}
+
+// save encrypts the entries and atomically replaces the file
+func (t *Transcript) save() error {
+	if t.key == nil {
+		return fmt.Errorf("transcript is closed")
+	}
+
+	plaintext, err := json.Marshal(t.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode transcript: %w", err)
+	}
+	defer crypto.Wipe(plaintext)
+	ciphertext, err := crypto.Encrypt(plaintext, t.key.Bytes())
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(version)
+	buf.Write(t.salt)
+	buf.Write(t.duressSalt)
+	buf.Write(t.duressCheck)
+	buf.Write(ciphertext)
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), ".transcript-*")
+	if err != nil {
+		return fmt.Errorf("failed to save transcript: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save transcript: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save transcript: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		return fmt.Errorf("failed to save transcript: %w", err)
+	}
+	return nil
+}
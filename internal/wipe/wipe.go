@@ -0,0 +1,56 @@
+// Package wipe securely deletes files.
+//
+// A file is overwritten with random data and synced before it is renamed
+// to a random name and removed, so neither its contents nor its name stay
+// in place on disk. This is best effort: SSDs, journaling and copy-on-write
+// filesystems, snapshots and backups may still keep older copies.
+package wipe
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// File securely deletes the file at path; a missing file is not an error
+func File(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	info, err := f.Stat()
+	if err == nil {
+		_, err = io.CopyN(f, rand.Reader, info.Size())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to overwrite %s: %w", path, err)
+	}
+
+	// Hide the original name before unlinking
+	name := make([]byte, 8)
+	if _, err := rand.Read(name); err == nil {
+		hidden := filepath.Join(filepath.Dir(path), "."+hex.EncodeToString(name))
+		if os.Rename(path, hidden) == nil {
+			path = hidden
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return nil
+}
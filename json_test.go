@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"e2e-message/internal/codec"
+	"e2e-message/internal/session"
+)
+
+// captureJSON runs fn in --json mode and returns the objects it printed
+func captureJSON(t *testing.T, fn func()) []map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	jsonOutput, jsonOut = true, &buf
+	defer func() { jsonOutput, jsonOut = false, os.Stdout }()
+	fn()
+
+	var objects []map[string]any
+	for _, l := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(l), &obj); err != nil {
+			t.Fatalf("Output line %q is not a JSON object: %v", l, err)
+		}
+		objects = append(objects, obj)
+	}
+	return objects
+}
+
+func TestErrorCodes(t *testing.T) {
+	clock := newFakeClock()
+	alice, bob := establishedPair(t, session.WithClock(clock))
+	lone, _ := newSessions(t)
+	line, _ := alice.Encrypt("hi")
+	expiring, _ := alice.EncryptMessage(&session.Message{Text: "soon gone", TTL: time.Minute})
+	num, encoded, _ := strings.Cut(expiring[0], " ")
+	ct, _ := codec.Decode(encoded)
+	ct[len(ct)-1] ^= 1
+	forged := num + " " + base64.StdEncoding.EncodeToString(ct)
+	if _, err := bob.Decrypt(line); err != nil {
+		t.Fatal(err)
+	}
+
+	decrypt := func(line string) error {
+		_, err := bob.Decrypt(line)
+		return err
+	}
+	tests := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{"replay", decrypt(line), "already_received"},
+		{"forged", decrypt(forged), "decryption_failed"},
+		{"garbage", decrypt("5 !!!"), "invalid_message"},
+		{"no number", decrypt("hello"), "invalid_message"},
+		{"bad part", decrypt("1/3/2 abc"), "invalid_message"},
+		{"skip too far", decrypt("5000 " + encoded), "too_many_skipped"},
+		{"not established", func() error { _, err := lone.Encrypt("hi"); return err }(), "not_established"},
+		{"invalid key", lone.SetPeerPublicKey("!!!"), "invalid_key"},
+		{"expired", func() error { clock.Advance(time.Hour); return decrypt(expiring[0]) }(), "expired"},
+		{"no transcript", fmt.Errorf("history: %w", errNoTranscript), "no_transcript"},
+		{"missing file", func() error { _, err := os.ReadFile("testdata/missing"); return err }(), "not_found"},
+		{"other", fmt.Errorf("something else"), "error"},
+	}
+	for _, tt := range tests {
+		if got := errorCode(tt.err); got != tt.code {
+			t.Errorf("%s: errorCode(%v) = %q, want %q", tt.name, tt.err, got, tt.code)
+		}
+	}
+}
+
+func TestJSONMessage(t *testing.T) {
+	clock := newFakeClock()
+	alice, bob := establishedPair(t, session.WithClock(clock))
+	lines, err := alice.EncryptMessage(&session.Message{Text: "hi <there>", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := bob.DecryptMessage(lines[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writeJSON(&buf, newMessageJSON(msg, clock.Now().Add(2*time.Hour)))
+	want := `{"type":"message","num":0,"kind":"text","text":"hi <there>",` +
+		`"sent_at":"2024-01-02T03:04:05Z","expires_at":"2024-01-02T04:04:05Z","expired":true}` + "\n"
+	if buf.String() != want {
+		t.Errorf("Message object:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	objects := captureJSON(t, func() {
+		handleEncrypt(alice, "hello")
+		handleEncrypt(alice, "")
+		handleStatus(alice)
+	})
+	if len(objects) != 3 {
+		t.Fatalf("Got %d objects, want 3: %v", len(objects), objects)
+	}
+	ct := objects[0]
+	if ct["type"] != "ciphertext" || ct["num"] != 0.0 || ct["kind"] != "text" {
+		t.Errorf("Ciphertext object = %v", ct)
+	}
+	if objects[1]["type"] != "error" || objects[1]["code"] != "usage" {
+		t.Errorf("Usage error object = %v", objects[1])
+	}
+	status := objects[2]
+	if status["type"] != "status" || status["established"] != true || status["sent"] != 1.0 {
+		t.Errorf("Status object = %v", status)
+	}
+	if words := status["verification_words"].([]any); len(words) != 5 {
+		t.Errorf("Status verification words = %v", words)
+	}
+
+	// The ciphertext lines are what the peer pastes
+	line := ct["lines"].([]any)[0].(string)
+	objects = captureJSON(t, func() {
+		handleDecrypt(bob, line)
+		handleDecrypt(bob, line)
+	})
+	if objects[0]["type"] != "message" || objects[0]["text"] != "hello" {
+		t.Errorf("Message object = %v", objects[0])
+	}
+	if objects[1]["type"] != "error" || objects[1]["code"] != "already_received" {
+		t.Errorf("Replay error object = %v", objects[1])
+	}
+}
+
+// TestJSONEmptyLists checks that lists are written as [] rather than null
+func TestJSONEmptyLists(t *testing.T) {
+	_, bob := establishedPair(t)
+	res, err := bob.DecryptBatch(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writeJSON(&buf, newBatchJSON(res, time.Now()))
+	var batch map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &batch); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"messages", "duplicates", "failed", "invalid", "missing", "incomplete"} {
+		if !reflect.DeepEqual(batch[key], []any{}) {
+			t.Errorf("Batch %s = %v, want []", key, batch[key])
+		}
+	}
+}
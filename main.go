@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"flag"
 	"fmt"
+	"image/png"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -10,42 +19,92 @@ import (
 
 	"github.com/peterh/liner"
 
+	"e2e-message/internal/age"
+	"e2e-message/internal/chunk"
+	"e2e-message/internal/codec"
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/identity"
+	"e2e-message/internal/qr"
 	"e2e-message/internal/session"
+	"e2e-message/internal/transcript"
+	"e2e-message/internal/wipe"
 )
 
 var (
 	line         *liner.State
 	ctrlCPressed atomic.Bool
+	transcriptDB *transcript.Transcript // Open transcript, nil when not recording
+	historyMode  historyPolicy          // Which input lines are kept in the history
+	panicWipe    bool                   // Wipe everything on a double Ctrl+C
+	ident        *identity.Identity     // Identity key, loaded on first use
+	identityPath string                 // --identity file, "" for the one in the data directory
+	deniable     bool                   // --deniable: authenticate with a triple-DH handshake
+)
+
+// Files in the data directory
+const (
+	identityFile   = "identity.pem"
+	knownPeersFile = "known_peers"
 )
 
 func main() {
-	// Create a new session
-	sess, err := session.NewSession()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to initialize session: %v\n", err)
-		os.Exit(1)
+	flags := flag.NewFlagSet("e2e-message", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&identityPath, "identity", "", "identity file")
+	flags.BoolVar(&deniable, "deniable", false, "deniable authentication")
+	flags.BoolVar(&jsonOutput, "json", false, "JSON output")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(runCommand([]string{"help"}, os.Stdin, os.Stdout))
+		}
+		if jsonOutput {
+			emit(newErrorJSON("usage", fmt.Sprintf("%v\n%s", err, commandUsage)))
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %v\n%s\n", err, commandUsage)
+		}
+		os.Exit(2)
+	}
+
+	// Non-interactive modes
+	if flags.NArg() > 0 {
+		os.Exit(runCommand(flags.Args(), os.Stdin, os.Stdout))
 	}
 
 	// Setup liner for proper UTF-8 input handling
 	line = liner.NewLiner()
 	defer line.Close()
+	defer closeTranscript()
+	defer closeIdentity()
 
 	// Let liner handle Ctrl+C
 	line.SetCtrlCAborts(true)
 
+	// Create a new session; a duress unlock replaces it, so the one current
+	// at exit is closed
+	sess, err := newSession()
+	if err != nil {
+		fatal("Failed to initialize session", err)
+	}
+	defer func() { sess.Close() }()
+
 	// Display welcome message and public key
-	fmt.Println("=== E2E Message - End-to-End Encryption Tool ===")
-	fmt.Println()
-	fmt.Println("Your public key (share this with your peer):")
-	fmt.Println(sess.GetPublicKeyBase64())
-	fmt.Println()
-	fmt.Println("Type 'help' for available commands.")
-	fmt.Println()
+	if jsonOutput {
+		ready := readyJSON{Type: "ready", PublicKey: sess.GetPublicKeyBase64(), Deniable: deniable}
+		if ident != nil {
+			ready.Identity = identity.SSHPublicKey(ident.PublicKey())
+		}
+		emit(ready)
+	} else {
+		printWelcome(sess)
+	}
 
 	// Start interactive loop
 	for {
 		prompt := "> "
-		if sess.IsEstablished() {
+		if jsonOutput {
+			// Only JSON objects go to stdout
+			prompt = ""
+		} else if sess.IsEstablished() {
 			_, recv := sess.GetMessageStats()
 			if recv > 0 {
 				prompt = fmt.Sprintf("[#%d] > ", sess.GetLastRecvMsgNum())
@@ -55,12 +114,20 @@ func main() {
 		if err != nil {
 			if err == liner.ErrPromptAborted {
 				// Ctrl+C pressed
-				if handleCtrlC() {
+				if handleCtrlC(sess) {
 					return
 				}
 				continue
 			}
-			// Ignore other errors (EOF etc)
+			// Piped input ends at EOF; on a terminal, ignore it (Ctrl+D etc)
+			if err == io.EOF && stdinPiped() {
+				return
+			}
+			// Line editing needs a terminal for both input and output
+			if err == liner.ErrNotTerminalOutput {
+				printError(fmt.Errorf("%w: pipe the commands in, or run in a terminal", err))
+				return
+			}
 			continue
 		}
 
@@ -69,8 +136,20 @@ func main() {
 			continue
 		}
 
-		// Add to history
-		line.AppendHistory(input)
+		// Add to history, keeping plaintext out of it
+		recordHistory(input)
+
+		// A pasted signed message
+		if input == identity.BeginMessage {
+			handleVerify(input)
+			continue
+		}
+
+		// Parts of a fragmented message ("msgNum/part/total ...")
+		if chunk.IsPart(input) {
+			handleDecrypt(sess, input)
+			continue
+		}
 
 		// Check if input starts with number + space (auto-decrypt)
 		if startsWithNumberSpace(input) {
@@ -89,23 +168,187 @@ func main() {
 		switch cmd {
 		case "key":
 			handleKey(sess, arg)
+		case "pake":
+			handlePAKE(sess, arg)
 		case "e":
 			handleEncrypt(sess, arg)
 		case "d":
 			handleDecrypt(sess, arg)
+		case "batch":
+			handleBatch(sess, arg)
+		case "ack":
+			handleAck(sess)
+		case "resend":
+			handleResend(sess, arg)
+		case "transcript":
+			sess = handleTranscript(sess, arg)
+		case "history":
+			handleHistory(arg)
+		case "export":
+			handleExport(arg)
+		case "identity":
+			handleIdentity()
+		case "sign":
+			handleSign(arg)
+		case "verify":
+			handleVerify(arg)
+		case "peers":
+			handlePeers(arg)
+		case "qr":
+			handleQR(sess, arg)
+		case "set":
+			handleSet(sess, arg)
 		case "status":
 			handleStatus(sess)
+		case "wipe":
+			if handleWipe(sess, arg) {
+				return
+			}
+		case "clear-history":
+			line.ClearHistory()
+			printNote("ok", "Command history cleared.")
 		case "help":
 			handleHelp()
 		case "quit", "exit", "q":
-			if confirmExit() {
-				fmt.Println("Goodbye!")
+			// Programs driving --json mode mean it; people get asked
+			if jsonOutput || confirmExit() {
+				printGoodbye(false)
 				return
 			}
 		default:
-			fmt.Printf("Unknown command: %s. Type 'help' for available commands.\n", cmd)
+			if jsonOutput {
+				emit(newErrorJSON("unknown_command", fmt.Sprintf("unknown command: %s", cmd)))
+			} else {
+				fmt.Printf("Unknown command: %s. Type 'help' for available commands.\n", cmd)
+			}
+		}
+	}
+}
+
+// fatal reports an error that keeps the REPL from starting and exits
+func fatal(msg string, err error) {
+	if jsonOutput {
+		emit(newErrorJSON(errorCode(err), fmt.Sprintf("%s: %v", msg, err)))
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", msg, err)
+	}
+	os.Exit(1)
+}
+
+// printWelcome shows the public key and how to start
+func printWelcome(sess *session.Session) {
+	fmt.Println("=== E2E Message - End-to-End Encryption Tool ===")
+	fmt.Println()
+	fmt.Println("Your public key (share this with your peer):")
+	fmt.Println(sess.GetPublicKeyBase64())
+	fmt.Println()
+	if ident != nil {
+		fmt.Println("Your identity (peers pin it with: key <identity>):")
+		fmt.Println(identity.SSHPublicKey(ident.PublicKey()))
+		fmt.Println()
+	}
+	if deniable {
+		fmt.Println("Deniable mode: pin your peer's identity (key <ssh-ed25519 ...>), then import")
+		fmt.Println("their session key. Your peer must also run with --deniable.")
+		fmt.Println()
+	}
+	fmt.Println("Type 'help' for available commands.")
+	fmt.Println()
+}
+
+// historyPolicy controls which input lines are kept in the line-editing history
+type historyPolicy int
+
+const (
+	historySkip     historyPolicy = iota // Record lines except those with plaintext
+	historyRedact                        // Record all lines with plaintext replaced
+	historyCommands                      // Record command names only, without arguments
+	historyOff                           // Record nothing
+)
+
+var historyPolicyNames = []string{"skip", "redact", "commands", "off"}
+
+func (p historyPolicy) String() string {
+	return historyPolicyNames[p]
+}
+
+func parseHistoryPolicy(name string) (historyPolicy, error) {
+	for i, n := range historyPolicyNames {
+		if n == name {
+			return historyPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown history policy %q (use skip, redact, commands or off)", name)
+}
+
+// recordHistory adds an input line to the line-editing history as the policy allows
+func recordHistory(input string) {
+	if entry, ok := historyEntry(historyMode, input); ok {
+		line.AppendHistory(entry)
+	}
+}
+
+// historyEntry returns what the policy records for an input line, if anything
+func historyEntry(policy historyPolicy, input string) (string, bool) {
+	start := plaintextStart(input)
+	switch policy {
+	case historySkip:
+		return input, start < 0
+	case historyRedact:
+		if start < 0 {
+			return input, true
+		}
+		return input[:start] + "[redacted]", true
+	case historyCommands:
+		// Pasted ciphertexts are not commands
+		if chunk.IsPart(input) || startsWithNumberSpace(input) {
+			return "", false
+		}
+		cmd, _, _ := strings.Cut(input, " ")
+		return strings.ToLower(cmd), true
+	}
+	return "", false
+}
+
+// plaintextStart returns the offset of the plaintext in a command line,
+// or -1 if the line carries none
+func plaintextStart(input string) int {
+	cmd, _, _ := strings.Cut(input, " ")
+	rest := strings.Fields(input)[1:]
+	var skip int // Arguments before the plaintext
+	switch strings.ToLower(cmd) {
+	case "e":
+		if len(rest) > 0 && rest[0] == "--ttl" {
+			skip = 2
+		}
+	case "resend":
+		skip = 1
+	case "sign":
+	case "pake":
+		if _, arg, _ := strings.Cut(input, " "); !isPAKECode(arg) {
+			return -1
+		}
+	case "history":
+		if len(rest) == 0 || rest[0] != "search" {
+			return -1
+		}
+		skip = 1
+	default:
+		return -1
+	}
+	if len(rest) <= skip {
+		return -1
+	}
+
+	// Find the start of argument skip+1 in the original line
+	offset := len(cmd)
+	for i := 0; i <= skip; i++ {
+		offset += strings.Index(input[offset:], rest[i])
+		if i < skip {
+			offset += len(rest[i])
 		}
 	}
+	return offset
 }
 
 // startsWithNumberSpace checks if input starts with digits followed by a space
@@ -127,16 +370,22 @@ func startsWithNumberSpace(input string) bool {
 	return true
 }
 
-func handleCtrlC() bool {
+func handleCtrlC(sess *session.Session) bool {
 	if ctrlCPressed.Load() {
 		// Second Ctrl+C within timeout - exit
-		fmt.Println("Goodbye!")
+		if panicWipe {
+			wipeAll(sess)
+			return true
+		}
+		printGoodbye(false)
 		return true
 	}
 
 	// First Ctrl+C - set flag and start timeout
 	ctrlCPressed.Store(true)
-	fmt.Println("\nPress Ctrl+C again within 2 seconds to exit, or type a command to continue...")
+	if !jsonOutput {
+		fmt.Println("\nPress Ctrl+C again within 2 seconds to exit, or type a command to continue...")
+	}
 
 	// Reset flag after 2 seconds
 	go func() {
@@ -147,6 +396,75 @@ func handleCtrlC() bool {
 	return false
 }
 
+// handleWipe runs the wipe command and reports whether the program should exit
+func handleWipe(sess *session.Session, arg string) bool {
+	arg = strings.TrimSpace(arg)
+	if arg != "" && arg != "-f" {
+		printUsage("Usage: wipe [-f]")
+		return false
+	}
+	if arg == "" {
+		response, err := promptLine("Destroy all keys, the transcript, the identity and the history, and exit? (y/N): ")
+		if err != nil {
+			if jsonOutput {
+				printError(fmt.Errorf("wipe %w", errCancelled))
+			}
+			return false
+		}
+		response = strings.TrimSpace(strings.ToLower(response))
+		if response != "y" && response != "yes" {
+			if jsonOutput {
+				printError(fmt.Errorf("wipe %w", errCancelled))
+			}
+			return false
+		}
+	}
+	wipeAll(sess)
+	return true
+}
+
+// printGoodbye says goodbye, or emits the exit object
+func printGoodbye(wiped bool) {
+	if jsonOutput {
+		emit(exitJSON{Type: "exit", Wiped: wiped})
+		return
+	}
+	fmt.Println("Goodbye!")
+}
+
+// wipeAll destroys the session and identity keys, securely deletes the
+// transcript, identity and known-peers files, and clears the command history
+// and the terminal; the caller must exit after it
+func wipeAll(sess *session.Session) {
+	sess.Close()
+	closeIdentity()
+	var files []string
+	if transcriptDB != nil {
+		files = append(files, transcriptDB.Path())
+		closeTranscript()
+	}
+	if dir, err := dataDir(); err == nil {
+		files = append(files, filepath.Join(dir, identityFile), filepath.Join(dir, knownPeersFile))
+	}
+	for _, path := range files {
+		if err := wipe.File(path); err != nil {
+			if jsonOutput {
+				emit(newErrorJSON(errorCode(err), err.Error()))
+			} else {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}
+	}
+	line.ClearHistory()
+
+	// Clear the screen and the scrollback buffer
+	if jsonOutput {
+		printGoodbye(true)
+		return
+	}
+	fmt.Print("\033[H\033[2J\033[3J")
+}
+
 func confirmExit() bool {
 	response, err := line.Prompt("Are you sure you want to exit? (y/N): ")
 	if err != nil {
@@ -156,20 +474,56 @@ func confirmExit() bool {
 	return response == "y" || response == "yes"
 }
 
-func handleKey(sess *session.Session, base64Key string) {
-	if base64Key == "" {
-		fmt.Println("Usage: key <base64-public-key>")
+func handleKey(sess *session.Session, encodedKey string) {
+	if encodedKey == "" {
+		printUsage("Usage: key <public-key> | key --qr <image.png> | key <ssh-ed25519 key or .keys file>")
+		return
+	}
+
+	// A peer's long-term identity rather than a session key
+	if isIdentityArg(encodedKey) {
+		handlePinIdentity(sess, encodedKey)
 		return
 	}
 
-	if err := sess.SetPeerPublicKey(base64Key); err != nil {
-		fmt.Printf("Error: %v\n", err)
+	// The QR payload is the key, optionally followed by the peer's words
+	var peerWords string
+	if path, ok := strings.CutPrefix(encodedKey, "--qr"); ok {
+		payload, err := readQRFile(strings.TrimSpace(path))
+		if err != nil {
+			printError(err)
+			return
+		}
+		encodedKey, peerWords, _ = strings.Cut(payload, "\n")
+		encodedKey = strings.TrimSpace(encodedKey)
+		peerWords = strings.TrimSpace(peerWords)
+	}
+
+	if err := sess.SetPeerPublicKey(encodedKey); err != nil {
+		printError(err)
 		return
 	}
 
+	if jsonOutput {
+		res := newEstablishedJSON(sess, "key")
+		if peerWords != "" {
+			match := peerWords == strings.Join(res.VerificationWords, " - ")
+			res.QRWordsMatch = &match
+		}
+		emit(res)
+		return
+	}
 	fmt.Println("Peer public key imported successfully!")
 	fmt.Println("Secure channel established. You can now encrypt and decrypt messages.")
 	fmt.Println()
+	if sess.GetPeerIdentityKey() != nil {
+		fmt.Println("The channel is bound to the pinned peer identity: only its owner can read")
+		fmt.Println("your messages, and the verification words differ if either side's pin is wrong.")
+		if sess.GetDeniable() {
+			fmt.Println("The handshake is deniable: neither of you can prove to anyone else who wrote a message.")
+		}
+		fmt.Println()
+	}
 
 	// Display verification words
 	words := sess.GetVerificationWords()
@@ -178,86 +532,1624 @@ func handleKey(sess *session.Session, base64Key string) {
 		fmt.Println("Verify these words match on both sides to ensure no MITM attack:")
 		fmt.Printf("  %s\n", strings.Join(words, " - "))
 		fmt.Println()
+
+		if peerWords != "" {
+			if peerWords == strings.Join(words, " - ") {
+				fmt.Println("Verification words from the QR code match.")
+			} else {
+				fmt.Println("WARNING: verification words from the QR code do NOT match!")
+				fmt.Printf("  QR code: %s\n", peerWords)
+			}
+			fmt.Println()
+		}
 	}
 }
 
-func handleEncrypt(sess *session.Session, plaintext string) {
-	if plaintext == "" {
-		fmt.Println("Usage: e <plaintext message>")
+// pakeCodeRe matches a PAKE code such as "7-guitar-ocean" after normalizing;
+// PAKE messages never match because encodings use upper case or no hyphens
+// after a leading number
+var pakeCodeRe = regexp.MustCompile(`^[0-9]+(-[a-z]+)+$`)
+
+// isPAKECode reports whether a pake argument is a code rather than a message
+func isPAKECode(arg string) bool {
+	return arg == strings.ToLower(arg) && pakeCodeRe.MatchString(session.NormalizePAKECode(arg))
+}
+
+// handlePAKE starts an exchange with a new or given code, or finishes it
+// with the peer's message
+func handlePAKE(sess *session.Session, arg string) {
+	arg = strings.TrimSpace(arg)
+	if arg != "" && !isPAKECode(arg) {
+		if !sess.PAKEPending() {
+			printUsage("Usage: pake [code] | pake <peer's message> after starting with a code")
+			return
+		}
+		if err := sess.FinishPAKE(arg); err != nil {
+			printError(err)
+			return
+		}
+		if jsonOutput {
+			emit(newEstablishedJSON(sess, "pake"))
+			return
+		}
+		fmt.Println("PAKE complete. Secure channel established from the shared code.")
+		fmt.Println("If the peer typed the same code, only the two of you can read your messages;")
+		fmt.Println("a mistyped code or a man in the middle makes the first message fail to decrypt.")
+		if sess.GetPeerIdentityKey() != nil {
+			fmt.Println("The channel is also bound to the pinned peer identity.")
+		}
+		fmt.Println()
+		fmt.Println("Verification words (optional, match automatically with the same code):")
+		fmt.Printf("  %s\n", strings.Join(sess.GetVerificationWords(), " - "))
+		fmt.Println()
 		return
 	}
 
-	ciphertext, err := sess.Encrypt(plaintext)
+	code := arg
+	if code == "" {
+		var err error
+		if code, err = session.NewPAKECode(); err != nil {
+			printError(err)
+			return
+		}
+		if !jsonOutput {
+			fmt.Println("Tell your peer this one-time code over a channel you trust (e.g. by phone):")
+			fmt.Printf("  %s\n", code)
+			fmt.Println("They start with: pake <code>")
+			fmt.Println()
+		}
+	}
+	msg, err := sess.StartPAKE(code)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		printError(err)
+		return
+	}
+	if jsonOutput {
+		res := pakeJSON{Type: "pake", Line: "pake " + msg}
+		if arg == "" {
+			res.Code = code
+		}
+		emit(res)
 		return
 	}
+	fmt.Println("Send your peer this line:")
+	fmt.Printf("pake %s\n", msg)
+	fmt.Println()
+	fmt.Println("Then paste the line they send you.")
+}
+
+// isIdentityArg reports whether a key argument is an SSH public key or a
+// file of them rather than a session key
+func isIdentityArg(arg string) bool {
+	if strings.HasPrefix(arg, "ssh-") {
+		return true
+	}
+	info, err := os.Stat(arg)
+	return err == nil && !info.IsDir()
+}
 
-	fmt.Println(ciphertext)
+// parseIdentityArg reads a peer identity from an SSH public key line, an
+// identity key, or a file holding exactly one Ed25519 SSH key (such as a
+// saved https://github.com/<user>.keys)
+func parseIdentityArg(arg string) (ed25519.PublicKey, error) {
+	if !isIdentityArg(arg) || strings.HasPrefix(arg, "ssh-") {
+		return identity.ParsePublicKey(arg)
+	}
+	data, err := os.ReadFile(arg)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := identity.ParseAuthorizedKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", arg, err)
+	}
+	if len(keys) > 1 {
+		return nil, fmt.Errorf("%s holds %d Ed25519 keys; use key <ssh-ed25519 line> with the one your peer uses", arg, len(keys))
+	}
+	return keys[0], nil
 }
 
-func handleDecrypt(sess *session.Session, ciphertext string) {
-	if ciphertext == "" {
-		fmt.Println("Usage: <msgNum> <base64-ciphertext>")
+func handlePinIdentity(sess *session.Session, arg string) {
+	key, err := parseIdentityArg(arg)
+	if err != nil {
+		printError(err)
 		return
 	}
-
-	plaintext, err := sess.Decrypt(ciphertext)
+	x, err := identity.X25519PublicKey(key)
+	if err == nil {
+		err = sess.SetPeerIdentityKey(x)
+	}
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		printError(err)
+		return
+	}
+
+	name := "unknown peer"
+	if peers, err := loadKnownPeers(); err == nil {
+		if p, ok := peers.Lookup(key); ok {
+			name = p.Name
+		}
+	}
+	if jsonOutput {
+		res := peerIdentityJSON{
+			Type:             "peer_identity",
+			Key:              identity.SSHPublicKey(key),
+			Rekeyed:          sess.IsEstablished(),
+			IdentityRequired: sess.GetIdentityPublicKey() == nil,
+		}
+		if name != "unknown peer" {
+			res.Name = name
+		}
+		emit(res)
 		return
 	}
+	fmt.Printf("Pinned peer identity (%s):\n%s\n", name, identity.SSHPublicKey(key))
+	switch {
+	case sess.GetIdentityPublicKey() == nil:
+		fmt.Println("Restart with --identity <your key>: a pinned channel needs your own identity too.")
+	case sess.IsEstablished():
+		fmt.Println("Channel re-keyed with the identity; message numbers start from 0 again.")
+	default:
+		fmt.Println("Now import the peer's session key with: key <public-key>")
+	}
+}
+
+// readQRFile decodes a QR code from a PNG image
+func readQRFile(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("missing image path")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
 
-	fmt.Println(plaintext)
+	img, err := png.Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read PNG image: %w", err)
+	}
+	data, err := qr.Decode(img)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode QR code: %w", err)
+	}
+	return string(data), nil
 }
 
-func handleStatus(sess *session.Session) {
-	fmt.Println("=== Session Status ===")
-	fmt.Printf("Session established: %v\n", sess.IsEstablished())
-	fmt.Println()
-	fmt.Println("Your public key:")
-	fmt.Println(sess.GetPublicKeyBase64())
+func handleQR(sess *session.Session, args string) {
+	var withWords bool
+	var pngPath string
+	fields := strings.Fields(args)
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "--sas":
+			withWords = true
+		case "--png":
+			if i+1 >= len(fields) {
+				printUsage("Usage: qr [--sas] [--png <file>]")
+				return
+			}
+			i++
+			pngPath = fields[i]
+		default:
+			printUsage("Usage: qr [--sas] [--png <file>]")
+			return
+		}
+	}
 
-	if sess.IsEstablished() {
-		fmt.Println()
-		fmt.Println("Peer's public key:")
-		fmt.Println(sess.GetPeerPublicKeyBase64())
-		fmt.Println()
+	payload := sess.GetPublicKeyBase64()
+	if withWords {
 		words := sess.GetVerificationWords()
-		if words != nil {
-			fmt.Println("Verification words:")
-			fmt.Printf("  %s\n", strings.Join(words, " - "))
+		if words == nil {
+			printError(errors.New("verification words are available after importing the peer's key"))
+			return
 		}
-		fmt.Println()
-		send, recv := sess.GetMessageStats()
-		fmt.Printf("Messages sent: %d, received: %d\n", send, recv)
-		if recv > 0 {
-			fmt.Printf("Last received message: #%d\n", sess.GetLastRecvMsgNum())
+		payload += "\n" + strings.Join(words, " - ")
+	}
+
+	code, err := qr.Encode([]byte(payload), qr.LevelM)
+	if err != nil {
+		printError(err)
+		return
+	}
+
+	if pngPath != "" {
+		f, err := os.Create(pngPath)
+		if err != nil {
+			printError(err)
+			return
 		}
-		fmt.Println("(Each message uses a unique key for forward secrecy)")
+		err = png.Encode(f, code.Image(8))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			printError(err)
+			return
+		}
+		if jsonOutput {
+			emit(qrJSON{Type: "qr", Payload: payload, File: pngPath})
+			return
+		}
+		fmt.Printf("QR code written to %s\n", pngPath)
+		return
+	}
+
+	if jsonOutput {
+		emit(qrJSON{Type: "qr", Payload: payload, Code: code.String()})
+		return
 	}
+	fmt.Print(code.String())
 }
 
-func handleHelp() {
-	fmt.Println("=== Available Commands ===")
-	fmt.Println()
-	fmt.Println("  key <base64-public-key>  Import peer's public key to establish secure channel")
-	fmt.Println("  e <plaintext>            Encrypt a message")
-	fmt.Println("  <msgNum> <ciphertext>    Decrypt (auto-detected, no 'd' needed)")
-	fmt.Println("  status                   Show current session status")
-	fmt.Println("  help                     Show this help message")
-	fmt.Println("  quit / exit / q          Exit the program")
+func handleEncrypt(sess *session.Session, plaintext string) {
+	if plaintext == "" {
+		printUsage("Usage: e [--ttl <duration>] <plaintext message>")
+		return
+	}
+
+	msg := &session.Message{Text: plaintext}
+	if rest, ok := strings.CutPrefix(plaintext, "--ttl "); ok {
+		value, text, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 || text == "" {
+			printUsage("Usage: e [--ttl <duration>] <plaintext message>  (e.g. e --ttl 10m hello)")
+			return
+		}
+		msg = &session.Message{Text: text, TTL: ttl}
+	}
+
+	lines, err := sess.EncryptMessage(msg)
+	if err != nil {
+		printError(err)
+		return
+	}
+
+	if jsonOutput {
+		emit(ciphertextJSON{Type: "ciphertext", Num: msg.Num, Kind: msg.Type.String(), Lines: lines})
+	} else {
+		for _, l := range lines {
+			fmt.Println(l)
+		}
+	}
+	recordMessage(transcript.Sent, msg)
+}
+
+func handleAck(sess *session.Session) {
+	ack := sess.NewAck()
+	if ack == nil {
+		printError(errors.New("nothing received yet"))
+		return
+	}
+
+	lines, err := sess.EncryptMessage(ack)
+	if err != nil {
+		printError(err)
+		return
+	}
+	if jsonOutput {
+		emit(ciphertextJSON{Type: "ciphertext", Num: ack.Num, Kind: ack.Type.String(), Lines: lines, Ack: newAckJSON(ack.Ack)})
+		return
+	}
+	fmt.Printf("Ack (received up to #%d%s), send this to your peer:\n", ack.Ack.Highest, formatMissing(ack.Ack.Missing))
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+}
+
+func handleResend(sess *session.Session, args string) {
+	numStr, plaintext, _ := strings.Cut(strings.TrimSpace(args), " ")
+	msgNum, err := strconv.ParseUint(numStr, 10, 32)
+	if err != nil {
+		printUsage("Usage: resend <msgNum> [plaintext]")
+		return
+	}
+
+	// Without plaintext, repeat the original ciphertext; the peer still
+	// holds the key for a message that never arrived
+	res := ciphertextJSON{Type: "ciphertext", Num: uint32(msgNum)}
+	var lines []string
+	if plaintext = strings.TrimSpace(plaintext); plaintext == "" {
+		lines, err = sess.GetSentLines(uint32(msgNum))
+	} else {
+		msg := &session.Message{Text: plaintext}
+		if lines, err = sess.Resend(uint32(msgNum), msg); err == nil {
+			defer recordMessage(transcript.Sent, msg)
+			replaced := res.Num
+			res.Num, res.Kind, res.Replaces = msg.Num, msg.Type.String(), &replaced
+		}
+	}
+	if err != nil {
+		printError(err)
+		return
+	}
+	if jsonOutput {
+		res.Lines = lines
+		emit(res)
+		return
+	}
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+}
+
+func handleDecrypt(sess *session.Session, ciphertext string) {
+	if ciphertext == "" {
+		printUsage("Usage: <msgNum> <ciphertext>")
+		return
+	}
+
+	if chunk.IsPart(ciphertext) {
+		handleDecryptPart(sess, ciphertext)
+		return
+	}
+
+	msg, err := sess.DecryptMessage(ciphertext)
+	if err != nil {
+		printError(err)
+		return
+	}
+
+	printMessage(msg)
+	recordMessage(transcript.Received, msg)
+}
+
+// printMessage shows a decrypted message followed by its send time and expiry
+// Control messages are shown as a bracketed description
+func printMessage(msg *session.Message) {
+	if jsonOutput {
+		emit(newMessageJSON(msg, time.Now()))
+		return
+	}
+	switch msg.Type {
+	case session.TypeText:
+		fmt.Println(msg.Text)
+	case session.TypeFileChunk:
+		fmt.Printf("[file %s: chunk %d/%d, %d bytes]\n", msg.File.Name, msg.File.Index, msg.File.Total, len(msg.File.Data))
+	case session.TypeAck:
+		fmt.Printf("[ack: received up to #%d%s]\n", msg.Ack.Highest, formatMissing(msg.Ack.Missing))
+	case session.TypeReceipt:
+		fmt.Printf("[read receipt for %s]\n", formatNums(msg.Receipt))
+	case session.TypeRekey:
+		fmt.Println("[peer requested a rekey]")
+	case session.TypeClose:
+		if msg.Text != "" {
+			fmt.Printf("[peer closed the session: %s]\n", msg.Text)
+		} else {
+			fmt.Println("[peer closed the session]")
+		}
+	}
+
+	info := "sent " + msg.SentAt.Format(time.DateTime)
+	if msg.TTL > 0 {
+		info += ", expires " + msg.ExpiresAt().Format(time.DateTime)
+	}
+	fmt.Printf("(%s)\n", info)
+
+	if msg.Expired(time.Now()) {
+		fmt.Println("WARNING: this message has expired")
+	}
+}
+
+// formatNums formats message numbers as "#1, #2"
+func formatNums(nums []uint32) string {
+	s := make([]string, len(nums))
+	for i, n := range nums {
+		s[i] = fmt.Sprintf("#%d", n)
+	}
+	return strings.Join(s, ", ")
+}
+
+// formatMissing formats missing message numbers as ", missing #1, #2"
+func formatMissing(nums []uint32) string {
+	if len(nums) == 0 {
+		return ""
+	}
+	return ", missing " + formatNums(nums)
+}
+
+func handleDecryptPart(sess *session.Session, part string) {
+	msg, status, err := sess.DecryptPart(part)
+	if err != nil {
+		printError(err)
+		return
+	}
+
+	if !status.Complete() {
+		if jsonOutput {
+			emit(newPartJSON(status))
+			return
+		}
+		fmt.Printf("Received %d of %d parts of message #%d, missing: %s\n",
+			status.Received, status.Total, status.MsgNum, formatParts(status.Missing))
+		return
+	}
+
+	printMessage(msg)
+	recordMessage(transcript.Received, msg)
+}
+
+// handleBatch decrypts many pasted lines (or the lines of a file) at once
+// and prints the messages in number order, followed by a summary
+func handleBatch(sess *session.Session, path string) {
+	var lines []string
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			printError(err)
+			return
+		}
+		lines = strings.Split(string(data), "\n")
+	} else {
+		// Pasted lines bypass the history; an empty line or EOF ends the batch
+		if jsonOutput {
+			emit(promptJSON{Type: "prompt", Prompt: "Paste the messages, then an empty line:"})
+		} else {
+			fmt.Println("Paste the messages, then an empty line:")
+		}
+		for {
+			l, err := line.Prompt("")
+			if err != nil || strings.TrimSpace(l) == "" {
+				break
+			}
+			lines = append(lines, l)
+		}
+	}
+
+	res, err := sess.DecryptBatch(lines)
+	if err != nil {
+		printError(err)
+		return
+	}
+	for _, msg := range res.Messages {
+		if !jsonOutput {
+			fmt.Printf("[#%d] ", msg.Num)
+			printMessage(msg)
+		}
+		recordMessage(transcript.Received, msg)
+	}
+	if jsonOutput {
+		emit(newBatchJSON(res, time.Now()))
+		return
+	}
+	fmt.Println(batchSummary(res))
+}
+
+// batchSummary lists the decrypted, duplicate, failed and missing numbers of a batch
+func batchSummary(res *session.BatchResult) string {
+	decrypted := make([]uint32, len(res.Messages))
+	for i, msg := range res.Messages {
+		decrypted[i] = msg.Num
+	}
+	var failed []string
+	for _, f := range res.Failed {
+		failed = append(failed, fmt.Sprintf("#%d (line %d: %v)", f.Num, f.Line, f.Err))
+	}
+	for _, n := range res.Invalid {
+		failed = append(failed, fmt.Sprintf("line %d (not a message)", n))
+	}
+
+	orNone := func(s string) string {
+		if s == "" {
+			return "none"
+		}
+		return s
+	}
+	summary := []string{
+		"Batch summary:",
+		fmt.Sprintf("  Decrypted:  %s", orNone(formatNums(decrypted))),
+		fmt.Sprintf("  Duplicate:  %s", orNone(formatNums(res.Duplicates))),
+		fmt.Sprintf("  Failed:     %s", orNone(strings.Join(failed, ", "))),
+		fmt.Sprintf("  Missing:    %s", orNone(formatNums(res.Missing))),
+	}
+	for _, st := range res.Incomplete {
+		summary = append(summary, fmt.Sprintf("  Incomplete: #%d, %d of %d parts, missing: %s",
+			st.MsgNum, st.Received, st.Total, formatParts(st.Missing)))
+	}
+	return strings.Join(summary, "\n")
+}
+
+// stdinPiped reports whether standard input is a pipe or file, not a terminal
+func stdinPiped() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice == 0
+}
+
+func formatParts(parts []int) string {
+	s := make([]string, len(parts))
+	for i, p := range parts {
+		s[i] = strconv.Itoa(p)
+	}
+	return strings.Join(s, ", ")
+}
+
+const setUsage = `Usage:
+  set padding <none|padme|pow2> [min-bucket-bytes]
+  set compress <on|off>
+  set encoding <base64|base64url|base32|base85|words>
+  set parts <max-line-length|off>
+  set ttl <duration|off>
+  set expiry <refuse|warn>
+  set history <skip|redact|commands|off>
+  set duress <on|off>
+  set panic-wipe <on|off>`
+
+func handleSet(sess *session.Session, args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		printSettings(sess)
+		return
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "padding":
+		if len(fields) < 2 || len(fields) > 3 {
+			printUsage("Usage: set padding <none|padme|pow2> [min-bucket-bytes]")
+			return
+		}
+		scheme, err := crypto.ParsePaddingScheme(fields[1])
+		if err != nil {
+			printError(err)
+			return
+		}
+		_, minBucket := sess.GetPadding()
+		if len(fields) == 3 {
+			minBucket, err = strconv.Atoi(fields[2])
+			if err != nil {
+				printError(fmt.Errorf("invalid minimum bucket: %s", fields[2]))
+				return
+			}
+		}
+		if err := sess.SetPadding(scheme, minBucket); err != nil {
+			printError(err)
+			return
+		}
+		printSettings(sess)
+	case "compress":
+		if len(fields) != 2 {
+			printUsage("Usage: set compress <on|off>")
+			return
+		}
+		enabled, err := parseOnOff(fields[1])
+		if err != nil {
+			printError(err)
+			return
+		}
+		if err := sess.SetCompression(enabled); err != nil {
+			printError(err)
+			return
+		}
+		printSettings(sess)
+	case "encoding":
+		if len(fields) != 2 {
+			printUsage("Usage: set encoding <base64|base64url|base32|base85|words>")
+			return
+		}
+		enc, err := codec.Parse(fields[1])
+		if err != nil {
+			printError(err)
+			return
+		}
+		sess.SetEncoding(enc)
+		if jsonOutput {
+			settings := newSettingsJSON(sess)
+			settings.PublicKey = sess.GetPublicKeyEncoded()
+			emit(settings)
+			return
+		}
+		printSettings(sess)
+		fmt.Println()
+		fmt.Println("Your public key in this encoding:")
+		fmt.Println(sess.GetPublicKeyEncoded())
+	case "parts":
+		if len(fields) != 2 {
+			printUsage("Usage: set parts <max-line-length|off>")
+			return
+		}
+		size := 0
+		if strings.ToLower(fields[1]) != "off" {
+			var err error
+			size, err = strconv.Atoi(fields[1])
+			if err != nil {
+				printError(fmt.Errorf("invalid part size: %s", fields[1]))
+				return
+			}
+		}
+		if err := sess.SetPartSize(size); err != nil {
+			printError(err)
+			return
+		}
+		printSettings(sess)
+	case "ttl":
+		if len(fields) != 2 {
+			printUsage("Usage: set ttl <duration|off>  (e.g. set ttl 24h)")
+			return
+		}
+		var ttl time.Duration
+		if strings.ToLower(fields[1]) != "off" {
+			var err error
+			ttl, err = time.ParseDuration(fields[1])
+			if err != nil {
+				printError(fmt.Errorf("invalid duration: %s", fields[1]))
+				return
+			}
+		}
+		if err := sess.SetTTL(ttl); err != nil {
+			printError(err)
+			return
+		}
+		printSettings(sess)
+	case "expiry":
+		if len(fields) != 2 {
+			printUsage("Usage: set expiry <refuse|warn>")
+			return
+		}
+		policy, err := session.ParseExpiryPolicy(strings.ToLower(fields[1]))
+		if err != nil {
+			printError(err)
+			return
+		}
+		sess.SetExpiryPolicy(policy)
+		printSettings(sess)
+	case "history":
+		if len(fields) != 2 {
+			printUsage("Usage: set history <skip|redact|commands|off>")
+			return
+		}
+		policy, err := parseHistoryPolicy(strings.ToLower(fields[1]))
+		if err != nil {
+			printError(err)
+			return
+		}
+		historyMode = policy
+		printSettings(sess)
+	case "duress":
+		if len(fields) != 2 {
+			printUsage("Usage: set duress <on|off>")
+			return
+		}
+		enabled, err := parseOnOff(fields[1])
+		if err != nil {
+			printError(err)
+			return
+		}
+		if transcriptDB == nil {
+			printError(errNoTranscript)
+			return
+		}
+		var pass string
+		if enabled {
+			if pass, err = promptNewPassphrase("Duress passphrase: "); err != nil {
+				printError(err)
+				return
+			}
+		}
+		if err := transcriptDB.SetDuressPassphrase(pass); err != nil {
+			printError(err)
+			return
+		}
+		if enabled {
+			printNote("ok", "Duress passphrase set: entering it wipes the transcript and opens an empty one.")
+		} else {
+			printNote("ok", "Duress passphrase removed.")
+		}
+	case "panic-wipe":
+		if len(fields) != 2 {
+			printUsage("Usage: set panic-wipe <on|off>")
+			return
+		}
+		enabled, err := parseOnOff(fields[1])
+		if err != nil {
+			printError(err)
+			return
+		}
+		panicWipe = enabled
+		printSettings(sess)
+	default:
+		printUsage(fmt.Sprintf("Unknown setting: %s\n%s", fields[0], setUsage))
+	}
+}
+
+func printSettings(sess *session.Session) {
+	if jsonOutput {
+		emit(newSettingsJSON(sess))
+		return
+	}
+	scheme, minBucket := sess.GetPadding()
+	fmt.Printf("Padding: %s (minimum bucket %d bytes)\n", scheme, minBucket)
+	fmt.Printf("Compression: %s\n", onOff(sess.GetCompression()))
+	fmt.Printf("Output encoding: %s\n", sess.GetEncoding())
+	if ttl := sess.GetTTL(); ttl > 0 {
+		fmt.Printf("Message TTL: %v\n", ttl)
+	} else {
+		fmt.Println("Message TTL: off")
+	}
+	fmt.Printf("Expired messages: %s\n", sess.GetExpiryPolicy())
+	if size := sess.GetPartSize(); size > 0 {
+		fmt.Printf("Split messages into parts of at most %d characters\n", size)
+	} else {
+		fmt.Println("Split messages into parts: off")
+	}
+	fmt.Printf("Command history: %s\n", historyMode)
+	fmt.Printf("Wipe on double Ctrl+C: %s\n", onOff(panicWipe))
+}
+
+func parseOnOff(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1":
+		return true, nil
+	case "off", "false", "no", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("expected on or off, got %q", value)
+	}
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+// recordMessage adds a text message to the transcript, if one is open
+func recordMessage(dir transcript.Direction, msg *session.Message) {
+	if err := saveMessage(transcriptDB, dir, msg); err != nil {
+		if jsonOutput {
+			emit(noteJSON{Type: "warning", Message: fmt.Sprintf("message not saved to transcript: %v", err)})
+			return
+		}
+		fmt.Printf("WARNING: message not saved to transcript: %v\n", err)
+	}
+}
+
+// saveMessage adds a text message to tr; other messages and a nil tr are ignored
+func saveMessage(tr *transcript.Transcript, dir transcript.Direction, msg *session.Message) error {
+	if tr == nil || msg.Type != session.TypeText {
+		return nil
+	}
+	return tr.Add(transcript.Entry{
+		Direction: dir,
+		Num:       msg.Num,
+		Time:      msg.SentAt,
+		ExpiresAt: msg.ExpiresAt(),
+		Text:      msg.Text,
+	})
+}
+
+// handleTranscript opens or creates a transcript and returns the session to
+// continue with, which is a new, empty one if the duress passphrase was entered
+func handleTranscript(sess *session.Session, arg string) *session.Session {
+	arg = strings.TrimSpace(arg)
+	switch arg {
+	case "":
+		if jsonOutput {
+			emit(newTranscriptJSON(transcriptDB))
+		} else if transcriptDB == nil {
+			fmt.Println("Transcript: off")
+		} else {
+			fmt.Printf("Transcript: %s (%d messages)\n", transcriptDB.Path(), len(transcriptDB.Entries()))
+		}
+		return sess
+	case "off":
+		closeTranscript()
+		if jsonOutput {
+			emit(newTranscriptJSON(transcriptDB))
+		} else {
+			fmt.Println("Transcript closed.")
+		}
+		return sess
+	}
+
+	closeTranscript()
+
+	var err error
+	if _, statErr := os.Stat(arg); statErr == nil {
+		var pass string
+		if pass, err = promptPassword("Transcript passphrase: "); err == nil {
+			transcriptDB, err = transcript.Open(arg, pass)
+			if errors.Is(err, transcript.ErrDuress) {
+				sess, err = openDecoy(sess, arg, pass)
+			}
+		}
+	} else {
+		var pass string
+		if pass, err = promptNewPassphrase("New transcript passphrase: "); err != nil {
+			printError(err)
+			return sess
+		}
+		transcriptDB, err = transcript.Create(arg, pass)
+	}
+	if err != nil {
+		printError(err)
+		return sess
+	}
+	if jsonOutput {
+		emit(newTranscriptJSON(transcriptDB))
+		return sess
+	}
+	fmt.Printf("Recording messages to %s (%d messages so far)\n", arg, len(transcriptDB.Entries()))
+	return sess
+}
+
+// openDecoy handles the duress passphrase: it destroys the session, securely
+// deletes the real transcript and replaces both with empty ones, so the
+// unlock looks like it succeeded
+func openDecoy(sess *session.Session, path, pass string) (*session.Session, error) {
+	decoy, tr, err := replaceWithDecoy(sess, path, pass, newSession)
+	transcriptDB = tr
+	return decoy, err
+}
+
+// replaceWithDecoy closes sess, wipes the transcript at path and returns a new
+// session and an empty transcript under pass in their place
+// The decoy is created by newSess like the original and keeps its peer pin,
+// so it behaves the same on the next key import
+func replaceWithDecoy(sess *session.Session, path, pass string, newSess func() (*session.Session, error)) (*session.Session, *transcript.Transcript, error) {
+	pin := bytes.Clone(sess.GetPeerIdentityKey())
+	sess.Close()
+	decoy, err := newSess()
+	if err != nil {
+		return sess, nil, err
+	}
+	if pin != nil {
+		if err := decoy.SetPeerIdentityKey(pin); err != nil {
+			return decoy, nil, err
+		}
+	}
+	if err := wipe.File(path); err != nil {
+		return decoy, nil, err
+	}
+	tr, err := transcript.Create(path, pass)
+	return decoy, tr, err
+}
+
+// promptNewPassphrase asks for a passphrase twice
+func promptNewPassphrase(prompt string) (string, error) {
+	pass, err := promptPassword(prompt)
+	if err != nil {
+		return "", err
+	}
+	confirm, err := promptPassword("Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if pass != confirm {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+	return pass, nil
+}
+
+// closeTranscript stops recording and forgets the transcript key
+func closeTranscript() {
+	if transcriptDB != nil {
+		transcriptDB.Close()
+		transcriptDB = nil
+	}
+}
+
+func handleHistory(arg string) {
+	if transcriptDB == nil {
+		printError(errNoTranscript)
+		return
+	}
+	if _, err := transcriptDB.Purge(); err != nil {
+		printError(err)
+		return
+	}
+
+	var entries []transcript.Entry
+	fields := strings.Fields(arg)
+	switch {
+	case len(fields) == 0:
+		entries = transcriptDB.Entries()
+	case fields[0] == "search" && len(fields) > 1:
+		entries = transcriptDB.Search(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(arg), "search")))
+	case len(fields) == 1:
+		n, err := strconv.Atoi(fields[0])
+		if err != nil || n < 1 {
+			printUsage("Usage: history [<count> | search <term>]")
+			return
+		}
+		entries = transcriptDB.Entries()
+		if len(entries) > n {
+			entries = entries[len(entries)-n:]
+		}
+	default:
+		printUsage("Usage: history [<count> | search <term>]")
+		return
+	}
+
+	if jsonOutput {
+		emit(newHistoryJSON(entries))
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("No messages.")
+		return
+	}
+	for _, e := range entries {
+		fmt.Println(e.String())
+	}
+}
+
+func handleExport(path string) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		printUsage("Usage: export <file>")
+		return
+	}
+	if transcriptDB == nil {
+		printError(errNoTranscript)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		printError(err)
+		return
+	}
+	err = transcriptDB.Export(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		printError(err)
+		return
+	}
+	printNote("ok", fmt.Sprintf("Transcript exported to %s as UNENCRYPTED text", path))
+}
+
+// dataDir returns the directory for the identity and known peers:
+// $E2E_MESSAGE_HOME, or e2e-message in the user's configuration directory
+func dataDir() (string, error) {
+	if dir := os.Getenv("E2E_MESSAGE_HOME"); dir != "" {
+		return dir, nil
+	}
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config, "e2e-message"), nil
+}
+
+// dataPath returns the path of a file in the data directory, creating the directory
+func dataPath(name string) (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// loadIdentity returns the identity key: the --identity file, or the one
+// in the data directory, which is created on first use
+func loadIdentity() (*identity.Identity, error) {
+	if ident != nil {
+		return ident, nil
+	}
+	if identityPath != "" {
+		id, err := loadIdentityFile(identityPath)
+		if err != nil {
+			return nil, err
+		}
+		ident = id
+		return ident, nil
+	}
+	path, err := dataPath(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	id, created, err := identity.LoadOrCreate(path)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		printNote("notice", fmt.Sprintf("Created a new identity key in %s", path))
+	}
+	ident = id
+	return ident, nil
+}
+
+// loadIdentityFile loads an identity, asking for the passphrase of a
+// protected SSH key
+func loadIdentityFile(path string) (*identity.Identity, error) {
+	id, err := identity.Load(path)
+	if !errors.Is(err, identity.ErrPassphraseRequired) {
+		return id, err
+	}
+	pass, err := promptPassword(fmt.Sprintf("Passphrase for %s: ", path))
+	if err != nil {
+		return nil, err
+	}
+	passBytes := []byte(pass)
+	defer crypto.Wipe(passBytes)
+	return identity.LoadWithPassphrase(path, passBytes)
+}
+
+// promptPassword reads a password from the terminal, also outside the REPL
+func promptPassword(prompt string) (string, error) {
+	if line != nil {
+		if jsonOutput {
+			emit(promptJSON{Type: "prompt", Prompt: prompt, Secret: true})
+			prompt = ""
+		}
+		return line.PasswordPrompt(prompt)
+	}
+	l := liner.NewLiner()
+	defer l.Close()
+	return l.PasswordPrompt(prompt)
+}
+
+// promptLine reads a line of input in the REPL; with --json the prompt is
+// a prompt object
+func promptLine(prompt string) (string, error) {
+	if jsonOutput {
+		emit(promptJSON{Type: "prompt", Prompt: prompt})
+		prompt = ""
+	}
+	return line.Prompt(prompt)
+}
+
+// newSession creates a session as the command line asks for: in deniable
+// mode and with the identity key if requested
+func newSession() (*session.Session, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	// A long-term identity authenticates sessions to peers who pinned it
+	if deniable {
+		if err := sess.SetDeniable(true); err != nil {
+			sess.Close()
+			return nil, fmt.Errorf("failed to enable deniable mode: %w", err)
+		}
+	}
+	if identityPath != "" || deniable {
+		if err := useIdentity(sess); err != nil {
+			sess.Close()
+			return nil, fmt.Errorf("failed to load identity: %w", err)
+		}
+	}
+	return sess, nil
+}
+
+// useIdentity loads the identity key and makes the session use it
+func useIdentity(sess *session.Session) error {
+	id, err := loadIdentity()
+	if err != nil {
+		return err
+	}
+	return sess.SetIdentityKey(id.X25519())
+}
+
+// closeIdentity forgets the identity key
+func closeIdentity() {
+	if ident != nil {
+		ident.Close()
+		ident = nil
+	}
+}
+
+func loadKnownPeers() (*identity.KnownPeers, error) {
+	path, err := dataPath(knownPeersFile)
+	if err != nil {
+		return nil, err
+	}
+	return identity.LoadPeers(path)
+}
+
+func handleIdentity() {
+	id, err := loadIdentity()
+	if err != nil {
+		printError(err)
+		return
+	}
+	if jsonOutput {
+		res := identityJSON{Type: "identity", Key: session.EncodeKey(id.PublicKey())}
+		if r, err := ageRecipient(id.PublicKey()); err == nil {
+			res.AgeRecipient = r.String()
+		}
+		emit(res)
+		return
+	}
+	fmt.Println("Your identity key (share this so others can verify your signatures):")
+	fmt.Println(session.EncodeKey(id.PublicKey()))
+	if r, err := ageRecipient(id.PublicKey()); err == nil {
+		fmt.Println()
+		fmt.Println("The same key as an age recipient, for encrypting files to you:")
+		fmt.Println(r)
+	}
+}
+
+func handleSign(text string) {
+	if strings.TrimSpace(text) == "" {
+		printUsage("Usage: sign <text>")
+		return
+	}
+	id, err := loadIdentity()
+	if err != nil {
+		printError(err)
+		return
+	}
+	if jsonOutput {
+		emit(signedJSON{Type: "signed", Armor: id.Sign(text)})
+		return
+	}
+	fmt.Print(id.Sign(text))
+}
+
+// handleVerify verifies a signed message; the rest of the armor is read
+// from the following input lines
+func handleVerify(first string) {
+	first = strings.TrimSpace(first)
+	if first == "" {
+		if jsonOutput {
+			emit(promptJSON{Type: "prompt", Prompt: "Paste the signed message:"})
+		} else {
+			fmt.Println("Paste the signed message:")
+		}
+	}
+	armored := []string{first}
+	for first != identity.EndSignature {
+		next, err := line.Prompt("")
+		if err != nil {
+			if jsonOutput {
+				printError(fmt.Errorf("verification %w", errCancelled))
+			} else {
+				fmt.Println("Verification cancelled.")
+			}
+			return
+		}
+		first = strings.TrimSpace(next)
+		armored = append(armored, next)
+	}
+
+	signed, err := identity.ParseSigned(strings.Join(armored, "\n"))
+	if err != nil {
+		printError(err)
+		return
+	}
+	peers, err := loadKnownPeers()
+	if err != nil {
+		printError(err)
+		return
+	}
+	if jsonOutput {
+		emit(newSignatureJSON(signed, peers))
+		return
+	}
+	fmt.Println(describeSignature(signed, peers))
+}
+
+// describeSignature reports whether a signed message is valid and who signed it
+func describeSignature(signed *identity.Signed, peers *identity.KnownPeers) string {
+	key := session.EncodeKey(signed.Key)
+	if !signed.Valid() {
+		return fmt.Sprintf("BAD signature: the message was altered or not signed by %s", key)
+	}
+	if peer, ok := peers.Lookup(signed.Key); ok {
+		return fmt.Sprintf("Good signature from %s:\n%s", peer.Name, signed.Text)
+	}
+	return fmt.Sprintf("Valid signature, but from an UNKNOWN key %s:\n%s\n"+
+		"Check the key with its owner, then: peers add <name> %s", key, signed.Text, key)
+}
+
+func handlePeers(arg string) {
+	peers, err := loadKnownPeers()
+	if err != nil {
+		printError(err)
+		return
+	}
+
+	fields := strings.Fields(arg)
+	switch {
+	case len(fields) == 0 && jsonOutput:
+		emit(newPeersJSON(peers))
+	case len(fields) == 0:
+		list := peers.List()
+		if len(list) == 0 {
+			fmt.Println("No known peers.")
+		}
+		for _, p := range list {
+			fmt.Printf("%s %s\n", p.Name, session.EncodeKey(p.Key))
+		}
+	case fields[0] == "add" && len(fields) >= 3:
+		key, err := parseIdentityArg(strings.Join(fields[2:], " "))
+		if err == nil {
+			err = peers.Add(fields[1], key)
+		}
+		if err != nil {
+			printError(err)
+			return
+		}
+		if jsonOutput {
+			emit(newPeersJSON(peers))
+			return
+		}
+		fmt.Printf("Added %s to known peers.\n", fields[1])
+	case fields[0] == "remove" && len(fields) == 2:
+		if err := peers.Remove(fields[1]); err != nil {
+			printError(err)
+			return
+		}
+		if jsonOutput {
+			emit(newPeersJSON(peers))
+			return
+		}
+		fmt.Printf("Removed %s from known peers.\n", fields[1])
+	default:
+		printUsage("Usage: peers [add <name> <identity-key | ssh-ed25519 key | .keys file> | remove <name>]")
+	}
+}
+
+const commandUsage = `Usage:
+  e2e-message [--identity <key>] [--deniable] [--json]
+                                    Start an interactive session
+  e2e-message age-encrypt -r <recipient> [-r ...] [-o <output>] [<input>]
+  e2e-message age-decrypt [-i <identity>] [-o <output>] [<input>]
+  e2e-message daemon [--socket <path>]
+                                    Serve a JSON-RPC API on stdin/stdout or a socket
+
+A recipient is an age1... key, an identity key or the name of a known peer.
+An identity is an age identity file, an identity.pem or an SSH Ed25519 key
+(such as ~/.ssh/id_ed25519); the default is yours, or the --identity key.
+age-decrypt also opens files age -R encrypted to the key's ssh-ed25519 form;
+other recipient types, such as scrypt or ssh-rsa, are skipped.
+With --json, results and errors are printed as JSON objects, one per line.`
+
+// runCommand runs a non-interactive mode and returns the exit code
+func runCommand(args []string, stdin io.Reader, stdout io.Writer) int {
+	var err error
+	switch args[0] {
+	case "age-encrypt":
+		err = ageEncrypt(args[1:], stdin, stdout)
+	case "age-decrypt":
+		err = ageDecrypt(args[1:], stdin, stdout)
+	case "daemon":
+		err = runDaemon(args[1:], stdin, stdout)
+	case "help", "-h", "--help":
+		if jsonOutput {
+			writeJSON(stdout, noteJSON{Type: "usage", Message: commandUsage})
+			return 0
+		}
+		fmt.Fprintln(stdout, commandUsage)
+		return 0
+	default:
+		if jsonOutput {
+			writeJSON(stdout, newErrorJSON("unknown_command", fmt.Sprintf("unknown command: %s\n%s", args[0], commandUsage)))
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n%s\n", args[0], commandUsage)
+		return 2
+	}
+	if err != nil {
+		if jsonOutput {
+			writeJSON(stdout, newErrorJSON(errorCode(err), err.Error()))
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// stringList is a flag that may be repeated
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// parseFileFlags parses the flags of a file mode, which takes an optional input file
+func parseFileFlags(fs *flag.FlagSet, args []string) (input string, err error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return "", fmt.Errorf("%w\n%s", err, commandUsage)
+	}
+	switch fs.NArg() {
+	case 0:
+		return "", nil
+	case 1:
+		return fs.Arg(0), nil
+	default:
+		return "", fmt.Errorf("too many arguments\n%s", commandUsage)
+	}
+}
+
+func ageEncrypt(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("age-encrypt", flag.ContinueOnError)
+	var recipientArgs stringList
+	fs.Var(&recipientArgs, "r", "recipient")
+	output := fs.String("o", "", "output file")
+	input, err := parseFileFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(recipientArgs) == 0 {
+		return fmt.Errorf("at least one recipient (-r) is required")
+	}
+
+	var recipients []*age.Recipient
+	for _, arg := range recipientArgs {
+		r, err := parseAgeRecipient(arg)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, r)
+	}
+
+	return transformFile(input, *output, stdin, stdout, func(dst io.Writer, src io.Reader) error {
+		w, err := age.Encrypt(dst, recipients...)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, src); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+func ageDecrypt(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("age-decrypt", flag.ContinueOnError)
+	var identityArgs stringList
+	fs.Var(&identityArgs, "i", "identity file")
+	output := fs.String("o", "", "output file")
+	input, err := parseFileFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(identityArgs) == 0 {
+		path := identityPath
+		if path == "" {
+			dir, err := dataDir()
+			if err != nil {
+				return err
+			}
+			path = filepath.Join(dir, identityFile)
+		}
+		identityArgs = append(identityArgs, path)
+	}
+
+	var identities []*age.Identity
+	defer func() {
+		for _, id := range identities {
+			id.Close()
+		}
+	}()
+	for _, path := range identityArgs {
+		ids, err := loadAgeIdentities(path)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, ids...)
+	}
+
+	return transformFile(input, *output, stdin, stdout, func(dst io.Writer, src io.Reader) error {
+		r, err := age.Decrypt(src, identities...)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, r)
+		return err
+	})
+}
+
+// parseAgeRecipient accepts an age1... recipient, an identity key or a known peer's name
+func parseAgeRecipient(arg string) (*age.Recipient, error) {
+	if strings.HasPrefix(arg, "age1") {
+		return age.ParseRecipient(arg)
+	}
+	if peers, err := loadKnownPeers(); err == nil {
+		for _, p := range peers.List() {
+			if p.Name == arg {
+				return ageRecipient(p.Key)
+			}
+		}
+	}
+	key, err := identity.ParsePublicKey(arg)
+	if err != nil {
+		return nil, fmt.Errorf("recipient %q is not an age recipient, identity key or known peer", arg)
+	}
+	return ageRecipient(key)
+}
+
+// ageRecipient returns the age recipient of an identity key
+func ageRecipient(key ed25519.PublicKey) (*age.Recipient, error) {
+	public, err := identity.X25519PublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return age.NewRecipient(public)
+}
+
+// loadAgeIdentities reads an age identity file, an identity.pem or an SSH Ed25519 key
+func loadAgeIdentities(path string) ([]*age.Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+	defer crypto.Wipe(data)
+
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		return age.ParseIdentities(bytes.NewReader(data))
+	}
+	id, err := loadIdentityFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer id.Close()
+	ageID, err := age.NewSSHIdentity(id.PublicKey(), id.X25519())
+	if err != nil {
+		return nil, err
+	}
+	return []*age.Identity{ageID}, nil
+}
+
+// transformFile runs fn from the input file (or stdin) to a new output file
+// (or stdout); a partly written output file is removed on error
+func transformFile(input, output string, stdin io.Reader, stdout io.Writer, fn func(dst io.Writer, src io.Reader) error) error {
+	src := stdin
+	if input != "" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+	if output == "" {
+		return fn(stdout, src)
+	}
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	err = fn(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	if jsonOutput {
+		writeJSON(stdout, writtenJSON{Type: "written", Path: output})
+	}
+	return nil
+}
+
+func handleStatus(sess *session.Session) {
+	if jsonOutput {
+		emit(newStatusJSON(sess, transcriptDB, newSettingsJSON(sess)))
+		return
+	}
+	fmt.Println("=== Session Status ===")
+	fmt.Printf("Session established: %v\n", sess.IsEstablished())
+	fmt.Println()
+	fmt.Println("Your public key:")
+	fmt.Println(sess.GetPublicKeyEncoded())
+
+	if sess.IsEstablished() {
+		fmt.Println()
+		if sess.EstablishedByPAKE() {
+			fmt.Println("Established from a PAKE code")
+		} else {
+			fmt.Println("Peer's public key:")
+			fmt.Println(sess.GetPeerPublicKeyBase64())
+		}
+		fmt.Println()
+		words := sess.GetVerificationWords()
+		if words != nil {
+			fmt.Println("Verification words:")
+			fmt.Printf("  %s\n", strings.Join(words, " - "))
+		}
+		fmt.Println()
+		version, caps := sess.GetProtocol()
+		fmt.Printf("Protocol: v%d (capabilities: %s)\n", version, caps)
+		send, recv := sess.GetMessageStats()
+		fmt.Printf("Messages sent: %d, received: %d\n", send, recv)
+		if recv > 0 {
+			fmt.Printf("Last received message: #%d\n", sess.GetLastRecvMsgNum())
+		}
+		d := sess.GetDelivery()
+		fmt.Printf("Delivery: sent %d, peer confirmed %d%s\n", d.Sent, d.Confirmed, formatMissing(d.Missing))
+		if len(d.Unconfirmed) > 0 {
+			fmt.Printf("Awaiting confirmation: %s\n", formatNums(d.Unconfirmed))
+		}
+		for _, st := range sess.PendingParts() {
+			fmt.Printf("Incomplete message #%d: %d of %d parts, missing: %s\n",
+				st.MsgNum, st.Received, st.Total, formatParts(st.Missing))
+		}
+		fmt.Println("(Each message uses a unique key for forward secrecy)")
+	}
+	if ident != nil && sess.GetIdentityPublicKey() != nil {
+		fmt.Printf("Identity: %s\n", identity.SSHPublicKey(ident.PublicKey()))
+	}
+	if sess.GetPeerIdentityKey() != nil {
+		fmt.Println("Peer identity: pinned")
+	}
+	if sess.GetDeniable() {
+		fmt.Println("Deniable mode: on (triple-DH, no signatures)")
+	}
+	if sess.PAKEPending() {
+		fmt.Println("PAKE: waiting for the peer's pake line")
+	}
+	if transcriptDB != nil {
+		fmt.Printf("Transcript: %s\n", transcriptDB.Path())
+	}
+	fmt.Println()
+	printSettings(sess)
+}
+
+// commandHelp describes a REPL command for help
+type commandHelp struct {
+	Usage       string `json:"usage"`
+	Description string `json:"description"`
+}
+
+var commands = []commandHelp{
+	{"key <public-key>", "Import peer's public key to establish secure channel"},
+	{"key --qr <image.png>", "Import peer's public key from a QR code image"},
+	{"key <ssh-ed25519 ...>", "Pin the peer's identity (or: key <file.keys>), needs --identity"},
+	{"pake [code]", "Establish the channel from a short one-time code (new if omitted)"},
+	{"pake <peer's message>", "Finish the code exchange with the line your peer sent"},
+	{"e <plaintext>", "Encrypt a message"},
+	{"e --ttl <dur> <text>", "Encrypt a message that expires (e.g. e --ttl 1h hi)"},
+	{"<msgNum> <ciphertext>", "Decrypt (auto-detected, no 'd' needed)"},
+	{"<msgNum>/<part>/<total> <ciphertext>", "Collect a part of a split message (any order)"},
+	{"batch [file]", "Decrypt many pasted lines (or a file) in number order, with a summary"},
+	{"ack", "Encrypt an ack listing what you received and what is missing"},
+	{"resend <msgNum> [text]", "Repeat an unconfirmed message, or re-encrypt its text"},
+	{"transcript <file|off>", "Record messages to an encrypted transcript file"},
+	{"history [<n>]", "Show the transcript (or its last n messages)"},
+	{"history search <term>", "Search the transcript"},
+	{"export <file>", "Export the transcript as plain text"},
+	{"identity", "Show your identity key for signatures"},
+	{"sign <text>", "Sign a statement anyone can verify without a session"},
+	{"verify", "Verify a pasted signed message against known peers"},
+	{"peers [add|remove ...]", "List, add (peers add <name> <key>) or remove known peers"},
+	{"qr [--sas] [--png <f>]", "Show your public key (and verification words) as a QR code"},
+	{"set [<option> <value>]", "Show or change settings (e.g. set padding pow2 64)"},
+	{"status", "Show current session status"},
+	{"clear-history", "Clear the up/down arrow command history"},
+	{"wipe [-f]", "Destroy keys, transcript, identity and history, then exit"},
+	{"help", "Show this help message"},
+	{"quit / exit / q", "Exit the program"},
+}
+
+func handleHelp() {
+	if jsonOutput {
+		emit(helpJSON{Type: "help", Commands: commands})
+		return
+	}
+	fmt.Println("=== Available Commands ===")
+	fmt.Println()
+	for _, c := range commands {
+		// Long usages get a line of their own
+		if len(c.Usage) > 24 {
+			fmt.Printf("  %s\n", c.Usage)
+			c.Usage = ""
+		}
+		fmt.Printf("  %-24s %s\n", c.Usage, c.Description)
+	}
 	fmt.Println()
 	fmt.Println("=== Usage Flow ===")
 	fmt.Println()
 	fmt.Println("1. Share your public key with your peer (displayed at startup)")
 	fmt.Println("2. Import your peer's public key using: key <their-public-key>")
 	fmt.Println("3. Verify the 5 words match on both sides (MITM protection)")
+	fmt.Println("   (Or skip steps 1-3: run 'pake', tell your peer the code, exchange the pake lines)")
 	fmt.Println("4. Encrypt: e <your message>")
 	fmt.Println("5. Decrypt: paste the received message directly (e.g., 0 abc123...)")
 	fmt.Println()
 	fmt.Println("=== Exit ===")
 	fmt.Println()
 	fmt.Println("  - Type 'quit', 'exit', or 'q' to exit (with confirmation)")
-	fmt.Println("  - Press Ctrl+C twice to force exit")
+	fmt.Println("  - Press Ctrl+C twice to force exit (and wipe, with: set panic-wipe on)")
 }
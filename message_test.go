@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/session"
+)
+
+func TestTypedMessagesRoundTrip(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	messages := []*session.Message{
+		{Type: session.TypeText, Text: "hello"},
+		{Type: session.TypeFileChunk, File: &session.FileChunk{Name: "notes.txt", Index: 2, Total: 3, Data: []byte{0, 1, 2, 255}}},
+		{Type: session.TypeAck, Ack: &session.Ack{Highest: 7, Missing: []uint32{2, 5}}},
+		{Type: session.TypeAck, Ack: &session.Ack{Highest: 0}},
+		{Type: session.TypeReceipt, Receipt: []uint32{0, 1, 300000}},
+		{Type: session.TypeRekey, RekeyKey: bytes.Repeat([]byte{4}, 65)},
+		{Type: session.TypeClose, Text: "bye"},
+		{Type: session.TypeClose},
+	}
+
+	for _, sent := range messages {
+		lines, err := alice.EncryptMessage(sent)
+		if err != nil {
+			t.Fatalf("EncryptMessage(%s) failed: %v", sent.Type, err)
+		}
+		got, err := bob.DecryptMessage(lines[0])
+		if err != nil {
+			t.Fatalf("DecryptMessage(%s) failed: %v", sent.Type, err)
+		}
+		if got.Type != sent.Type || got.Num != sent.Num || got.Text != sent.Text ||
+			!reflect.DeepEqual(got.File, sent.File) || !reflect.DeepEqual(got.Ack, sent.Ack) ||
+			!reflect.DeepEqual(got.Receipt, sent.Receipt) || !bytes.Equal(got.RekeyKey, sent.RekeyKey) {
+			t.Errorf("%s message mismatch:\n got  %+v\n want %+v", sent.Type, got, sent)
+		}
+	}
+}
+
+func TestDecryptRejectsControlMessages(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	lines, _ := alice.EncryptMessage(&session.Message{Type: session.TypeReceipt, Receipt: []uint32{0}})
+	if _, err := bob.Decrypt(lines[0]); err == nil || !strings.Contains(err.Error(), "receipt") {
+		t.Errorf("Expected Decrypt to reject a receipt, got %v", err)
+	}
+}
+
+func TestInvalidTypedMessages(t *testing.T) {
+	alice, _ := establishedPair(t)
+
+	invalid := []*session.Message{
+		{Type: session.TypeFileChunk},
+		{Type: session.TypeFileChunk, File: &session.FileChunk{Index: 4, Total: 3}},
+		{Type: session.TypeAck},
+		{Type: session.TypeReceipt},
+		{Type: session.TypeRekey},
+		{Type: 99},
+	}
+	for _, m := range invalid {
+		if _, err := alice.EncryptMessage(m); err == nil {
+			t.Errorf("Expected EncryptMessage(%+v) to fail", m)
+		}
+	}
+
+	// Rejected messages must not consume a message number
+	if send, _ := alice.GetMessageStats(); send != 0 {
+		t.Errorf("Invalid messages advanced the send counter to %d", send)
+	}
+}
+
+func TestCompressedFileChunk(t *testing.T) {
+	alice, bob := establishedPair(t)
+	alice.SetCompression(true)
+
+	data := []byte(strings.Repeat("line of a log file\n", 500))
+	lines, err := alice.EncryptMessage(&session.Message{
+		Type: session.TypeFileChunk,
+		File: &session.FileChunk{Name: "app.log", Index: 1, Total: 1, Data: data},
+	})
+	if err != nil {
+		t.Fatalf("EncryptMessage failed: %v", err)
+	}
+	if len(lines[0]) > len(data)/4 {
+		t.Errorf("File chunk was not compressed: %d characters", len(lines[0]))
+	}
+
+	m, err := bob.DecryptMessage(lines[0])
+	if err != nil {
+		t.Fatalf("DecryptMessage failed: %v", err)
+	}
+	if m.File == nil || m.File.Name != "app.log" || !bytes.Equal(m.File.Data, data) {
+		t.Error("Decompressed file chunk mismatch")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+
+	"e2e-message/internal/session"
+)
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// seededRand returns a deterministic stream of bytes for seed
+func seededRand(seed string) io.Reader {
+	return hkdf.New(sha256.New, []byte(seed), nil, []byte("e2e-message test rand"))
+}
+
+func TestDeterministicSessions(t *testing.T) {
+	run := func() []string {
+		clock := newFakeClock()
+		alice, _ := session.NewSession(session.WithRand(seededRand("alice")), session.WithClock(clock))
+		bob, _ := session.NewSession(session.WithRand(seededRand("bob")), session.WithClock(clock))
+		alice.SetPeerPublicKey(bob.GetPublicKeyBase64())
+		bob.SetPeerPublicKey(alice.GetPublicKeyBase64())
+
+		out := []string{alice.GetPublicKeyBase64(), bob.GetPublicKeyBase64()}
+		for _, text := range []string{"one", "two", "three"} {
+			ct, err := alice.Encrypt(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(time.Minute)
+			m, err := bob.DecryptMessage(ct)
+			if err != nil || m.Text != text {
+				t.Fatalf("DecryptMessage = %+v, %v", m, err)
+			}
+			out = append(out, ct)
+		}
+		return out
+	}
+
+	first, second := run(), run()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("Output %d differs between runs: %q and %q", i, first[i], second[i])
+		}
+	}
+
+	// The default sources stay random
+	a, _ := session.NewSession()
+	b, _ := session.NewSession()
+	if a.GetPublicKeyBase64() == b.GetPublicKeyBase64() {
+		t.Error("Two default sessions have the same key")
+	}
+}
+
+func TestWithClockSendTime(t *testing.T) {
+	clock := newFakeClock()
+	alice, bob := establishedPair(t, session.WithClock(clock))
+	ct, _ := alice.Encrypt("when")
+	m, err := bob.DecryptMessage(ct)
+	if err != nil || !m.SentAt.Equal(clock.Now()) {
+		t.Errorf("SentAt = %v, %v; want %v", m.SentAt, err, clock.Now())
+	}
+}
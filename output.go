@@ -0,0 +1,521 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"e2e-message/internal/age"
+	"e2e-message/internal/chunk"
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/identity"
+	"e2e-message/internal/session"
+	"e2e-message/internal/transcript"
+)
+
+// With --json, every result is written to stdout as one JSON object per
+// line instead of text, so that GUIs and bots can drive the REPL over pipes.
+// Every object has a "type"; README.md documents each of them
+
+var (
+	jsonOutput bool                  // --json: print results as JSON objects
+	jsonOut    io.Writer = os.Stdout // Where JSON objects are written
+)
+
+// emit writes v as a JSON object on a line of its own
+func emit(v any) {
+	writeJSON(jsonOut, v)
+}
+
+// writeJSON writes v as a JSON object on a line of its own
+func writeJSON(w io.Writer, v any) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false) // Usages are full of <arguments>
+	// The objects hold only strings, numbers, times and slices of them,
+	// which always marshal
+	enc.Encode(v)
+}
+
+// Errors reported by the REPL itself
+var (
+	errNoTranscript = errors.New("no transcript open (use: transcript <file>)")
+	errCancelled    = errors.New("cancelled")
+)
+
+// Errors reported by the daemon
+var (
+	errUnknownSession = errors.New("unknown session")
+	errInvalidParams  = errors.New("invalid params")
+)
+
+// errorCodes are the codes of error objects, checked in order; errors not
+// listed have the code "error"
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{session.ErrClosed, "session_closed"},
+	{session.ErrNotEstablished, "not_established"},
+	{session.ErrInvalidKey, "invalid_key"},
+	{session.ErrUnsupportedProtocol, "unsupported_protocol"},
+	{session.ErrExpired, "expired"},
+	{crypto.ErrAlreadyReceived, "already_received"},
+	{crypto.ErrTooManySkipped, "too_many_skipped"},
+	{session.ErrDecryption, "decryption_failed"},
+	{session.ErrInvalidMessage, "invalid_message"},
+	{errNoTranscript, "no_transcript"},
+	{transcript.ErrWrongPassphrase, "wrong_passphrase"},
+	{identity.ErrPassphraseRequired, "passphrase_required"},
+	{age.ErrNoIdentity, "no_identity"},
+	{errCancelled, "cancelled"},
+	{errUnknownSession, "unknown_session"},
+	{errInvalidParams, "invalid_params"},
+	{fs.ErrNotExist, "not_found"},
+	{fs.ErrExist, "exists"},
+}
+
+// errorCode returns the code of an error object for err
+func errorCode(err error) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return "error"
+}
+
+type errorJSON struct {
+	Type    string `json:"type"` // "error"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newErrorJSON(code, message string) errorJSON {
+	return errorJSON{Type: "error", Code: code, Message: message}
+}
+
+// printError reports an error as "Error: ..." or as an error object
+func printError(err error) {
+	if jsonOutput {
+		emit(newErrorJSON(errorCode(err), err.Error()))
+		return
+	}
+	fmt.Printf("Error: %v\n", err)
+}
+
+// printUsage reports wrong arguments with the command's usage
+func printUsage(usage string) {
+	if jsonOutput {
+		emit(newErrorJSON("usage", usage))
+		return
+	}
+	fmt.Println(usage)
+}
+
+// noteJSON is a result that is only a sentence: "ok" confirms a command,
+// "notice" and "warning" come along with other results
+type noteJSON struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// printNote prints a sentence as text or as a note object of the given type
+func printNote(typ, message string) {
+	if jsonOutput {
+		emit(noteJSON{Type: typ, Message: message})
+		return
+	}
+	fmt.Println(message)
+}
+
+type promptJSON struct {
+	Type   string `json:"type"` // "prompt"
+	Prompt string `json:"prompt"`
+	Secret bool   `json:"secret,omitempty"` // A passphrase
+}
+
+type exitJSON struct {
+	Type  string `json:"type"` // "exit"
+	Wiped bool   `json:"wiped,omitempty"`
+}
+
+type readyJSON struct {
+	Type      string `json:"type"` // "ready"
+	PublicKey string `json:"public_key"`
+	Identity  string `json:"identity,omitempty"`
+	Deniable  bool   `json:"deniable"`
+}
+
+type establishedJSON struct {
+	Type              string   `json:"type"`   // "established"
+	Method            string   `json:"method"` // "key" or "pake"
+	VerificationWords []string `json:"verification_words"`
+	PeerIdentity      bool     `json:"peer_identity"` // Bound to the pinned peer identity
+	Deniable          bool     `json:"deniable"`
+	QRWordsMatch      *bool    `json:"qr_words_match,omitempty"` // key --qr with words only
+}
+
+func newEstablishedJSON(sess *session.Session, method string) establishedJSON {
+	return establishedJSON{
+		Type:              "established",
+		Method:            method,
+		VerificationWords: list(sess.GetVerificationWords()),
+		PeerIdentity:      sess.GetPeerIdentityKey() != nil,
+		Deniable:          sess.GetDeniable(),
+	}
+}
+
+type peerIdentityJSON struct {
+	Type             string `json:"type"` // "peer_identity"
+	Name             string `json:"name,omitempty"`
+	Key              string `json:"key"`
+	Rekeyed          bool   `json:"rekeyed"`
+	IdentityRequired bool   `json:"identity_required"`
+}
+
+type pakeJSON struct {
+	Type string `json:"type"`           // "pake"
+	Code string `json:"code,omitempty"` // Only when generated
+	Line string `json:"line"`           // To send to the peer
+}
+
+type qrJSON struct {
+	Type    string `json:"type"` // "qr"
+	Payload string `json:"payload"`
+	File    string `json:"file,omitempty"`
+	Code    string `json:"code,omitempty"` // Text rendering, without --png
+}
+
+type ciphertextJSON struct {
+	Type     string   `json:"type"` // "ciphertext"
+	Num      uint32   `json:"num"`
+	Kind     string   `json:"kind,omitempty"` // Unknown when repeating a message
+	Lines    []string `json:"lines"`
+	Ack      *ackJSON `json:"ack,omitempty"`
+	Replaces *uint32  `json:"replaces,omitempty"` // resend with new text
+}
+
+type ackJSON struct {
+	Highest uint32   `json:"highest"`
+	Missing []uint32 `json:"missing"`
+}
+
+func newAckJSON(ack *session.Ack) *ackJSON {
+	return &ackJSON{Highest: ack.Highest, Missing: list(ack.Missing)}
+}
+
+type fileJSON struct {
+	Name  string `json:"name"`
+	Index uint32 `json:"index"`
+	Total uint32 `json:"total"`
+	Data  []byte `json:"data"`
+}
+
+type messageJSON struct {
+	Type      string    `json:"type"` // "message"
+	Num       uint32    `json:"num"`
+	Kind      string    `json:"kind"`
+	Text      string    `json:"text,omitempty"`
+	SentAt    time.Time `json:"sent_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	Expired   bool      `json:"expired"`
+	File      *fileJSON `json:"file,omitempty"`
+	Ack       *ackJSON  `json:"ack,omitempty"`
+	Receipt   []uint32  `json:"receipt,omitempty"`
+}
+
+func newMessageJSON(msg *session.Message, now time.Time) messageJSON {
+	m := messageJSON{
+		Type:    "message",
+		Num:     msg.Num,
+		Kind:    msg.Type.String(),
+		Text:    msg.Text,
+		SentAt:  msg.SentAt.UTC(),
+		Expired: msg.Expired(now),
+		Receipt: msg.Receipt,
+	}
+	if msg.TTL > 0 {
+		m.ExpiresAt = msg.ExpiresAt().UTC()
+	}
+	if f := msg.File; f != nil {
+		m.File = &fileJSON{Name: f.Name, Index: f.Index, Total: f.Total, Data: f.Data}
+	}
+	if msg.Ack != nil {
+		m.Ack = newAckJSON(msg.Ack)
+	}
+	return m
+}
+
+type partJSON struct {
+	Type     string `json:"type"` // "part"
+	Num      uint32 `json:"num"`
+	Received int    `json:"received"`
+	Total    int    `json:"total"`
+	Missing  []int  `json:"missing"`
+}
+
+func newPartJSON(st chunk.Status) partJSON {
+	return partJSON{Type: "part", Num: st.MsgNum, Received: st.Received, Total: st.Total, Missing: list(st.Missing)}
+}
+
+type batchJSON struct {
+	Type       string             `json:"type"` // "batch"
+	Messages   []messageJSON      `json:"messages"`
+	Duplicates []uint32           `json:"duplicates"`
+	Failed     []batchFailureJSON `json:"failed"`
+	Invalid    []int              `json:"invalid"` // Lines that are not messages
+	Missing    []uint32           `json:"missing"`
+	Incomplete []partJSON         `json:"incomplete"`
+}
+
+type batchFailureJSON struct {
+	Line    int    `json:"line"`
+	Num     uint32 `json:"num"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newBatchJSON(res *session.BatchResult, now time.Time) batchJSON {
+	b := batchJSON{
+		Type:       "batch",
+		Messages:   []messageJSON{},
+		Duplicates: list(res.Duplicates),
+		Failed:     []batchFailureJSON{},
+		Invalid:    list(res.Invalid),
+		Missing:    list(res.Missing),
+		Incomplete: []partJSON{},
+	}
+	for _, msg := range res.Messages {
+		b.Messages = append(b.Messages, newMessageJSON(msg, now))
+	}
+	for _, f := range res.Failed {
+		b.Failed = append(b.Failed, batchFailureJSON{Line: f.Line, Num: f.Num, Code: errorCode(f.Err), Message: f.Err.Error()})
+	}
+	for _, st := range res.Incomplete {
+		b.Incomplete = append(b.Incomplete, newPartJSON(st))
+	}
+	return b
+}
+
+type settingsJSON struct {
+	Type        string `json:"type"` // "settings"
+	Padding     string `json:"padding"`
+	MinBucket   int    `json:"min_bucket"`
+	Compression bool   `json:"compression"`
+	Encoding    string `json:"encoding"`
+	TTLMillis   int64  `json:"ttl_ms"` // 0 when off
+	Expiry      string `json:"expiry"`
+	PartSize    int    `json:"part_size"`            // 0 when off
+	History     string `json:"history,omitempty"`    // REPL only
+	PanicWipe   *bool  `json:"panic_wipe,omitempty"` // REPL only
+	PublicKey   string `json:"public_key,omitempty"` // After set encoding
+}
+
+// newSettingsJSON returns the session's settings and those of the REPL
+func newSettingsJSON(sess *session.Session) settingsJSON {
+	s := newSessionSettingsJSON(sess)
+	s.History = historyMode.String()
+	wipeOnPanic := panicWipe
+	s.PanicWipe = &wipeOnPanic
+	return s
+}
+
+// newSessionSettingsJSON returns the settings that belong to the session
+// alone, as the daemon reports them
+func newSessionSettingsJSON(sess *session.Session) settingsJSON {
+	scheme, minBucket := sess.GetPadding()
+	return settingsJSON{
+		Type:        "settings",
+		Padding:     scheme.String(),
+		MinBucket:   minBucket,
+		Compression: sess.GetCompression(),
+		Encoding:    sess.GetEncoding().String(),
+		TTLMillis:   sess.GetTTL().Milliseconds(),
+		Expiry:      sess.GetExpiryPolicy().String(),
+		PartSize:    sess.GetPartSize(),
+	}
+}
+
+type statusJSON struct {
+	Type              string        `json:"type"` // "status"
+	Established       bool          `json:"established"`
+	PublicKey         string        `json:"public_key"`
+	PeerPublicKey     string        `json:"peer_public_key,omitempty"`
+	PAKE              bool          `json:"pake"` // Established from a PAKE code
+	VerificationWords []string      `json:"verification_words,omitempty"`
+	Protocol          *protocolJSON `json:"protocol,omitempty"`
+	Sent              uint32        `json:"sent"`
+	Received          uint32        `json:"received"`
+	LastReceived      *uint32       `json:"last_received,omitempty"`
+	Delivery          *deliveryJSON `json:"delivery,omitempty"`
+	Incomplete        []partJSON    `json:"incomplete"`
+	Identity          string        `json:"identity,omitempty"`
+	PeerIdentity      bool          `json:"peer_identity"` // A peer identity is pinned
+	Deniable          bool          `json:"deniable"`
+	PAKEPending       bool          `json:"pake_pending"`
+	Transcript        string        `json:"transcript,omitempty"`
+	Settings          settingsJSON  `json:"settings"`
+}
+
+type protocolJSON struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type deliveryJSON struct {
+	Sent        uint32   `json:"sent"`
+	Confirmed   uint32   `json:"confirmed"`
+	Missing     []uint32 `json:"missing"`
+	Unconfirmed []uint32 `json:"unconfirmed"`
+}
+
+func newStatusJSON(sess *session.Session, tr *transcript.Transcript, settings settingsJSON) statusJSON {
+	st := statusJSON{
+		Type:         "status",
+		Established:  sess.IsEstablished(),
+		PublicKey:    sess.GetPublicKeyEncoded(),
+		Incomplete:   []partJSON{},
+		PeerIdentity: sess.GetPeerIdentityKey() != nil,
+		Deniable:     sess.GetDeniable(),
+		PAKEPending:  sess.PAKEPending(),
+		Settings:     settings,
+	}
+	if st.Established {
+		st.PAKE = sess.EstablishedByPAKE()
+		if !st.PAKE {
+			st.PeerPublicKey = sess.GetPeerPublicKeyBase64()
+		}
+		st.VerificationWords = sess.GetVerificationWords()
+		version, caps := sess.GetProtocol()
+		st.Protocol = &protocolJSON{Version: version, Capabilities: caps.Names()}
+		st.Sent, st.Received = sess.GetMessageStats()
+		if st.Received > 0 {
+			last := sess.GetLastRecvMsgNum()
+			st.LastReceived = &last
+		}
+		d := sess.GetDelivery()
+		st.Delivery = &deliveryJSON{Sent: d.Sent, Confirmed: d.Confirmed, Missing: list(d.Missing), Unconfirmed: list(d.Unconfirmed)}
+		for _, p := range sess.PendingParts() {
+			st.Incomplete = append(st.Incomplete, newPartJSON(p))
+		}
+	}
+	if ident != nil && sess.GetIdentityPublicKey() != nil {
+		st.Identity = identity.SSHPublicKey(ident.PublicKey())
+	}
+	if tr != nil {
+		st.Transcript = tr.Path()
+	}
+	return st
+}
+
+type transcriptJSON struct {
+	Type     string `json:"type"` // "transcript"
+	Open     bool   `json:"open"`
+	Path     string `json:"path,omitempty"`
+	Messages int    `json:"messages"`
+}
+
+func newTranscriptJSON(tr *transcript.Transcript) transcriptJSON {
+	if tr == nil {
+		return transcriptJSON{Type: "transcript"}
+	}
+	return transcriptJSON{Type: "transcript", Open: true, Path: tr.Path(), Messages: len(tr.Entries())}
+}
+
+type historyJSON struct {
+	Type    string      `json:"type"` // "history"
+	Entries []entryJSON `json:"entries"`
+}
+
+type entryJSON struct {
+	Direction string    `json:"direction"` // "sent" or "received"
+	Num       uint32    `json:"num"`
+	Time      time.Time `json:"time"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	Text      string    `json:"text"`
+}
+
+func newHistoryJSON(entries []transcript.Entry) historyJSON {
+	h := historyJSON{Type: "history", Entries: []entryJSON{}}
+	for _, e := range entries {
+		h.Entries = append(h.Entries, entryJSON{
+			Direction: e.Direction.String(),
+			Num:       e.Num,
+			Time:      e.Time.UTC(),
+			ExpiresAt: e.ExpiresAt.UTC(),
+			Text:      e.Text,
+		})
+	}
+	return h
+}
+
+type identityJSON struct {
+	Type         string `json:"type"` // "identity"
+	Key          string `json:"key"`
+	AgeRecipient string `json:"age_recipient,omitempty"`
+}
+
+type signedJSON struct {
+	Type  string `json:"type"`  // "signed"
+	Armor string `json:"armor"` // The signed message to paste
+}
+
+type signatureJSON struct {
+	Type   string `json:"type"` // "signature"
+	Valid  bool   `json:"valid"`
+	Key    string `json:"key"`
+	Known  bool   `json:"known"`
+	Signer string `json:"signer,omitempty"` // Known peer's name
+	Text   string `json:"text,omitempty"`   // Only when valid
+}
+
+func newSignatureJSON(signed *identity.Signed, peers *identity.KnownPeers) signatureJSON {
+	s := signatureJSON{Type: "signature", Valid: signed.Valid(), Key: session.EncodeKey(signed.Key)}
+	if s.Valid {
+		s.Text = signed.Text
+	}
+	if peer, ok := peers.Lookup(signed.Key); ok {
+		s.Known, s.Signer = true, peer.Name
+	}
+	return s
+}
+
+type peersJSON struct {
+	Type  string     `json:"type"` // "peers"
+	Peers []peerJSON `json:"peers"`
+}
+
+type peerJSON struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+func newPeersJSON(peers *identity.KnownPeers) peersJSON {
+	p := peersJSON{Type: "peers", Peers: []peerJSON{}}
+	for _, peer := range peers.List() {
+		p.Peers = append(p.Peers, peerJSON{Name: peer.Name, Key: session.EncodeKey(peer.Key)})
+	}
+	return p
+}
+
+type helpJSON struct {
+	Type     string        `json:"type"` // "help"
+	Commands []commandHelp `json:"commands"`
+}
+
+type writtenJSON struct {
+	Type string `json:"type"` // "written"
+	Path string `json:"path"`
+}
+
+// list returns s, or an empty slice instead of nil so that it is written as []
+func list[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/session"
+)
+
+func TestPaddedLen(t *testing.T) {
+	tests := []struct {
+		n         int
+		scheme    crypto.PaddingScheme
+		minBucket int
+		want      int
+	}{
+		{0, crypto.PaddingNone, 32, 1},
+		{10, crypto.PaddingNone, 32, 11},
+		{2, crypto.PaddingPowerOfTwo, 32, 32},
+		{31, crypto.PaddingPowerOfTwo, 32, 32},
+		{32, crypto.PaddingPowerOfTwo, 32, 64},
+		{100, crypto.PaddingPowerOfTwo, 0, 128},
+		{3, crypto.PaddingPadme, 32, 32},
+		{99, crypto.PaddingPadme, 0, 104},
+		{1000, crypto.PaddingPadme, 0, 1024},
+	}
+
+	for _, tt := range tests {
+		if got := crypto.PaddedLen(tt.n, tt.scheme, tt.minBucket); got != tt.want {
+			t.Errorf("PaddedLen(%d, %s, %d) = %d, want %d", tt.n, tt.scheme, tt.minBucket, got, tt.want)
+		}
+	}
+}
+
+func TestPadUnpad(t *testing.T) {
+	for _, scheme := range []crypto.PaddingScheme{crypto.PaddingNone, crypto.PaddingPadme, crypto.PaddingPowerOfTwo} {
+		for _, msg := range []string{"", "yes", "no", strings.Repeat("\x00", 5), strings.Repeat("long message ", 50)} {
+			padded := crypto.Pad([]byte(msg), scheme, 16)
+			got, err := crypto.Unpad(padded)
+			if err != nil {
+				t.Fatalf("Unpad(%s, %q) failed: %v", scheme, msg, err)
+			}
+			if string(got) != msg {
+				t.Errorf("Round trip (%s): got %q, want %q", scheme, got, msg)
+			}
+		}
+	}
+
+	// Missing end marker
+	if _, err := crypto.Unpad([]byte{1, 2, 0, 0}); err == nil {
+		t.Error("Expected error for padding without end marker")
+	}
+	if _, err := crypto.Unpad(nil); err == nil {
+		t.Error("Expected error for empty input")
+	}
+}
+
+func TestSessionPaddingSameBucket(t *testing.T) {
+	alice, bob := establishedPair(t)
+
+	// "yes" and "no" must be indistinguishable by length
+	yes, err := alice.Encrypt("yes")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	no, err := alice.Encrypt("no")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if ciphertextLen(yes) != ciphertextLen(no) {
+		t.Errorf("Same-bucket messages have different lengths: %d vs %d", ciphertextLen(yes), ciphertextLen(no))
+	}
+
+	for _, ct := range []string{yes, no} {
+		if _, err := bob.Decrypt(ct); err != nil {
+			t.Fatalf("Decrypt failed: %v", err)
+		}
+	}
+
+	// Messages in the same power-of-two bucket match; the next bucket is longer
+	// (each payload also carries a 13-byte header and the padding marker)
+	if err := alice.SetPadding(crypto.PaddingPowerOfTwo, 64); err != nil {
+		t.Fatalf("SetPadding failed: %v", err)
+	}
+	a, _ := alice.Encrypt(strings.Repeat("a", 30))
+	b, _ := alice.Encrypt(strings.Repeat("b", 50))
+	c, _ := alice.Encrypt(strings.Repeat("c", 60))
+	if ciphertextLen(a) != ciphertextLen(b) {
+		t.Errorf("Messages of 30 and 50 bytes should share the 64-byte bucket")
+	}
+	if ciphertextLen(c) <= ciphertextLen(b) {
+		t.Errorf("Message of 60 bytes should be in a larger bucket")
+	}
+
+	for i, ct := range []string{a, b, c} {
+		pt, err := bob.Decrypt(ct)
+		if err != nil {
+			t.Fatalf("Decrypt %d failed: %v", i, err)
+		}
+		if len(pt) != []int{30, 50, 60}[i] {
+			t.Errorf("Decrypted message %d has wrong length %d", i, len(pt))
+		}
+	}
+}
+
+func TestSessionPaddingInvalidBucket(t *testing.T) {
+	sess, _ := session.NewSession()
+	if err := sess.SetPadding(crypto.PaddingPadme, -1); err == nil {
+		t.Error("Expected error for negative minimum bucket")
+	}
+	if err := sess.SetPadding(crypto.PaddingPadme, crypto.MaxMinBucket+1); err == nil {
+		t.Error("Expected error for oversized minimum bucket")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/identity"
+	"e2e-message/internal/session"
+)
+
+func TestHashToP256(t *testing.T) {
+	// RFC 9380, Appendix J.1.1 (P256_XMD:SHA-256_SSWU_RO_)
+	dst := []byte("QUUX-V01-CS02-with-P256_XMD:SHA-256_SSWU_RO_")
+	tests := []struct{ msg, x, y string }{
+		{"",
+			"2c15230b26dbc6fc9a37051158c95b79656e17a1a920b11394ca91c44247d3e4",
+			"8a7a74985cc5c776cdfe4b1f19884970453912e9d31528c060be9ab5c43e8415"},
+		{"abc",
+			"0bb8b87485551aa43ed54f009230450b492fead5f1cc91658775dac4a3388a0f",
+			"5c41b3d0731a27a7b14bc0bf0ccded2d8751f83493404c84a88e71ffd424212e"},
+	}
+	for _, tt := range tests {
+		x, y := crypto.HashToP256([]byte(tt.msg), dst)
+		if hex.EncodeToString(x) != tt.x || hex.EncodeToString(y) != tt.y {
+			t.Errorf("HashToP256(%q) = %x, %x", tt.msg, x, y)
+		}
+	}
+}
+
+// pakeSessions runs a PAKE between two new sessions with the given codes
+func pakeSessions(t *testing.T, codeA, codeB string) (a, b *session.Session) {
+	t.Helper()
+	a, _ = session.NewSession()
+	b, _ = session.NewSession()
+	msgA, err := a.StartPAKE(codeA)
+	if err != nil {
+		t.Fatalf("StartPAKE failed: %v", err)
+	}
+	msgB, err := b.StartPAKE(codeB)
+	if err != nil {
+		t.Fatalf("StartPAKE failed: %v", err)
+	}
+	if err := a.FinishPAKE(msgB); err != nil {
+		t.Fatalf("FinishPAKE failed: %v", err)
+	}
+	if err := b.FinishPAKE(msgA); err != nil {
+		t.Fatalf("FinishPAKE failed: %v", err)
+	}
+	return a, b
+}
+
+func TestPAKESession(t *testing.T) {
+	code, err := session.NewPAKECode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[1-9][0-9]?-[a-z]+-[a-z]+$`).MatchString(code) {
+		t.Fatalf("Unexpected code format %q", code)
+	}
+
+	a, b := pakeSessions(t, code, strings.ToUpper(strings.ReplaceAll(code, "-", " ")))
+	if !a.EstablishedByPAKE() || !b.EstablishedByPAKE() {
+		t.Fatal("Sessions not established by PAKE")
+	}
+	if strings.Join(a.GetVerificationWords(), " ") != strings.Join(b.GetVerificationWords(), " ") {
+		t.Error("Verification words differ")
+	}
+	for i, s := range [][2]*session.Session{{a, b}, {b, a}} {
+		ct, _ := s[0].Encrypt("over the code")
+		if pt, err := s[1].Decrypt(ct); err != nil || pt != "over the code" {
+			t.Errorf("Direction %d: Decrypt = %q, %v", i, pt, err)
+		}
+	}
+
+	// A session key import replaces the PAKE channel
+	c, _ := session.NewSession()
+	if err := a.SetPeerPublicKey(c.GetPublicKeyBase64()); err != nil || a.EstablishedByPAKE() {
+		t.Errorf("SetPeerPublicKey after PAKE: %v, by PAKE %v", err, a.EstablishedByPAKE())
+	}
+}
+
+func TestPAKEWrongCode(t *testing.T) {
+	a, b := pakeSessions(t, "7-guitar-ocean", "7-guitar-otter")
+	ct, _ := a.Encrypt("hello")
+	if _, err := b.Decrypt(ct); err == nil {
+		t.Error("Message decrypted with a different code")
+	}
+
+	// Fresh randomness each time: the same code gives different keys
+	a1, _ := pakeSessions(t, "7-guitar-ocean", "7-guitar-ocean")
+	a2, _ := pakeSessions(t, "7-guitar-ocean", "7-guitar-ocean")
+	if strings.Join(a1.GetVerificationWords(), " ") == strings.Join(a2.GetVerificationWords(), " ") {
+		t.Error("Two exchanges with the same code share keys")
+	}
+}
+
+func TestPAKEInvalidMessages(t *testing.T) {
+	a, _ := session.NewSession()
+	if err := a.FinishPAKE("AAAA"); err == nil {
+		t.Error("FinishPAKE accepted without StartPAKE")
+	}
+	msg, _ := a.StartPAKE("7-guitar-ocean")
+	if err := a.FinishPAKE(msg); err == nil {
+		t.Error("Own message reflected back accepted")
+	}
+	data, _ := session.DecodeKey(msg)
+	hello := data[:len(data)-crypto.PAKEMessageSize]
+	notOnCurve := append(bytes.Clone(hello), make([]byte, 32)...)
+	notOnCurve[len(notOnCurve)-1] = 1 // x = 1 has no y on P-256
+	if err := a.FinishPAKE(session.EncodeKey(notOnCurve)); err == nil {
+		t.Error("Message that is not a curve point accepted")
+	}
+	if err := a.FinishPAKE(session.EncodeKey(append(bytes.Clone(hello), make([]byte, 16)...))); err == nil {
+		t.Error("Short message accepted")
+	}
+	if !a.PAKEPending() || a.IsEstablished() {
+		t.Error("Failed messages should leave the exchange pending")
+	}
+	if _, err := a.StartPAKE(" - "); err == nil {
+		t.Error("Empty code accepted")
+	}
+}
+
+func TestPAKEWithPinnedIdentity(t *testing.T) {
+	alice, _ := identity.Generate()
+	defer alice.Close()
+	bob, _ := identity.Generate()
+	defer bob.Close()
+
+	a, b := pakeSessions(t, "12-koala-radar", "12-koala-radar")
+	words := strings.Join(a.GetVerificationWords(), " ")
+	for _, pin := range []struct {
+		s        *session.Session
+		id, peer *identity.Identity
+	}{{a, alice, bob}, {b, bob, alice}} {
+		x, _ := identity.X25519PublicKey(pin.peer.PublicKey())
+		if err := pin.s.SetIdentityKey(pin.id.X25519()); err != nil {
+			t.Fatal(err)
+		}
+		if err := pin.s.SetPeerIdentityKey(x); err != nil {
+			t.Fatalf("SetPeerIdentityKey after PAKE failed: %v", err)
+		}
+	}
+	if strings.Join(a.GetVerificationWords(), " ") == words {
+		t.Error("Pinning identities did not re-key the PAKE channel")
+	}
+	ct, _ := a.Encrypt("pinned over PAKE")
+	if pt, err := b.Decrypt(ct); err != nil || pt != "pinned over PAKE" {
+		t.Errorf("Decrypt = %q, %v", pt, err)
+	}
+}
+
+func TestIsPAKECode(t *testing.T) {
+	sess, _ := session.NewSession()
+	msg, _ := sess.StartPAKE("7-guitar-ocean")
+	tests := map[string]bool{
+		"7-guitar-ocean":    true,
+		"7 guitar ocean":    true,
+		"42-our-old-mill":   true,
+		"7-Guitar-ocean":    false,
+		"guitar-ocean":      false,
+		msg:                 false,
+		"3ZQ1-4K7D-AB2C":    false,
+		"acorn actor ankle": false,
+	}
+	for arg, want := range tests {
+		if got := isPAKECode(arg); got != want {
+			t.Errorf("isPAKECode(%q) = %v, want %v", arg, got, want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/identity"
+	"e2e-message/internal/session"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// The files in testdata/protocol pin the wire format of each protocol
+// version. Lines starting with "> " are inputs, each followed by the
+// expected "< " result; go test -update rewrites the results:
+//
+//	> key <key>            import a session key into a new session
+//	> deniable-key <key>   the same in deniable mode
+//	> pake <message>       finish a PAKE with a message
+//	> message <line>       decrypt in the session of the last imported key
+//	> ours                 describe what this build sends
+
+func TestProtocolGolden(t *testing.T) {
+	paths, _ := filepath.Glob(filepath.Join("testdata", "protocol", "*.golden"))
+	if len(paths) == 0 {
+		t.Fatal("No golden files")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := runProtocolScript(t, string(want))
+			if *update {
+				if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if got != string(want) {
+				t.Errorf("%s differs:\n--- got\n%s\n--- want\n%s", path, got, want)
+			}
+		})
+	}
+}
+
+// runProtocolScript replaces the results in a golden file with fresh ones
+func runProtocolScript(t *testing.T, script string) string {
+	var out strings.Builder
+	var last *session.Session
+	sc := bufio.NewScanner(strings.NewReader(script))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "< ") {
+			continue
+		}
+		out.WriteString(line + "\n")
+		input, ok := strings.CutPrefix(line, "> ")
+		if !ok {
+			continue
+		}
+		cmd, arg, _ := strings.Cut(input, " ")
+		var result string
+		switch cmd {
+		case "key", "deniable-key":
+			sess := newSessionForKey(t, cmd == "deniable-key")
+			result = protocolResult(sess, sess.SetPeerPublicKey(arg))
+			if sess.IsEstablished() && cmd == "key" {
+				last = sess
+			}
+		case "pake":
+			sess, _ := session.NewSession()
+			sess.StartPAKE("1-test-code")
+			result = protocolResult(sess, sess.FinishPAKE(arg))
+		case "message":
+			if last == nil {
+				t.Fatalf("%q before any key", line)
+			}
+			if _, err := last.DecryptMessage(arg); err != nil {
+				result = "error: " + err.Error()
+			} else {
+				result = "ok"
+			}
+		case "ours":
+			result = describeOurFormat(t)
+		default:
+			t.Fatalf("Unknown golden command %q", cmd)
+		}
+		out.WriteString("< " + result + "\n")
+	}
+	return out.String()
+}
+
+// newSessionForKey creates a session, in deniable mode with identities
+func newSessionForKey(t *testing.T, deniable bool) *session.Session {
+	sess, _ := session.NewSession()
+	if deniable {
+		id, _ := identity.Generate()
+		defer id.Close()
+		sess.SetDeniable(true)
+		sess.SetIdentityKey(id.X25519())
+		x, _ := identity.X25519PublicKey(id.PublicKey())
+		sess.SetPeerIdentityKey(x)
+	}
+	return sess
+}
+
+func protocolResult(sess *session.Session, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	v, caps := sess.GetProtocol()
+	return fmt.Sprintf("v%d, %s", v, caps)
+}
+
+// describeOurFormat lists the hellos and the message version byte we send
+func describeOurFormat(t *testing.T) string {
+	a, _ := session.NewSession()
+	b, _ := session.NewSession()
+	d, _ := session.NewSession()
+	d.SetDeniable(true)
+	p, _ := session.NewSession()
+	msg, _ := p.StartPAKE("1-test-code")
+
+	hello := func(encoded string, size int) string {
+		data, _ := session.DecodeKey(encoded)
+		return fmt.Sprintf("%x + %d bytes", data[:len(data)-size], size)
+	}
+	a.SetPeerPublicKey(b.GetPublicKeyBase64())
+	ct, err := a.Encrypt("hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, _ := strings.Cut(ct, " ")
+	data, _ := session.DecodeKey(c)
+	return fmt.Sprintf("key %s, deniable key %s, pake %s, message version %02x",
+		hello(a.GetPublicKeyBase64(), 65), hello(d.GetPublicKeyBase64(), 32), hello(msg, 32), data[0])
+}
+
+func TestUnsupportedProtocolError(t *testing.T) {
+	a, _ := session.NewSession()
+	b, _ := session.NewSession()
+	key, _ := session.DecodeKey(b.GetPublicKeyBase64())
+	if err := a.SetPeerPublicKey(session.EncodeKey(key[4:])); !errors.Is(err, session.ErrUnsupportedProtocol) {
+		t.Errorf("Unversioned key: %v", err)
+	}
+}
+
+func TestHelloAuthenticated(t *testing.T) {
+	// An attacker strips the compression capability from Bob's hello on
+	// its way to Alice; both still negotiate, but with different hellos
+	alice, bob := newSessions(t)
+	key, _ := session.DecodeKey(bob.GetPublicKeyBase64())
+	key[3] = 0
+	if err := alice.SetPeerPublicKey(session.EncodeKey(key)); err != nil {
+		t.Fatalf("Alice failed to import the altered key: %v", err)
+	}
+	if err := bob.SetPeerPublicKey(alice.GetPublicKeyBase64()); err != nil {
+		t.Fatalf("Bob failed to import Alice's key: %v", err)
+	}
+
+	if strings.Join(alice.GetVerificationWords(), " ") == strings.Join(bob.GetVerificationWords(), " ") {
+		t.Error("Verification words match despite the altered hello")
+	}
+	ct, err := alice.Encrypt("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Decrypt(ct); !errors.Is(err, session.ErrDecryption) {
+		t.Errorf("Message across altered hellos: %v", err)
+	}
+}
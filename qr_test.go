@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/qr"
+	"e2e-message/internal/session"
+)
+
+func TestQRRoundTrip(t *testing.T) {
+	payloads := []string{
+		"a",
+		"Hello, World!",
+		strings.Repeat("0123456789", 8),
+		strings.Repeat("x", 150),
+	}
+
+	for _, level := range []qr.Level{qr.LevelL, qr.LevelM, qr.LevelQ, qr.LevelH} {
+		for _, payload := range payloads {
+			code, err := qr.Encode([]byte(payload), level)
+			if err != nil {
+				// Long payloads may not fit at high correction levels
+				if level >= qr.LevelQ && len(payload) > 100 {
+					continue
+				}
+				t.Fatalf("Encode(len=%d, level=%d) failed: %v", len(payload), level, err)
+			}
+
+			decoded, err := qr.Decode(code.Image(4))
+			if err != nil {
+				t.Fatalf("Decode(len=%d, level=%d, version=%d) failed: %v", len(payload), level, code.Version, err)
+			}
+			if string(decoded) != payload {
+				t.Errorf("Round trip mismatch at level %d: got %q, want %q", level, decoded, payload)
+			}
+		}
+	}
+}
+
+func TestQRPublicKeyPNG(t *testing.T) {
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	pubKey := sess.GetPublicKeyBase64()
+
+	code, err := qr.Encode([]byte(pubKey), qr.LevelM)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	// Write and re-read as PNG, as the key --qr command does
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, code.Image(3)); err != nil {
+		t.Fatalf("PNG encode failed: %v", err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("PNG decode failed: %v", err)
+	}
+
+	decoded, err := qr.Decode(img)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if string(decoded) != pubKey {
+		t.Errorf("Key mismatch: got %q, want %q", decoded, pubKey)
+	}
+
+	// The decoded key must be importable
+	peer, _ := session.NewSession()
+	if err := peer.SetPeerPublicKey(string(decoded)); err != nil {
+		t.Errorf("Decoded key rejected: %v", err)
+	}
+}
+
+func TestQRRotated(t *testing.T) {
+	payload := "rotation test payload"
+	code, err := qr.Encode([]byte(payload), qr.LevelM)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	for _, degrees := range []float64{90, 180, 270, 17, -30} {
+		img := rotate(code.Image(6), degrees)
+		decoded, err := qr.Decode(img)
+		if err != nil {
+			t.Errorf("Decode rotated by %v failed: %v", degrees, err)
+			continue
+		}
+		if string(decoded) != payload {
+			t.Errorf("Rotated by %v: got %q, want %q", degrees, decoded, payload)
+		}
+	}
+}
+
+func TestQRErrorCorrection(t *testing.T) {
+	payload := strings.Repeat("damaged but readable ", 3)
+	code, err := qr.Encode([]byte(payload), qr.LevelH)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	// Blot out a patch in the middle of the symbol
+	const scale = 4
+	img := code.Image(scale).(*image.Gray)
+	center := img.Bounds().Dx() / 2
+	for y := center - 3*scale; y < center+3*scale; y++ {
+		for x := center - 3*scale; x < center+3*scale; x++ {
+			img.SetGray(x, y, color.Gray{Y: 0})
+		}
+	}
+
+	decoded, err := qr.Decode(img)
+	if err != nil {
+		t.Fatalf("Decode of damaged code failed: %v", err)
+	}
+	if string(decoded) != payload {
+		t.Errorf("Damaged code: got %q, want %q", decoded, payload)
+	}
+}
+
+func TestQRTooLong(t *testing.T) {
+	if _, err := qr.Encode(make([]byte, 1000), qr.LevelL); err == nil {
+		t.Error("Expected error for payload exceeding QR capacity")
+	}
+}
+
+func TestQRNoCode(t *testing.T) {
+	blank := image.NewGray(image.Rect(0, 0, 100, 100))
+	if _, err := qr.Decode(blank); err == nil {
+		t.Error("Expected error when decoding an image without a QR code")
+	}
+}
+
+func TestQRTerminalRendering(t *testing.T) {
+	code, err := qr.Encode([]byte("terminal"), qr.LevelM)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(code.String(), "\n"), "\n")
+	width := code.Size + 8 // 4-module quiet zone on both sides
+	if len(lines) != (width+1)/2 {
+		t.Errorf("Expected %d lines, got %d", (width+1)/2, len(lines))
+	}
+	for i, l := range lines {
+		if n := len([]rune(l)); n != width {
+			t.Errorf("Line %d has %d columns, want %d", i, n, width)
+		}
+	}
+
+	// The quiet zone is light: two full lines at the top and four columns on each side
+	full := strings.Repeat("█", width)
+	if lines[0] != full || lines[1] != full {
+		t.Errorf("Top quiet zone is not light:\n%s\n%s", lines[0], lines[1])
+	}
+	for i, l := range lines[:len(lines)-1] {
+		r := []rune(l)
+		if string(r[:4]) != "████" || string(r[width-4:]) != "████" {
+			t.Errorf("Line %d has no light quiet zone at its sides: %q", i, l)
+		}
+	}
+}
+
+func TestQRImageQuietZone(t *testing.T) {
+	code, err := qr.Encode([]byte("quiet zone"), qr.LevelM)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	const scale = 3
+	img := code.Image(scale).(*image.Gray)
+	dim := img.Bounds().Dx()
+	if dim != (code.Size+8)*scale {
+		t.Fatalf("Image is %d pixels wide, want %d", dim, (code.Size+8)*scale)
+	}
+	for i := 0; i < dim; i++ {
+		for j := 0; j < 4*scale; j++ {
+			for _, p := range [][2]int{{i, j}, {j, i}, {i, dim - 1 - j}, {dim - 1 - j, i}} {
+				if img.GrayAt(p[0], p[1]).Y != 0xFF {
+					t.Fatalf("Pixel %v in the quiet zone is not white", p)
+				}
+			}
+		}
+	}
+}
+
+// rotate returns img rotated by the given angle on a white canvas
+func rotate(img image.Image, degrees float64) image.Image {
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	dim := int(math.Ceil(math.Hypot(w, h))) + 10
+	out := image.NewGray(image.Rect(0, 0, dim, dim))
+
+	rad := degrees * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	c := float64(dim) / 2
+	for y := 0; y < dim; y++ {
+		for x := 0; x < dim; x++ {
+			// Inverse-map each output pixel into the source image
+			dx, dy := float64(x)-c, float64(y)-c
+			sx := cos*dx + sin*dy + w/2
+			sy := -sin*dx + cos*dy + h/2
+			v := color.Gray{Y: 0xFF}
+			if sx >= 0 && sy >= 0 && sx < w && sy < h {
+				v = color.GrayModel.Convert(img.At(b.Min.X+int(sx), b.Min.Y+int(sy))).(color.Gray)
+			}
+			out.SetGray(x, y, v)
+		}
+	}
+	return out
+}
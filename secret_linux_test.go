@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"e2e-message/internal/crypto"
+)
+
+// vmFlags returns the VmFlags of the mapping containing addr
+func vmFlags(t *testing.T, addr uintptr) []string {
+	t.Helper()
+	f, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		t.Skipf("smaps not available: %v", err)
+	}
+	defer f.Close()
+
+	inside := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		text := sc.Text()
+		var start, end uintptr
+		if n, _ := fmt.Sscanf(text, "%x-%x", &start, &end); n == 2 && strings.Contains(text, " ") {
+			inside = addr >= start && addr < end
+			continue
+		}
+		if inside && strings.HasPrefix(text, "VmFlags:") {
+			return strings.Fields(strings.TrimPrefix(text, "VmFlags:"))
+		}
+	}
+	t.Fatalf("no mapping found for %#x", addr)
+	return nil
+}
+
+func TestSecretExcludedFromCoreDumps(t *testing.T) {
+	s, err := crypto.NewSecret(32)
+	if err != nil {
+		t.Fatalf("NewSecret failed: %v", err)
+	}
+	defer s.Destroy()
+
+	flags := vmFlags(t, uintptr(unsafe.Pointer(&s.Bytes()[0])))
+	has := func(flag string) bool {
+		for _, f := range flags {
+			if f == flag {
+				return true
+			}
+		}
+		return false
+	}
+	if !has("dd") {
+		t.Errorf("Secret memory is not excluded from core dumps (VmFlags: %v)", flags)
+	}
+	if s.Locked() != has("lo") {
+		t.Errorf("Locked() = %v but VmFlags are %v", s.Locked(), flags)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/session"
+)
+
+func TestSecretLifecycle(t *testing.T) {
+	src := []byte("0123456789abcdef0123456789abcdef")
+	s, err := crypto.SecretFrom(src)
+	if err != nil {
+		t.Fatalf("SecretFrom failed: %v", err)
+	}
+	if string(s.Bytes()) != "0123456789abcdef0123456789abcdef" {
+		t.Error("Secret does not hold the source bytes")
+	}
+	for _, b := range src {
+		if b != 0 {
+			t.Fatal("SecretFrom did not wipe the source")
+		}
+	}
+	t.Logf("secret locked in memory: %v", s.Locked())
+
+	s.Destroy()
+	if s.Bytes() != nil || s.Locked() {
+		t.Error("Destroyed secret still exposes memory")
+	}
+	s.Destroy() // Safe to repeat
+
+	var nilSecret *crypto.Secret
+	nilSecret.Destroy()
+	if _, err := crypto.NewSecret(0); err == nil {
+		t.Error("Expected error for empty secret")
+	}
+}
+
+// TestSecretFinalized checks that a slice from Bytes stays readable after its
+// Secret was collected; the finalizer zeroes the memory but keeps it mapped
+func TestSecretFinalized(t *testing.T) {
+	b := func() []byte {
+		s, err := crypto.SecretFrom(bytes.Repeat([]byte{0xFF}, 32))
+		if err != nil {
+			t.Fatalf("SecretFrom failed: %v", err)
+		}
+		return s.Bytes()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b[0] != 0 { // Reading would fault if the memory had been unmapped
+		if time.Now().After(deadline) {
+			t.Skip("The finalizer did not run")
+		}
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	if !bytes.Equal(b, make([]byte, 32)) {
+		t.Errorf("Finalized secret not zeroed: %x", b)
+	}
+}
+
+func TestRatchetClose(t *testing.T) {
+	r, _ := crypto.NewRatchet(make([]byte, 32), nil, true)
+	r.GetRecvKey(3) // Caches skipped keys 0-2
+	r.Close()
+
+	if _, _, err := r.NextSendKey(); err == nil {
+		t.Error("Expected NextSendKey to fail after Close")
+	}
+	if _, err := r.GetRecvKey(0); err == nil {
+		t.Error("Skipped key survived Close")
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	alice, bob := establishedPair(t)
+	ct, _ := alice.Encrypt("before close")
+
+	bob.Close()
+	if _, err := bob.Decrypt(ct); !errors.Is(err, session.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Decrypt, got %v", err)
+	}
+	if _, err := bob.Encrypt("after close"); !errors.Is(err, session.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Encrypt, got %v", err)
+	}
+	if err := bob.SetPeerPublicKey(alice.GetPublicKeyBase64()); !errors.Is(err, session.ErrClosed) {
+		t.Errorf("Expected ErrClosed from SetPeerPublicKey, got %v", err)
+	}
+	if bob.IsEstablished() || bob.GetVerificationWords() != nil || bob.GetPeerPublicKeyBase64() != "" {
+		t.Error("Closed session still exposes channel state")
+	}
+	bob.Close() // Safe to repeat
+}
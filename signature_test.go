@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/identity"
+	"e2e-message/internal/session"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	id, err := identity.Generate()
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	defer id.Close()
+
+	for _, text := range []string{
+		"I, Alice, own this key",
+		"two\nlines",
+		"-----END E2E-MESSAGE SIGNATURE-----",
+		"- dashed\n--\n",
+		"a\n  -----BEGIN E2E-MESSAGE SIGNATURE-----\nb",
+		" -----END E2E-MESSAGE SIGNATURE-----\nafter",
+		"\t- indented",
+	} {
+		armored := id.Sign(text)
+		if !strings.HasPrefix(armored, identity.BeginMessage+"\n") {
+			t.Fatalf("Unexpected armor:\n%s", armored)
+		}
+		// handleVerify reads up to the first line that is the END line once
+		// trimmed, so only the real one may be
+		lines := strings.Split(armored, "\n")
+		for i, l := range lines[:len(lines)-2] {
+			if l := strings.TrimSpace(l); l == identity.EndSignature || (i > 0 && l == identity.BeginMessage) {
+				t.Errorf("Text of %q reads as an armor line: %q", text, l)
+			}
+		}
+		signed, err := identity.ParseSigned("Forwarded:\n" + armored + "\nthanks")
+		if err != nil {
+			t.Fatalf("ParseSigned(%q) failed: %v", text, err)
+		}
+		if signed.Text != text || !signed.Key.Equal(id.PublicKey()) || !signed.Valid() {
+			t.Errorf("Round trip of %q gave %+v (valid %v)", text, signed, signed.Valid())
+		}
+	}
+
+	// Altering the text breaks the signature
+	armored := strings.Replace(id.Sign("pay 10 EUR"), "10", "99", 1)
+	signed, err := identity.ParseSigned(armored)
+	if err != nil {
+		t.Fatalf("ParseSigned failed: %v", err)
+	}
+	if signed.Valid() {
+		t.Error("Altered message verified")
+	}
+
+	if _, err := identity.ParseSigned("no armor here"); err == nil {
+		t.Error("Expected error for missing armor")
+	}
+	truncated := strings.TrimSuffix(id.Sign("hi"), identity.EndSignature+"\n")
+	if _, err := identity.ParseSigned(truncated); err == nil {
+		t.Error("Expected error for missing END line")
+	}
+}
+
+func TestIdentityPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.pem")
+
+	id, created, err := identity.LoadOrCreate(path)
+	if err != nil || !created {
+		t.Fatalf("LoadOrCreate = %v, %v", created, err)
+	}
+	armored := id.Sign("hello")
+	id.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("Identity file mode %v, want 0600", perm)
+	}
+
+	id, created, err = identity.LoadOrCreate(path)
+	if err != nil || created {
+		t.Fatalf("Reloading = %v, %v", created, err)
+	}
+	defer id.Close()
+	signed, _ := identity.ParseSigned(armored)
+	if !signed.Key.Equal(id.PublicKey()) {
+		t.Error("Reloaded identity has a different key")
+	}
+}
+
+func TestKnownPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	alice, _ := identity.Generate()
+	defer alice.Close()
+	bob, _ := identity.Generate()
+	defer bob.Close()
+
+	peers, err := identity.LoadPeers(path)
+	if err != nil {
+		t.Fatalf("LoadPeers failed: %v", err)
+	}
+	if err := peers.Add("alice", alice.PublicKey()); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := peers.Add("alice", bob.PublicKey()); err == nil {
+		t.Error("Duplicate name accepted")
+	}
+	if err := peers.Add("alice2", alice.PublicKey()); err == nil {
+		t.Error("Duplicate key accepted")
+	}
+	if err := peers.Add("bob smith", bob.PublicKey()); err == nil {
+		t.Error("Name with a space accepted")
+	}
+
+	// Keys are accepted in any supported encoding
+	key, err := identity.ParsePublicKey(session.EncodeKey(bob.PublicKey()))
+	if err != nil || !key.Equal(bob.PublicKey()) {
+		t.Fatalf("ParsePublicKey = %v, %v", key, err)
+	}
+	if _, err := identity.ParsePublicKey(session.EncodeKey(make([]byte, 65))); err == nil {
+		t.Error("Session key accepted as identity key")
+	}
+	peers.Add("bob", key)
+
+	peers, err = identity.LoadPeers(path)
+	if err != nil {
+		t.Fatalf("Reloading failed: %v", err)
+	}
+	if p, ok := peers.Lookup(bob.PublicKey()); !ok || p.Name != "bob" {
+		t.Errorf("Lookup(bob) = %+v, %v", p, ok)
+	}
+
+	signed, _ := identity.ParseSigned(alice.Sign("statement"))
+	if got := describeSignature(signed, peers); !strings.HasPrefix(got, "Good signature from alice") {
+		t.Errorf("describeSignature = %q", got)
+	}
+	if err := peers.Remove("alice"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if got := describeSignature(signed, peers); !strings.Contains(got, "UNKNOWN") {
+		t.Errorf("describeSignature after remove = %q", got)
+	}
+	signed.Text += "!"
+	if got := describeSignature(signed, peers); !strings.HasPrefix(got, "BAD signature") {
+		t.Errorf("describeSignature of altered text = %q", got)
+	}
+}
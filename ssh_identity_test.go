@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"e2e-message/internal/identity"
+	"e2e-message/internal/session"
+)
+
+// Keys in testdata/ssh were created with ssh-keygen -t ed25519; the
+// protected one has the passphrase "correct horse", and github.keys is in
+// the format of https://github.com/<user>.keys (an RSA and an Ed25519 key)
+
+func sshTestFile(name string) string {
+	return filepath.Join("testdata", "ssh", name)
+}
+
+func TestSSHIdentity(t *testing.T) {
+	id, err := identity.Load(sshTestFile("id_ed25519"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer id.Close()
+
+	pub, _ := os.ReadFile(sshTestFile("id_ed25519.pub"))
+	key, err := identity.ParsePublicKey(string(pub))
+	if err != nil {
+		t.Fatalf("ParsePublicKey failed: %v", err)
+	}
+	if !key.Equal(id.PublicKey()) {
+		t.Error("Private and public SSH key do not match")
+	}
+	if got := identity.SSHPublicKey(key); !strings.HasPrefix(string(pub), got+" ") {
+		t.Errorf("SSHPublicKey = %q, want prefix of %q", got, pub)
+	}
+
+	data, _ := os.ReadFile(sshTestFile("github.keys"))
+	keys, err := identity.ParseAuthorizedKeys(data)
+	if err != nil || len(keys) != 1 || !keys[0].Equal(key) {
+		t.Errorf("ParseAuthorizedKeys = %v, %v", keys, err)
+	}
+	if got, err := parseIdentityArg(sshTestFile("github.keys")); err != nil || !got.Equal(key) {
+		t.Errorf("parseIdentityArg(github.keys) = %v, %v", got, err)
+	}
+
+	if _, err := identity.ParsePublicKey(strings.SplitN(string(data), "\n", 2)[0]); err == nil {
+		t.Error("RSA key accepted as identity")
+	}
+}
+
+func TestSSHIdentityPassphrase(t *testing.T) {
+	path := sshTestFile("id_ed25519_protected")
+	if _, err := identity.Load(path); !errors.Is(err, identity.ErrPassphraseRequired) {
+		t.Fatalf("Expected ErrPassphraseRequired, got %v", err)
+	}
+	if _, err := identity.LoadWithPassphrase(path, []byte("wrong")); err == nil {
+		t.Error("Wrong passphrase accepted")
+	}
+	id, err := identity.LoadWithPassphrase(path, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("LoadWithPassphrase failed: %v", err)
+	}
+	defer id.Close()
+
+	pub, _ := os.ReadFile(path + ".pub")
+	key, _ := identity.ParsePublicKey(string(pub))
+	if !key.Equal(id.PublicKey()) {
+		t.Error("Decrypted key does not match its public key")
+	}
+}
+
+// identitySession creates a session using id and pinning peer
+func identitySession(t *testing.T, id *identity.Identity, peer *identity.Identity) *session.Session {
+	t.Helper()
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.SetIdentityKey(id.X25519()); err != nil {
+		t.Fatalf("SetIdentityKey failed: %v", err)
+	}
+	x, err := identity.X25519PublicKey(peer.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.SetPeerIdentityKey(x); err != nil {
+		t.Fatalf("SetPeerIdentityKey failed: %v", err)
+	}
+	return sess
+}
+
+func TestPinnedIdentitySession(t *testing.T) {
+	alice, err := identity.Load(sshTestFile("id_ed25519"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, _ := identity.Generate()
+	defer bob.Close()
+	mallory, _ := identity.Generate()
+	defer mallory.Close()
+
+	connect := func(a, b *session.Session) {
+		t.Helper()
+		if err := a.SetPeerPublicKey(b.GetPublicKeyBase64()); err != nil {
+			t.Fatalf("SetPeerPublicKey failed: %v", err)
+		}
+		if err := b.SetPeerPublicKey(a.GetPublicKeyBase64()); err != nil {
+			t.Fatalf("SetPeerPublicKey failed: %v", err)
+		}
+	}
+
+	a := identitySession(t, alice, bob)
+	b := identitySession(t, bob, alice)
+	connect(a, b)
+	ct, _ := a.Encrypt("pinned hello")
+	if pt, err := b.Decrypt(ct); err != nil || pt != "pinned hello" {
+		t.Fatalf("Decrypt = %q, %v", pt, err)
+	}
+
+	// Sessions between the same identities still get fresh keys
+	a2 := identitySession(t, alice, bob)
+	b2 := identitySession(t, bob, alice)
+	connect(a2, b2)
+	if _, err := b2.Decrypt(ct); err == nil {
+		t.Error("Message from an earlier session decrypted")
+	}
+	if strings.Join(a.GetVerificationWords(), " ") == strings.Join(a2.GetVerificationWords(), " ") {
+		t.Error("Two sessions share verification words")
+	}
+
+	// Bob pinned Mallory, who relays Alice's session key: no shared channel
+	a3 := identitySession(t, alice, bob)
+	m := identitySession(t, mallory, alice)
+	connect(a3, m)
+	ct, _ = a3.Encrypt("for Bob only")
+	if _, err := m.Decrypt(ct); err == nil {
+		t.Error("Holder of the wrong identity decrypted the message")
+	}
+
+	// Pinning a peer requires an identity of our own
+	plain, _ := session.NewSession()
+	x, _ := identity.X25519PublicKey(bob.PublicKey())
+	plain.SetPeerIdentityKey(x)
+	if err := plain.SetPeerPublicKey(b.GetPublicKeyBase64()); err == nil {
+		t.Error("Pinned channel established without an own identity")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/transcript"
+)
+
+func TestTranscriptPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.e2et")
+
+	tr, err := transcript.Create(path, "correct horse")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	sent := time.Now().Truncate(time.Second)
+	tr.Add(transcript.Entry{Direction: transcript.Sent, Num: 0, Time: sent, Text: "hello Bob"})
+	tr.Add(transcript.Entry{Direction: transcript.Received, Num: 0, Time: sent, Text: "hi Alice"})
+	tr.Close()
+
+	raw, _ := os.ReadFile(path)
+	if bytes.Contains(raw, []byte("hello Bob")) {
+		t.Error("Transcript file contains plaintext")
+	}
+
+	if _, err := transcript.Open(path, "wrong"); !errors.Is(err, transcript.ErrWrongPassphrase) {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+	if _, err := transcript.Create(path, "correct horse"); err == nil {
+		t.Error("Create should not overwrite an existing transcript")
+	}
+
+	tr, err = transcript.Open(path, "correct horse")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	entries := tr.Entries()
+	if len(entries) != 2 || entries[0].Text != "hello Bob" || entries[1].Direction != transcript.Received {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+	if !entries[0].Time.Equal(sent) {
+		t.Errorf("Time not preserved: %v vs %v", entries[0].Time, sent)
+	}
+}
+
+func TestTranscriptSearchAndExport(t *testing.T) {
+	tr, err := transcript.Create(filepath.Join(t.TempDir(), "t"), "pw")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	now := time.Now()
+	for i, text := range []string{"Meet at the Station", "bring the keys", "station is closed"} {
+		tr.Add(transcript.Entry{Num: uint32(i), Time: now, Text: text})
+	}
+
+	found := tr.Search("station")
+	if len(found) != 2 || found[0].Num != 0 || found[1].Num != 2 {
+		t.Errorf("Search returned %+v", found)
+	}
+
+	var buf bytes.Buffer
+	if err := tr.Export(&buf); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[1], "> #1 bring the keys") {
+		t.Errorf("Unexpected export:\n%s", buf.String())
+	}
+}
+
+func TestTranscriptPurgesExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t")
+	tr, err := transcript.Create(path, "pw")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	now := time.Now()
+	tr.Add(transcript.Entry{Num: 0, Time: now, Text: "keep"})
+	tr.Add(transcript.Entry{Num: 1, Time: now, ExpiresAt: now.Add(20 * time.Millisecond), Text: "self-destruct"})
+	if len(tr.Entries()) != 2 {
+		t.Fatal("Unexpired message missing")
+	}
+	tr.Close()
+
+	time.Sleep(30 * time.Millisecond)
+	tr, err = transcript.Open(path, "pw")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	entries := tr.Entries()
+	if len(entries) != 1 || entries[0].Text != "keep" {
+		t.Errorf("Expired message not purged: %+v", entries)
+	}
+	if n, err := tr.Purge(); n != 0 || err != nil {
+		t.Errorf("Purge after open removed %d, %v", n, err)
+	}
+}
+
+func TestTranscriptVersion1Upgraded(t *testing.T) {
+	// A version 1 file: magic, version, salt and the encrypted entries
+	path := filepath.Join(t.TempDir(), "old.e2et")
+	salt, _ := crypto.NewSalt()
+	key, err := crypto.DeriveKeyFromPassphrase("correct horse", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := crypto.Encrypt([]byte(`[{"dir":0,"num":4,"time":"2024-05-01T10:00:00Z","text":"old message"}]`), key.Bytes())
+	key.Destroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := append(append([]byte("E2ET\x01"), salt...), ciphertext...)
+	if err := os.WriteFile(path, v1, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := transcript.Open(path, "wrong"); !errors.Is(err, transcript.ErrWrongPassphrase) {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+	tr, err := transcript.Open(path, "correct horse")
+	if err != nil {
+		t.Fatalf("Open of a version 1 file failed: %v", err)
+	}
+	if entries := tr.Entries(); len(entries) != 1 || entries[0].Text != "old message" || entries[0].Num != 4 {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+	if err := tr.SetDuressPassphrase("duress"); err != nil {
+		t.Fatalf("SetDuressPassphrase failed: %v", err)
+	}
+	tr.Close()
+
+	raw, _ := os.ReadFile(path)
+	if raw[4] != 2 {
+		t.Errorf("File not upgraded: version %d", raw[4])
+	}
+	if _, err := transcript.Open(path, "duress"); !errors.Is(err, transcript.ErrDuress) {
+		t.Errorf("Expected ErrDuress after the upgrade, got %v", err)
+	}
+
+	// Unknown versions are refused as such, not as a wrong passphrase
+	raw[4] = 9
+	os.WriteFile(path, raw, 0o600)
+	if _, err := transcript.Open(path, "correct horse"); err == nil || errors.Is(err, transcript.ErrWrongPassphrase) || !strings.Contains(err.Error(), "version 9") {
+		t.Errorf("Expected an unsupported version error, got %v", err)
+	}
+}
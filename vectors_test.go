@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"e2e-message/internal/crypto"
+	"e2e-message/internal/session"
+)
+
+// testdata/vectors/v1.json holds known-answer vectors for protocol v1:
+// fixed key pairs, and for a short conversation the chain keys, message
+// keys, payloads and ciphertexts with fixed nonces. TestVectors recomputes
+// everything from the inputs with the low-level primitives, the way another
+// implementation would; go test -update regenerates the file
+
+var vectorsPath = filepath.Join("testdata", "vectors", "v1.json")
+
+type vectorParty struct {
+	PrivateKey string `json:"private_key"` // P-256 scalar, hex
+	PublicKey  string `json:"public_key"`  // Uncompressed point, hex
+	WireKey    string `json:"wire_key"`    // Hello and key in Base64, as shown to users
+}
+
+type vectorMessage struct {
+	Sender       string `json:"sender"` // "alice" or "bob"
+	Num          uint32 `json:"num"`
+	ChainKey     string `json:"chain_key"` // Sender's chain key before the message
+	MessageKey   string `json:"message_key"`
+	NextChainKey string `json:"next_chain_key"`
+	SentAtMs     int64  `json:"sent_at_ms"`
+	Text         string `json:"text"`
+	Payload      string `json:"payload"` // Inner payload, hex
+	Padded       string `json:"padded"`  // Payload after padding, hex
+	Nonce        string `json:"nonce"`
+	Line         string `json:"line"` // "num base64(version | nonce | AES-GCM)"
+}
+
+type vectorFile struct {
+	Description       string          `json:"description"`
+	Protocol          int             `json:"protocol"`
+	Alice             vectorParty     `json:"alice"`
+	Bob               vectorParty     `json:"bob"`
+	SharedSecret      string          `json:"shared_secret"` // x-coordinate of the ECDH point
+	Initiator         string          `json:"initiator"`     // Party with the smaller raw public key
+	Handshake         string          `json:"handshake"`     // Initiator's hello | responder's hello, hex
+	AESKey            string          `json:"aes_key"`       // HKDF-SHA256(shared, salt handshake, info "e2e-message-aes-key")
+	VerificationWords []string        `json:"verification_words"`
+	InitiatorChainKey string          `json:"initiator_chain_key"` // HKDF-SHA256(shared, salt handshake, info "e2e-ratchet-chains")[:32]
+	ResponderChainKey string          `json:"responder_chain_key"` // ...[32:64]
+	Padding           string          `json:"padding"`
+	MinBucket         int             `json:"min_bucket"`
+	Messages          []vectorMessage `json:"messages"`
+}
+
+const vectorsDescription = "Known-answer vectors for e2e-message protocol v1. " +
+	"Message keys come from HKDF-SHA256(chain_key | uint32be(num)) with info \"e2e-msg-key\", " +
+	"next chain keys the same with info \"e2e-chain-key\". The payload is " +
+	"version 1 | flags 0 | fields (tag, uvarint length, value; 2 = sent time in Unix ms as uvarint, 4 = text), " +
+	"padded with 0x80 and zeros, then sealed with AES-256-GCM with the version byte as associated data."
+
+// TestVectors checks the vectors against the primitives
+func TestVectors(t *testing.T) {
+	if *update {
+		writeVectors(t)
+	}
+	data, err := os.ReadFile(vectorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v vectorFile
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	got := computeVectors(t, v.Alice.PrivateKey, v.Bob.PrivateKey, v.Messages)
+	gotJSON, _ := json.MarshalIndent(got, "", "  ")
+	wantJSON, _ := json.MarshalIndent(v, "", "  ")
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("Vectors differ from %s:\n%s", vectorsPath, firstDiff(string(gotJSON), string(wantJSON)))
+	}
+
+	// The ratchet and a session-style decryption agree with the vectors
+	shared := mustHex(t, v.SharedSecret)
+	ratchets := map[string]*crypto.Ratchet{}
+	for _, p := range []string{"alice", "bob"} {
+		r, err := crypto.NewRatchet(shared, mustHex(t, v.Handshake), p == v.Initiator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		ratchets[p] = r
+	}
+	for _, m := range v.Messages {
+		key, num, err := ratchets[m.Sender].NextSendKey()
+		if err != nil || num != m.Num || hex.EncodeToString(key.Bytes()) != m.MessageKey {
+			t.Errorf("Ratchet send key %d of %s = %x, %v", num, m.Sender, key.Bytes(), err)
+		}
+		key.Destroy()
+
+		receiver := "alice"
+		if m.Sender == "alice" {
+			receiver = "bob"
+		}
+		key, err = ratchets[receiver].GetRecvKey(m.Num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n uint32
+		var encoded string
+		fmt.Sscanf(m.Line, "%d %s", &n, &encoded)
+		ct, _ := base64.StdEncoding.DecodeString(encoded)
+		if len(ct) == 0 || ct[0] != byte(v.Protocol) {
+			t.Fatalf("Message %d does not start with the version byte", m.Num)
+		}
+		padded, err := crypto.Open(nil, key.Bytes(), ct[1:], ct[:1])
+		key.Destroy()
+		if err != nil || hex.EncodeToString(padded) != m.Padded {
+			t.Errorf("Decrypting %q = %x, %v", m.Line, padded, err)
+		}
+	}
+}
+
+// computeVectors derives all outputs from the private keys and the
+// messages' sender, text, time and nonce
+func computeVectors(t *testing.T, alicePriv, bobPriv string, msgs []vectorMessage) vectorFile {
+	t.Helper()
+	v := vectorFile{
+		Description: vectorsDescription,
+		Protocol:    session.ProtocolVersion,
+		Padding:     crypto.PaddingPadme.String(),
+		MinBucket:   crypto.DefaultMinBucket,
+	}
+	alice, err := ecdh.P256().NewPrivateKey(mustHex(t, alicePriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ecdh.P256().NewPrivateKey(mustHex(t, bobPriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := []byte{0xE2, session.MinProtocolVersion, session.ProtocolVersion, byte(session.CapCompression)}
+	party := func(k *ecdh.PrivateKey) vectorParty {
+		pub := k.PublicKey().Bytes()
+		return vectorParty{
+			PrivateKey: hex.EncodeToString(k.Bytes()),
+			PublicKey:  hex.EncodeToString(pub),
+			WireKey:    session.EncodeKey(append(hello, pub...)),
+		}
+	}
+	v.Alice, v.Bob = party(alice), party(bob)
+
+	shared, err := crypto.ComputeSharedSecret(alice, bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.SharedSecret = hex.EncodeToString(shared)
+	v.Initiator = "bob"
+	if string(alice.PublicKey().Bytes()) < string(bob.PublicKey().Bytes()) {
+		v.Initiator = "alice"
+	}
+	// Both parties send the same hello
+	handshake := append(bytes.Clone(hello), hello...)
+	v.Handshake = hex.EncodeToString(handshake)
+
+	aesKey, err := crypto.DeriveAESKey(shared, handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aesKey.Destroy()
+	v.AESKey = hex.EncodeToString(aesKey.Bytes())
+	v.VerificationWords = crypto.GenerateVerificationWords(aesKey.Bytes())
+
+	initiator, responder := make([]byte, 32), make([]byte, 32)
+	if err := crypto.DeriveChainKeys(shared, handshake, initiator, responder); err != nil {
+		t.Fatal(err)
+	}
+	v.InitiatorChainKey, v.ResponderChainKey = hex.EncodeToString(initiator), hex.EncodeToString(responder)
+
+	chains := map[string][]byte{v.Initiator: initiator}
+	if v.Initiator == "alice" {
+		chains["bob"] = responder
+	} else {
+		chains["alice"] = responder
+	}
+	nums := map[string]uint32{}
+	for _, in := range msgs {
+		m := vectorMessage{Sender: in.Sender, Num: nums[in.Sender], SentAtMs: in.SentAtMs, Text: in.Text, Nonce: in.Nonce}
+		nums[in.Sender]++
+		chain := chains[m.Sender]
+		msgKey, next := make([]byte, 32), make([]byte, 32)
+		if err := crypto.DeriveMessageKey(chain, m.Num, msgKey, next); err != nil {
+			t.Fatal(err)
+		}
+		m.ChainKey, m.MessageKey, m.NextChainKey = hex.EncodeToString(chain), hex.EncodeToString(msgKey), hex.EncodeToString(next)
+		chains[m.Sender] = next
+
+		payload := textPayload(m.SentAtMs, m.Text)
+		padded := crypto.Pad(payload, crypto.PaddingPadme, crypto.DefaultMinBucket)
+		header := []byte{session.ProtocolVersion}
+		ct, err := crypto.EncryptWithNonce(padded, msgKey, mustHex(t, m.Nonce), header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Payload, m.Padded = hex.EncodeToString(payload), hex.EncodeToString(padded)
+		m.Line = fmt.Sprintf("%d %s", m.Num, base64.StdEncoding.EncodeToString(append(header, ct...)))
+		v.Messages = append(v.Messages, m)
+	}
+	return v
+}
+
+// textPayload builds the inner payload of a text message
+func textPayload(sentAtMs int64, text string) []byte {
+	payload := []byte{1, 0} // Version 1, no flags
+	field := func(tag byte, value []byte) {
+		payload = append(payload, tag)
+		payload = binary.AppendUvarint(payload, uint64(len(value)))
+		payload = append(payload, value...)
+	}
+	field(2, binary.AppendUvarint(nil, uint64(sentAtMs)))
+	field(4, []byte(text))
+	return payload
+}
+
+// writeVectors regenerates the vectors from fixed inputs
+func writeVectors(t *testing.T) {
+	label := func(s string) string {
+		h := sha256.Sum256([]byte("e2e-message test vector " + s))
+		return hex.EncodeToString(h[:])
+	}
+	nonce := func(i int) string {
+		return label(fmt.Sprintf("nonce %d", i))[:2*crypto.NonceSize]
+	}
+	texts := []struct{ sender, text string }{
+		{"alice", "Hello Bob"},
+		{"alice", "Are you there?"},
+		{"bob", "Hi Alice, I am here."},
+		{"alice", "Unicode: 你好, Grüße, 🙂"},
+		{"bob", "A longer message that does not fit into the smallest padding bucket, so it shows Padmé rounding."},
+	}
+	var msgs []vectorMessage
+	for i, m := range texts {
+		msgs = append(msgs, vectorMessage{Sender: m.sender, Text: m.text, SentAtMs: 1700000000000 + int64(i)*60000, Nonce: nonce(i)})
+	}
+	v := computeVectors(t, label("alice"), label("bob"), msgs)
+	data, _ := json.MarshalIndent(v, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(vectorsPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(vectorsPath, append(data, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// firstDiff returns the first differing line of two texts
+func firstDiff(got, want string) string {
+	gl, wl := bytes.Split([]byte(got), []byte("\n")), bytes.Split([]byte(want), []byte("\n"))
+	for i := 0; i < len(gl) && i < len(wl); i++ {
+		if !bytes.Equal(gl[i], wl[i]) {
+			return fmt.Sprintf("line %d: got %s, want %s", i+1, gl[i], wl[i])
+		}
+	}
+	return fmt.Sprintf("got %d lines, want %d", len(gl), len(wl))
+}
+
+// TestVectorsSessions replays the vectors through two sessions whose
+// randomness and clock are fixed with WithRand and WithClock
+func TestVectorsSessions(t *testing.T) {
+	data, err := os.ReadFile(vectorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v vectorFile
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each session reads its private key, then its nonces in order
+	entropy := map[string][]byte{
+		"alice": mustHex(t, v.Alice.PrivateKey),
+		"bob":   mustHex(t, v.Bob.PrivateKey),
+	}
+	for _, m := range v.Messages {
+		entropy[m.Sender] = append(entropy[m.Sender], mustHex(t, m.Nonce)...)
+	}
+	clock := newFakeClock()
+	sessions := map[string]*session.Session{}
+	for _, p := range []string{"alice", "bob"} {
+		s, err := session.NewSession(session.WithRand(bytes.NewReader(entropy[p])), session.WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		sessions[p] = s
+	}
+	if got := sessions["alice"].GetPublicKeyBase64(); got != v.Alice.WireKey {
+		t.Errorf("Alice's key = %s, want %s", got, v.Alice.WireKey)
+	}
+	if got := sessions["bob"].GetPublicKeyBase64(); got != v.Bob.WireKey {
+		t.Errorf("Bob's key = %s, want %s", got, v.Bob.WireKey)
+	}
+	if err := sessions["alice"].SetPeerPublicKey(v.Bob.WireKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions["bob"].SetPeerPublicKey(v.Alice.WireKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range v.Messages {
+		receiver := "alice"
+		if m.Sender == "alice" {
+			receiver = "bob"
+		}
+		clock.Set(time.UnixMilli(m.SentAtMs))
+		line, err := sessions[m.Sender].Encrypt(m.Text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != m.Line {
+			t.Errorf("Message %d of %s = %q, want %q", m.Num, m.Sender, line, m.Line)
+		}
+		got, err := sessions[receiver].DecryptMessage(line)
+		if err != nil || got.Text != m.Text || got.SentAt.UnixMilli() != m.SentAtMs {
+			t.Errorf("Decrypting message %d of %s = %+v, %v", m.Num, m.Sender, got, err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/peterh/liner"
+
+	"e2e-message/internal/identity"
+	"e2e-message/internal/session"
+	"e2e-message/internal/transcript"
+	"e2e-message/internal/wipe"
+)
+
+func TestWipeFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(path, []byte("meet at the old mill"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wipe.File(path); err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Errorf("Files left behind: %v", left)
+	}
+	if err := wipe.File(path); err != nil {
+		t.Errorf("Wiping a missing file should succeed, got %v", err)
+	}
+}
+
+func TestDuressPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	guarded := filepath.Join(dir, "guarded")
+
+	for _, path := range []string{plain, guarded} {
+		tr, err := transcript.Create(path, "real")
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if path == guarded {
+			if err := tr.SetDuressPassphrase("real"); err == nil {
+				t.Error("Duress passphrase equal to the real one was accepted")
+			}
+			if err := tr.SetDuressPassphrase("duress"); err != nil {
+				t.Fatalf("SetDuressPassphrase failed: %v", err)
+			}
+		}
+		tr.Close()
+	}
+
+	// A duress passphrase must not be detectable from the file
+	a, _ := os.Stat(plain)
+	b, _ := os.Stat(guarded)
+	if a.Size() != b.Size() {
+		t.Errorf("File sizes differ: %d vs %d", a.Size(), b.Size())
+	}
+
+	if _, err := transcript.Open(guarded, "duress"); !errors.Is(err, transcript.ErrDuress) {
+		t.Errorf("Expected ErrDuress, got %v", err)
+	}
+	if _, err := transcript.Open(plain, "duress"); !errors.Is(err, transcript.ErrWrongPassphrase) {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+
+	tr, err := transcript.Open(guarded, "real")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := tr.SetDuressPassphrase(""); err != nil {
+		t.Fatalf("Removing the duress passphrase failed: %v", err)
+	}
+	tr.Close()
+	if _, err := transcript.Open(guarded, "duress"); !errors.Is(err, transcript.ErrWrongPassphrase) {
+		t.Errorf("Removed duress passphrase still works: %v", err)
+	}
+}
+
+func TestDuressUnlockTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Times several scrypt derivations")
+	}
+	path := filepath.Join(t.TempDir(), "chat")
+	tr, err := transcript.Create(path, "real")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	tr.SetDuressPassphrase("duress")
+	tr.Close()
+
+	// The duress unlock must not take visibly longer than the real one;
+	// deriving the duress key only after the real key failed doubled it
+	fastest := func(pass string) time.Duration {
+		best := time.Duration(1<<63 - 1)
+		for i := 0; i < 2; i++ {
+			start := time.Now()
+			if tr, err := transcript.Open(path, pass); err == nil {
+				tr.Close()
+			}
+			best = min(best, time.Since(start))
+		}
+		return best
+	}
+	genuine, duress := fastest("real"), fastest("duress")
+	if duress > genuine*3/2 {
+		t.Errorf("Duress unlock took %v, real unlock %v", duress, genuine)
+	}
+}
+
+func TestOpenDecoy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat")
+	tr, err := transcript.Create(path, "real")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	tr.Add(transcript.Entry{Text: "meet at the old mill"})
+	tr.SetDuressPassphrase("duress")
+	tr.Close()
+
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTranscript()
+	decoy, err := openDecoy(sess, path, "duress")
+	if err != nil {
+		t.Fatalf("openDecoy failed: %v", err)
+	}
+	defer decoy.Close()
+	if decoy == sess || decoy.GetPublicKeyBase64() == sess.GetPublicKeyBase64() {
+		t.Error("Decoy reuses the original session")
+	}
+	if _, err := sess.Encrypt("x"); err == nil {
+		t.Error("Original session still usable")
+	}
+	if n := len(transcriptDB.Entries()); n != 0 {
+		t.Errorf("Decoy transcript has %d entries", n)
+	}
+
+	// The decoy opens with the passphrase that was entered
+	closeTranscript()
+	tr, err = transcript.Open(path, "duress")
+	if err != nil {
+		t.Fatalf("Reopening the decoy failed: %v", err)
+	}
+	tr.Close()
+}
+
+func TestOpenDecoyDeniableIdentity(t *testing.T) {
+	// Run as with --deniable --identity: the decoy must accept the next key
+	// import the way the original session would
+	deniable, identityPath = true, sshTestFile("id_ed25519")
+	defer func() { deniable, identityPath = false, "" }()
+	defer closeIdentity()
+
+	peer, _ := identity.Generate()
+	defer peer.Close()
+	pin, _ := identity.X25519PublicKey(peer.PublicKey())
+
+	sess, err := newSession()
+	if err != nil {
+		t.Fatalf("newSession failed: %v", err)
+	}
+	if err := sess.SetPeerIdentityKey(pin); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "chat")
+	tr, err := transcript.Create(path, "real")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	tr.SetDuressPassphrase("duress")
+	tr.Close()
+	defer closeTranscript()
+
+	decoy, err := openDecoy(sess, path, "duress")
+	if err != nil {
+		t.Fatalf("openDecoy failed: %v", err)
+	}
+	defer decoy.Close()
+	if !decoy.GetDeniable() || decoy.GetIdentityPublicKey() == nil || !bytes.Equal(decoy.GetPeerIdentityKey(), pin) {
+		t.Fatalf("Decoy lost the session setup: deniable %v, identity %x, pin %x",
+			decoy.GetDeniable(), decoy.GetIdentityPublicKey(), decoy.GetPeerIdentityKey())
+	}
+
+	me, err := loadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := deniableSession(t, peer, me)
+	defer other.Close()
+	connectSessions(t, decoy, other)
+	ct, _ := other.Encrypt("hello")
+	if pt, err := decoy.Decrypt(ct); err != nil || pt != "hello" {
+		t.Errorf("Decoy Decrypt = %q, %v", pt, err)
+	}
+}
+
+func TestWipeAll(t *testing.T) {
+	t.Setenv("E2E_MESSAGE_HOME", t.TempDir())
+	if _, err := loadIdentity(); err != nil {
+		t.Fatalf("loadIdentity failed: %v", err)
+	}
+	identityPath, _ := dataPath(identityFile)
+
+	line = liner.NewLiner()
+	defer line.Close()
+	line.AppendHistory("status")
+
+	path := filepath.Join(t.TempDir(), "chat")
+	var err error
+	if transcriptDB, err = transcript.Create(path, "pw"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wipeAll(sess)
+
+	if transcriptDB != nil || ident != nil {
+		t.Error("Transcript or identity still open")
+	}
+	if _, err := os.Stat(identityPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Identity file not deleted: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Transcript file not deleted: %v", err)
+	}
+	if _, err := sess.Encrypt("x"); !errors.Is(err, session.ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if n, _ := line.WriteHistory(io.Discard); n != 0 {
+		t.Errorf("History has %d entries", n)
+	}
+}